@@ -0,0 +1,434 @@
+package gshellos
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+)
+
+var reconcileInterval = "30" // in seconds
+
+// apply actions
+const (
+	applyStart   = "start"   // the job is missing
+	applyRestart = "restart" // the job is changed, the GRE is removed and the job started again
+	applyRemove  = "remove"  // the GRE is stopped and removed
+)
+
+type applyStep struct {
+	Action string
+	GRG    string
+	Job    string
+	GREID  string // of the GRE to be restarted or removed
+	Reason string
+}
+
+type greJobState struct {
+	ID      string
+	Stat    string
+	JobCmd  JobCmd // without code
+	CodeSum string // sha256 of the code
+}
+
+type grgJobStates struct {
+	Name string
+	GREs []*greJobState
+}
+
+func codeSum(zip []byte) string {
+	if len(zip) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(zip))
+}
+
+// reply *grgJobStates
+type grgCmdJobStates struct{}
+
+func (msg grgCmdJobStates) Handle(stream as.ContextStream) (reply interface{}) {
+	grg := stream.GetContext().(*grg)
+	gjs := &grgJobStates{Name: grg.name}
+
+	grg.RLock()
+	for _, greid := range grg.greids {
+		gc := grg.gres[greid]
+		js := &greJobState{ID: gc.ID, Stat: gc.Stat, JobCmd: gc.runMsg.JobCmd}
+		js.JobCmd.CodeZip = nil
+		func() {
+			file, err := os.Open(filepath.Join(gc.statDir, "runMsg"))
+			if err != nil {
+				return
+			}
+			defer file.Close()
+			runMsg := grgCmdRun{}
+			if err := gob.NewDecoder(file).Decode(&runMsg); err != nil {
+				return
+			}
+			js.CodeSum = codeSum(runMsg.CodeZip)
+		}()
+		gjs.GREs = append(gjs.GREs, js)
+	}
+	grg.RUnlock()
+
+	return gjs
+}
+
+func normalizeJobCmd(jc JobCmd) JobCmd {
+	for _, sl := range []*[]string{&jc.Args, &jc.Env, &jc.Secrets, &jc.DependsOn} {
+		if len(*sl) == 0 {
+			*sl = nil
+		}
+	}
+	jc.Name = ""
+	jc.CodeZip = nil
+	return jc
+}
+
+// sameJob tells if the running GRE is the job, the code and its signature
+// are only compared if given in the joblist, or else they are from the repo.
+func sameJob(want *JobCmd, have *greJobState) bool {
+	if len(want.CodeZip) != 0 && codeSum(want.CodeZip) != have.CodeSum {
+		return false
+	}
+	w, h := normalizeJobCmd(*want), normalizeJobCmd(have.JobCmd)
+	if len(w.CodeSig) == 0 {
+		h.CodeSig = ""
+	}
+	return reflect.DeepEqual(w, h)
+}
+
+// planApply compares the joblist with the running GREs and the settings of
+// their GRGs, only the GRGs in the joblist are managed. The GRG with its
+// settings changed is recreated with all its jobs restarted.
+func planApply(jlist *joblist, current map[string][]*greJobState, settings map[string]grgSettings) []*applyStep {
+	var steps []*applyStep
+	for _, grgjl := range jlist.GRGs {
+		grgName := strings.Split(grgjl.Name, "-")[0]
+		gres := current[grgName]
+		limits, _ := grgjl.limits() // the conflict is reported on GRG setup
+		grgChanged := ""
+		if len(gres) != 0 {
+			grgChanged = newGrgSettings(grgjl.RtPriority, grgjl.Maxprocs, limits).diff(settings[grgName])
+		}
+		wanted := make(map[string]bool)
+		for _, job := range grgjl.Jobs {
+			name := job.name()
+			wanted[name] = true
+			kept := false
+			var olds []*greJobState
+			for _, js := range gres {
+				if js.JobCmd.name() != name {
+					continue
+				}
+				if !kept && len(grgChanged) == 0 && sameJob(&job.JobCmd, js) {
+					kept = true
+					continue
+				}
+				olds = append(olds, js)
+			}
+			switch {
+			case kept:
+				for _, js := range olds {
+					steps = append(steps, &applyStep{applyRemove, grgName, name, js.ID, "duplicated"})
+				}
+			case len(olds) == 0:
+				steps = append(steps, &applyStep{applyStart, grgName, name, "", "missing"})
+			default:
+				reason := "changed"
+				if len(grgChanged) != 0 {
+					reason = "grg changed: " + grgChanged
+				}
+				steps = append(steps, &applyStep{applyRestart, grgName, name, olds[0].ID, reason})
+				for _, js := range olds[1:] {
+					steps = append(steps, &applyStep{applyRemove, grgName, name, js.ID, "duplicated"})
+				}
+			}
+		}
+		for _, js := range gres {
+			if name := js.JobCmd.name(); !wanted[name] {
+				steps = append(steps, &applyStep{applyRemove, grgName, name, js.ID, "not in joblist"})
+			}
+		}
+	}
+	return steps
+}
+
+// jobStates returns the GREs in the running GRGs and the settings of the GRGs
+// by GRG name without version.
+func (gd *daemon) jobStates() (map[string][]*greJobState, map[string]grgSettings) {
+	current := make(map[string][]*greJobState)
+	settings := make(map[string]grgSettings)
+	c := as.NewClient(as.WithLogger(gd.lg), as.WithScope(as.ScopeOS)).SetDiscoverTimeout(0)
+	connChan := c.Discover(godevsigPublisher, "grg-*")
+	for conn := range connChan {
+		var gjs *grgJobStates
+		conn.SetRecvTimeout(time.Second)
+		if err := conn.SendRecv(grgCmdJobStates{}, &gjs); err != nil {
+			gd.lg.Warnf("jobStates: send recv error: %v", err)
+		}
+		if gjs != nil {
+			grgName := strings.Split(gjs.Name, "-")[0]
+			current[grgName] = append(current[grgName], gjs.GREs...)
+			settings[grgName] = gd.loadGrgSettings(grgName)
+		}
+		conn.Close()
+	}
+	return current, settings
+}
+
+// removeGRE stops the GRE gracefully and removes it.
+func (gd *daemon) removeGRE(greid string) error {
+	conn, _ := gd.findGRE(greid)
+	if conn == nil {
+		return nil // already gone
+	}
+	defer conn.Close()
+	if err := conn.SendRecv(&grgCmdPatternAction{[]string{greid}, "stop", stopGraceDefault}, nil); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(stopGraceDefault + 3*time.Second); time.Now().Before(deadline); {
+		var greids []string
+		if err := conn.SendRecv(&grgCmdPatternAction{[]string{greid}, "rm", 0}, &greids); err != nil {
+			return err
+		}
+		if len(greids) != 0 {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("GRE %s not stopped", greid)
+}
+
+// waitGRGExit waits for the GRGs with the name of any version to exit.
+func (gd *daemon) waitGRGExit(grgName string) {
+	c := as.NewClient(as.WithLogger(gd.lg), as.WithScope(as.ScopeOS)).SetDiscoverTimeout(0)
+	for i := 0; i < 30; i++ {
+		found := false
+		for conn := range c.Discover(godevsigPublisher, "grg-"+grgName+"-*") {
+			found = true
+			conn.Close()
+		}
+		if !found {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// doApply brings the running jobs to the joblist, and returns the steps done
+// or to be done if dryRun.
+func (gd *daemon) doApply(jlist *joblist, requestedBy string, dryRun bool) ([]*applyStep, error) {
+	jobs, err := jlist.sortJobs()
+	if err != nil {
+		return nil, fmt.Errorf("apply joblist error: %v", err)
+	}
+	current, settings := gd.jobStates()
+	steps := planApply(jlist, current, settings)
+	if dryRun || len(steps) == 0 {
+		return steps, nil
+	}
+
+	errChan := make(chan error, len(steps)+len(jlist.GRGs)+len(jobs))
+	toStart := make(map[string]bool)
+	removed := make(map[string]int)
+	for _, st := range steps {
+		if st.Action == applyRestart || st.Action == applyRemove {
+			if err := gd.removeGRE(st.GREID); err != nil {
+				errChan <- fmt.Errorf("GRE %s not removed: %v", st.GREID, err)
+				continue
+			}
+			removed[st.GRG]++
+			gd.lg.Infof("GRE %s of job %s in grg %s removed: %s", st.GREID, st.Job, st.GRG, st.Reason)
+		}
+		if st.Action == applyRestart || st.Action == applyStart {
+			toStart[st.GRG+"/"+st.Job] = true
+		}
+	}
+	// the GRG exits after its last GRE is removed
+	for grgName, n := range removed {
+		if n == len(current[grgName]) {
+			gd.waitGRGExit(grgName)
+		}
+	}
+
+	var grgs []grgJoblist
+	grgStarting := make(map[string]bool)
+	for _, lj := range jobs {
+		grgName := strings.Split(lj.grgName, "-")[0]
+		if toStart[grgName+"/"+lj.job.name()] {
+			grgStarting[lj.grgName] = true
+		} else {
+			lj.started = true // kept running
+		}
+	}
+	for _, grgjl := range jlist.GRGs {
+		if grgStarting[grgjl.Name] {
+			grgs = append(grgs, grgjl)
+		}
+	}
+	grgConns := gd.setupgrgs(grgs, errChan)
+	defer func() {
+		for _, grgconn := range grgConns {
+			grgconn.Close()
+		}
+	}()
+	gd.startJobs(jobs, grgConns, requestedBy, errChan)
+
+	if len(errChan) == 0 {
+		return steps, nil
+	}
+	close(errChan)
+	err = errors.New("apply joblist error")
+	for e := range errChan {
+		err = fmt.Errorf("%v, %v", err, e)
+	}
+	return steps, err
+}
+
+type appliedJoblist struct {
+	Joblist     joblist
+	RequestedBy string
+}
+
+// applier keeps the last applied joblist in the work dir to be reconciled in
+// the background.
+type applier struct {
+	sync.Mutex
+	file    string
+	applied *appliedJoblist // nil if not applied or stopped
+}
+
+func newApplier(workDir string) *applier {
+	ap := &applier{file: filepath.Join(workDir, "applied.joblist")}
+	file, err := os.Open(ap.file)
+	if err != nil {
+		return ap
+	}
+	defer file.Close()
+	applied := &appliedJoblist{}
+	if err := gob.NewDecoder(file).Decode(applied); err == nil {
+		ap.applied = applied
+	}
+	return ap
+}
+
+// save must be called with lock held.
+func (ap *applier) save() error {
+	if ap.applied == nil {
+		err := os.Remove(ap.file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	tmpFile := ap.file + ".tmp"
+	file, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(ap.applied); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	return os.Rename(tmpFile, ap.file)
+}
+
+// stop stops the background reconciliation, the jobs keep running.
+func (ap *applier) stop() error {
+	ap.Lock()
+	defer ap.Unlock()
+	ap.applied = nil
+	return ap.save()
+}
+
+// reconciler applies the last applied joblist periodically, so the jobs
+// that disappeared come back.
+func (gd *daemon) reconciler() {
+	interval, _ := strconv.Atoi(reconcileInterval)
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		func() {
+			gd.applier.Lock()
+			defer gd.applier.Unlock()
+			applied := gd.applier.applied
+			if applied == nil {
+				return
+			}
+			steps, err := gd.doApply(&applied.Joblist, applied.RequestedBy, false)
+			for _, st := range steps {
+				gd.lg.Infof("reconcile: %s job %s in grg %s: %s", st.Action, st.Job, st.GRG, st.Reason)
+			}
+			if err != nil {
+				gd.lg.Warnf("reconcile: %v", err)
+			}
+		}()
+	}
+}
+
+// reply with []*applyStep or error
+type cmdApply struct {
+	joblist
+	DryRun bool
+	Stop   bool // stop the background reconciliation
+}
+
+func (msg *cmdApply) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	need, cmd := roleAdmin, "apply"
+	if msg.DryRun {
+		need, cmd = roleReadOnly, "diff"
+	}
+	if err := gd.authorize(stream, need, cmd); err != nil {
+		return err
+	}
+	gd.lg.Debugf("handle cmdApply: dry run %v, stop %v", msg.DryRun, msg.Stop)
+
+	if msg.Stop {
+		if err := gd.applier.stop(); err != nil {
+			return err
+		}
+		gd.lg.Infoln("joblist reconciliation stopped")
+		return []*applyStep(nil)
+	}
+
+	gd.applier.Lock()
+	defer gd.applier.Unlock()
+	requestedBy := gd.requester(stream)
+	steps, err := gd.doApply(&msg.joblist, requestedBy, msg.DryRun)
+	if msg.DryRun {
+		if err != nil {
+			return err
+		}
+		return steps
+	}
+	if steps == nil && err != nil { // joblist not valid
+		return err
+	}
+	gd.applier.applied = &appliedJoblist{msg.joblist, requestedBy}
+	if err := gd.applier.save(); err != nil {
+		gd.lg.Warnf("applied joblist not saved: %v", err)
+	}
+	if err != nil {
+		return err
+	}
+	return steps
+}
+
+func init() {
+	as.RegisterType(grgCmdJobStates{})
+	as.RegisterType((*grgJobStates)(nil))
+	as.RegisterType((*cmdApply)(nil))
+	as.RegisterType((*applyStep)(nil))
+	as.RegisterType([]*applyStep(nil))
+}
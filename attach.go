@@ -0,0 +1,236 @@
+package gshellos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	as "github.com/godevsig/adaptiveservice"
+)
+
+const attachInputMax = 64 * 1024 // max pending input bytes not yet read by the GRE
+
+// attacher connects the client attached to a non-interactive GRE with the
+// stdio of the GRE. At most one client can be attached at a time.
+type attacher struct {
+	sync.Mutex
+	out     io.Writer     // of the attached client, nil if detached
+	quit    chan error    // to end the attached session
+	pending []byte        // input not yet read by the GRE
+	ready   chan struct{} // pending input available
+	taps    []io.Writer   // of the clients only receiving the output
+}
+
+func newAttacher() *attacher {
+	return &attacher{ready: make(chan struct{}, 1)}
+}
+
+// Write sends the output of the GRE to the attached client and taps, never fails.
+func (at *attacher) Write(p []byte) (int, error) {
+	at.Lock()
+	defer at.Unlock()
+	if at.out != nil {
+		if _, err := at.out.Write(p); err != nil {
+			at.out = nil
+		}
+	}
+	for _, w := range at.taps {
+		w.Write(p)
+	}
+	return len(p), nil
+}
+
+func (at *attacher) tap(w io.Writer) {
+	at.Lock()
+	at.taps = append(at.taps, w)
+	at.Unlock()
+}
+
+func (at *attacher) untap(w io.Writer) {
+	at.Lock()
+	defer at.Unlock()
+	for i, tap := range at.taps {
+		if tap == w {
+			at.taps = append(at.taps[:i], at.taps[i+1:]...)
+			return
+		}
+	}
+}
+
+// reader returns the stdin of the GRE for one run. Reading blocks until there
+// is input from the attached client, and returns EOF once end is closed.
+func (at *attacher) reader(end <-chan struct{}) io.Reader {
+	return &attachReader{at, end}
+}
+
+type attachReader struct {
+	at  *attacher
+	end <-chan struct{}
+}
+
+func (ar *attachReader) Read(p []byte) (int, error) {
+	at := ar.at
+	for {
+		at.Lock()
+		if len(at.pending) != 0 {
+			n := copy(p, at.pending)
+			at.pending = at.pending[n:]
+			at.Unlock()
+			return n, nil
+		}
+		at.Unlock()
+		select {
+		case <-at.ready:
+		case <-ar.end:
+			return 0, io.EOF
+		}
+	}
+}
+
+func (at *attacher) feed(p []byte) error {
+	at.Lock()
+	defer at.Unlock()
+	if len(at.pending)+len(p) > attachInputMax {
+		return errors.New("GRE not reading input")
+	}
+	at.pending = append(at.pending, p...)
+	select {
+	case at.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (at *attacher) attach(out io.Writer) (chan error, error) {
+	at.Lock()
+	defer at.Unlock()
+	if at.out != nil {
+		return nil, errors.New("GRE already attached")
+	}
+	at.out = out
+	at.quit = make(chan error, 1)
+	return at.quit, nil
+}
+
+func (at *attacher) detach(quit chan error) {
+	at.Lock()
+	defer at.Unlock()
+	if at.quit == quit {
+		at.out = nil
+		at.quit = nil
+	}
+}
+
+// end ends the attached session if any with the reason.
+func (at *attacher) end(reason error) {
+	at.Lock()
+	defer at.Unlock()
+	if at.quit != nil {
+		at.quit <- reason
+		at.out = nil
+		at.quit = nil
+	}
+}
+
+// stream of IO with the GRE until detached
+type grgCmdAttach struct {
+	GREID string
+}
+
+func (msg *grgCmdAttach) Handle(stream as.ContextStream) (reply interface{}) {
+	grg := stream.GetContext().(*grg)
+	grg.RLock()
+	gc := grg.gres[msg.GREID]
+	grg.RUnlock()
+	if gc == nil {
+		return fmt.Errorf("GRE %s not found", msg.GREID)
+	}
+	if gc.runMsg.Interactive {
+		return fmt.Errorf("GRE %s is interactive", msg.GREID)
+	}
+	if stat := atomic.LoadInt32(&gc.stat); stat != greStatRunning && stat != greStatUnhealthy {
+		return fmt.Errorf("GRE %s is %s", msg.GREID, greStatString[stat])
+	}
+
+	clientIO := as.NewStreamIO(stream)
+	quit, err := gc.attacher.attach(clientIO)
+	if err != nil {
+		return err
+	}
+	defer gc.attacher.detach(quit)
+	grg.lg.Debugf("gre %s attached", gc.ID)
+
+	input := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := clientIO.Read(buf)
+			if err != nil {
+				input <- nil // detached by client
+				return
+			}
+			if err := gc.attacher.feed(buf[:n]); err != nil {
+				input <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err = <-input:
+	case err = <-quit:
+	}
+	grg.lg.Debugf("gre %s detached", gc.ID)
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// stream of IO with the GRE until detached
+type cmdAttach struct {
+	GREID string
+}
+
+func (msg *cmdAttach) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleOperator, "attach"); err != nil {
+		return err
+	}
+	gd.lg.Debugf("handle cmdAttach: %v", msg)
+	return gd.streamGRE(stream, msg.GREID, &grgCmdAttach{msg.GREID})
+}
+
+// streamGRE sends the message to the GRG where the GRE is, and relays the
+// stream between the client and the GRG.
+func (gd *daemon) streamGRE(stream as.ContextStream, greid string, msg interface{}) error {
+	conn, _ := gd.findGRE(greid)
+	if conn == nil {
+		return fmt.Errorf("GRE %s not found", greid)
+	}
+	defer conn.Close()
+	conn.SetRecvTimeout(0)
+	if err := conn.Send(msg); err != nil {
+		return err
+	}
+
+	client := as.NewStreamIO(stream)
+	grg := as.NewStreamIO(conn)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(client, grg)
+		done <- err
+	}()
+	go func() { io.Copy(grg, client); done <- nil }()
+	if err := <-done; err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func init() {
+	as.RegisterType((*grgCmdAttach)(nil))
+	as.RegisterType((*cmdAttach)(nil))
+}
@@ -0,0 +1,475 @@
+package gshellos
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/glib/sys/log"
+	"gopkg.in/yaml.v3"
+)
+
+// the roles of the callers, a role is also granted the commands of the lower roles
+const (
+	roleNone = iota
+	roleReadOnly
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = []string{"none", "read-only", "operator", "admin"}
+
+func parseRole(str string) (int, error) {
+	for role, name := range roleNames {
+		if name == str {
+			return role, nil
+		}
+	}
+	return roleNone, fmt.Errorf("unknown role %q, one of none, read-only, operator or admin expected", str)
+}
+
+type aclEntry struct {
+	ID   string `yaml:"id"`            // provider ID, self for the callers on the same node
+	Role string `yaml:"role"`          // none, read-only, operator or admin
+	Key  string `yaml:"key,omitempty"` // node key shown by gshell id -key, required for remote providers
+}
+
+// aclConfig is the access control list in acl.yaml of the daemon work dir.
+type aclConfig struct {
+	Default   string      `yaml:"default,omitempty"` // role of the callers not listed, none if not specified
+	Providers []*aclEntry `yaml:"providers,omitempty"`
+}
+
+func (acl *aclConfig) validate() error {
+	if len(acl.Default) != 0 {
+		if _, err := parseRole(acl.Default); err != nil {
+			return err
+		}
+	}
+	for _, entry := range acl.Providers {
+		if len(entry.ID) == 0 {
+			return errors.New("provider ID not specified")
+		}
+		if _, err := parseRole(entry.Role); err != nil {
+			return fmt.Errorf("provider %s: %v", entry.ID, err)
+		}
+		if len(entry.Key) != 0 {
+			if key, err := base64.StdEncoding.DecodeString(entry.Key); err != nil || len(key) != ed25519.PublicKeySize {
+				return fmt.Errorf("provider %s: wrong key", entry.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// accessControl identifies the callers of the daemon and checks their roles.
+// Callers on the same node are self, remote callers are anonymous unless
+// they have proved their provider ID with the node key.
+// All callers are admin if there is no acl file.
+type accessControl struct {
+	sync.Mutex
+	lg      *log.Logger
+	workDir string
+	modTime time.Time  // of the acl file loaded
+	acl     *aclConfig // nil if no acl file
+	aclErr  error
+	key     ed25519.PrivateKey
+	selfID  string
+	nonces  map[as.Netconn][]byte // issued challenges
+	callers map[as.Netconn]string // authenticated provider IDs
+	audit   *logFile
+}
+
+func newAccessControl(workDir string, lg *log.Logger) *accessControl {
+	return &accessControl{
+		lg:      lg,
+		workDir: workDir,
+		nonces:  make(map[as.Netconn][]byte),
+		callers: make(map[as.Netconn]string),
+	}
+}
+
+func (ac *accessControl) onDisconnect(netconn as.Netconn) {
+	ac.Lock()
+	delete(ac.nonces, netconn)
+	delete(ac.callers, netconn)
+	ac.Unlock()
+}
+
+func isLocal(netconn as.Netconn) bool {
+	network := netconn.LocalAddr().Network()
+	return network == "unix" || network == "chan"
+}
+
+// caller returns the provider ID of the caller, empty if anonymous.
+func (ac *accessControl) caller(netconn as.Netconn) string {
+	if isLocal(netconn) {
+		return "self"
+	}
+	ac.Lock()
+	defer ac.Unlock()
+	return ac.callers[netconn]
+}
+
+// loadACL reloads the acl file if changed, must be called with lock held.
+func (ac *accessControl) loadACL() {
+	file := filepath.Join(ac.workDir, "acl.yaml")
+	fi, err := os.Stat(file)
+	if err != nil {
+		ac.acl, ac.aclErr, ac.modTime = nil, nil, time.Time{}
+		if !os.IsNotExist(err) {
+			ac.aclErr = err
+		}
+		return
+	}
+	if fi.ModTime().Equal(ac.modTime) {
+		return
+	}
+	ac.modTime = fi.ModTime()
+	ac.acl, ac.aclErr = nil, nil
+	data, err := os.ReadFile(file)
+	if err != nil {
+		ac.aclErr = err
+		return
+	}
+	acl := &aclConfig{}
+	if err := yaml.Unmarshal(data, acl); err != nil {
+		ac.aclErr = fmt.Errorf("parse %s error: %v", file, err)
+		return
+	}
+	if err := acl.validate(); err != nil {
+		ac.aclErr = fmt.Errorf("parse %s error: %v", file, err)
+		return
+	}
+	ac.acl = acl
+	ac.lg.Infof("acl %s loaded", file)
+}
+
+// role returns the role of the caller. If the acl file is wrong, only
+// self is allowed and is admin.
+func (ac *accessControl) role(caller string) int {
+	ac.Lock()
+	defer ac.Unlock()
+	ac.loadACL()
+	if ac.aclErr != nil {
+		ac.lg.Errorf("acl: %v", ac.aclErr)
+		if caller == "self" {
+			return roleAdmin
+		}
+		return roleNone
+	}
+	if ac.acl == nil {
+		return roleAdmin
+	}
+	if len(caller) != 0 {
+		for _, entry := range ac.acl.Providers {
+			if entry.ID == caller {
+				role, _ := parseRole(entry.Role)
+				return role
+			}
+		}
+	}
+	if caller == "self" {
+		return roleAdmin
+	}
+	role, _ := parseRole(ac.acl.Default)
+	return role
+}
+
+// providerKey returns the key of the provider in the acl file.
+func (ac *accessControl) providerKey(providerID string) ed25519.PublicKey {
+	ac.Lock()
+	defer ac.Unlock()
+	ac.loadACL()
+	if ac.acl == nil {
+		return nil
+	}
+	for _, entry := range ac.acl.Providers {
+		if entry.ID == providerID {
+			key, _ := base64.StdEncoding.DecodeString(entry.Key)
+			return key
+		}
+	}
+	return nil
+}
+
+func (ac *accessControl) auditf(format string, args ...interface{}) {
+	ac.Lock()
+	defer ac.Unlock()
+	if ac.audit == nil {
+		audit, err := openLogFile(filepath.Join(ac.workDir, "logs", "audit.log"), LogRotation{})
+		if err != nil {
+			ac.lg.Errorf("open audit log failed: %v", err)
+			return
+		}
+		ac.audit = audit
+	}
+	fmt.Fprintf(ac.audit, "[%s] %s\n", time.Now().Format("2006/01/02 15:04:05.000000"), fmt.Sprintf(format, args...))
+}
+
+// nodeKey returns the key of this node, generated on first use.
+func (ac *accessControl) nodeKey() (ed25519.PrivateKey, error) {
+	ac.Lock()
+	defer ac.Unlock()
+	if ac.key != nil {
+		return ac.key, nil
+	}
+	file, err := keyFile(ac.workDir, "node.key")
+	if err != nil {
+		return nil, err
+	}
+	seed, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(file, seed, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("node key %s corrupted", file)
+	}
+	ac.key = ed25519.NewKeyFromSeed(seed)
+	return ac.key, nil
+}
+
+// keyFile returns the path of the key file of the name in the keys dir of the
+// work dir, no command reads files there. The key file directly in the work
+// dir written by older versions is moved there.
+func keyFile(workDir, name string) (string, error) {
+	dir := filepath.Join(workDir, "keys")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, name)
+	oldFile := filepath.Join(workDir, name)
+	if _, err := os.Stat(oldFile); err == nil {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			if err := os.Rename(oldFile, file); err != nil {
+				return "", err
+			}
+		}
+	}
+	return file, nil
+}
+
+// authorize checks if the caller of the stream has the role to run the
+// command, the denial is written to the audit log.
+func (gd *daemon) authorize(stream as.ContextStream, need int, cmd string) error {
+	netconn := stream.GetNetconn()
+	caller := gd.access.caller(netconn)
+	role := gd.access.role(caller)
+	if role >= need {
+		return nil
+	}
+	if len(caller) == 0 {
+		caller = "anonymous"
+	}
+	gd.access.auditf("denied: %s from %s(%s) as %s, %s required", cmd, caller, netconn.RemoteAddr(), roleNames[role], roleNames[need])
+	gd.lg.Warnf("%s from %s denied", cmd, caller)
+	return fmt.Errorf("permission denied: %s requires %s role", cmd, roleNames[need])
+}
+
+// requester returns the provider ID of the caller verified by the access
+// control, recorded as the requester of the jobs.
+func (gd *daemon) requester(stream as.ContextStream) string {
+	caller := gd.access.caller(stream.GetNetconn())
+	switch caller {
+	case "self":
+		if selfID, err := gd.access.selfProviderID(); err == nil {
+			return selfID
+		}
+	case "":
+		return "anonymous"
+	}
+	return caller
+}
+
+// localOnly rejects the internal commands from other nodes.
+func (gd *daemon) localOnly(stream as.ContextStream, cmd string) error {
+	netconn := stream.GetNetconn()
+	if isLocal(netconn) {
+		return nil
+	}
+	gd.access.auditf("denied: %s from %s is local only", cmd, netconn.RemoteAddr())
+	return fmt.Errorf("permission denied: %s is local only", cmd)
+}
+
+// authPurpose is signed with the challenge so that the signature is not
+// valid for anything other than the auth of gshell daemons.
+const authPurpose = "gshellos daemon auth v1"
+
+// authPayload returns the bytes signed by the provider to prove its ID to
+// the verifier with the challenge.
+func authPayload(nonce []byte, verifierID, providerID string) []byte {
+	var b bytes.Buffer
+	b.WriteString(authPurpose)
+	b.WriteByte(0)
+	b.Write(nonce)
+	b.WriteString(verifierID)
+	b.WriteByte(0)
+	b.WriteString(providerID)
+	return b.Bytes()
+}
+
+// authProof proves the provider ID with the node key.
+type authProof struct {
+	ProviderID string
+	Key        []byte
+	Sig        []byte // of authPayload
+}
+
+// authChallenge is the challenge issued by the verifier.
+type authChallenge struct {
+	Nonce      []byte
+	ProviderID string // of the verifier
+}
+
+// selfProviderID returns the provider ID of this node.
+func (ac *accessControl) selfProviderID() (string, error) {
+	ac.Lock()
+	selfID := ac.selfID
+	ac.Unlock()
+	if len(selfID) != 0 {
+		return selfID, nil
+	}
+	selfID, err := getSelfID()
+	if err != nil {
+		return "", err
+	}
+	ac.Lock()
+	ac.selfID = selfID
+	ac.Unlock()
+	return selfID, nil
+}
+
+// reply with *authChallenge or error
+type cmdAuthChallenge struct{}
+
+func (msg cmdAuthChallenge) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	selfID, err := gd.access.selfProviderID()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	gd.access.Lock()
+	gd.access.nonces[stream.GetNetconn()] = nonce
+	gd.access.Unlock()
+	return &authChallenge{Nonce: nonce, ProviderID: selfID}
+}
+
+// reply OK or error
+type cmdAuth struct {
+	authProof
+}
+
+func (msg *cmdAuth) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	gd.lg.Debugf("handle cmdAuth: %s", msg.ProviderID)
+	netconn := stream.GetNetconn()
+	ac := gd.access
+	ac.Lock()
+	nonce := ac.nonces[netconn]
+	delete(ac.nonces, netconn)
+	ac.Unlock()
+
+	err := func() error {
+		if nonce == nil {
+			return errors.New("no challenge")
+		}
+		selfID, err := ac.selfProviderID()
+		if err != nil {
+			return err
+		}
+		key := ac.providerKey(msg.ProviderID)
+		if key == nil {
+			return errors.New("no key in acl")
+		}
+		if !bytes.Equal(key, msg.Key) {
+			return errors.New("key mismatch")
+		}
+		if !ed25519.Verify(key, authPayload(nonce, selfID, msg.ProviderID), msg.Sig) {
+			return errors.New("wrong signature")
+		}
+		return nil
+	}()
+	if err != nil {
+		ac.auditf("auth failed: %s(%s): %v", msg.ProviderID, netconn.RemoteAddr(), err)
+		return fmt.Errorf("auth failed: %v", err)
+	}
+	ac.Lock()
+	ac.callers[netconn] = msg.ProviderID
+	ac.Unlock()
+	gd.lg.Infof("provider %s authenticated from %s", msg.ProviderID, netconn.RemoteAddr())
+	return as.OK
+}
+
+// reply with *authProof or error, only the key if no challenge.
+type cmdAuthSign struct {
+	*authChallenge
+}
+
+func (msg *cmdAuthSign) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.localOnly(stream, "auth sign"); err != nil {
+		return err
+	}
+	key, err := gd.access.nodeKey()
+	if err != nil {
+		return err
+	}
+	selfID, err := gd.access.selfProviderID()
+	if err != nil {
+		return err
+	}
+	proof := &authProof{ProviderID: selfID, Key: key.Public().(ed25519.PublicKey)}
+	if msg.authChallenge != nil && len(msg.Nonce) != 0 {
+		proof.Sig = ed25519.Sign(key, authPayload(msg.Nonce, msg.ProviderID, selfID))
+	}
+	return proof
+}
+
+// authenticate proves the provider ID of this node to the remote daemon with
+// the key of the local daemon. The commands run as anonymous if failed, the
+// error is returned to be reported.
+func authenticate(conn as.Connection, lg *log.Logger) error {
+	var challenge *authChallenge
+	if err := conn.SendRecv(cmdAuthChallenge{}, &challenge); err != nil {
+		lg.Debugf("auth not supported: %v", err)
+		return nil
+	}
+	c := as.NewClient(as.WithLogger(lg), as.WithScope(as.ScopeProcess|as.ScopeOS)).SetDiscoverTimeout(0)
+	local := <-c.Discover(godevsigPublisher, "gshellDaemon")
+	if local == nil {
+		return errors.New("local daemon not found to sign")
+	}
+	defer local.Close()
+	var proof *authProof
+	if err := local.SendRecv(&cmdAuthSign{challenge}, &proof); err != nil {
+		return fmt.Errorf("auth sign failed: %v", err)
+	}
+	return conn.SendRecv(&cmdAuth{*proof}, nil)
+}
+
+func init() {
+	as.RegisterType(cmdAuthChallenge{})
+	as.RegisterType((*cmdAuth)(nil))
+	as.RegisterType((*cmdAuthSign)(nil))
+	as.RegisterType((*authProof)(nil))
+	as.RegisterType((*authChallenge)(nil))
+}
@@ -0,0 +1,426 @@
+package gshellos
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ResourceLimits is the cgroup v2 based resource limits of the GRG in which the job runs.
+// The limits take effect on new GRG creation.
+type ResourceLimits struct {
+	MemoryMax string `yaml:"memory-max,omitempty"` // memory.max in bytes, K/M/G suffix supported
+	CPUQuota  int    `yaml:"cpu-quota,omitempty"`  // cpu.max in percentage of one CPU
+	PidsMax   int    `yaml:"pids-max,omitempty"`   // pids.max
+}
+
+func (rl ResourceLimits) isZero() bool {
+	return rl == ResourceLimits{}
+}
+
+// merge fills the unset fields of rl with those in other.
+func (rl *ResourceLimits) merge(other ResourceLimits) {
+	if len(rl.MemoryMax) == 0 {
+		rl.MemoryMax = other.MemoryMax
+	}
+	if rl.CPUQuota == 0 {
+		rl.CPUQuota = other.CPUQuota
+	}
+	if rl.PidsMax == 0 {
+		rl.PidsMax = other.PidsMax
+	}
+}
+
+// conflicts tells if any limit is set in both with different values.
+func (rl ResourceLimits) conflicts(other ResourceLimits) bool {
+	return len(rl.MemoryMax) != 0 && len(other.MemoryMax) != 0 && rl.MemoryMax != other.MemoryMax ||
+		rl.CPUQuota != 0 && other.CPUQuota != 0 && rl.CPUQuota != other.CPUQuota ||
+		rl.PidsMax != 0 && other.PidsMax != 0 && rl.PidsMax != other.PidsMax
+}
+
+func (rl ResourceLimits) validate() error {
+	if len(rl.MemoryMax) != 0 {
+		if _, err := parseSize(rl.MemoryMax); err != nil {
+			return fmt.Errorf("wrong memory limit: %v", err)
+		}
+	}
+	if rl.CPUQuota < 0 {
+		return errors.New("wrong cpu quota")
+	}
+	if rl.PidsMax < 0 {
+		return errors.New("wrong pids limit")
+	}
+	return nil
+}
+
+// parseSize parses size string like 512, 64K, 128M or 1G into bytes.
+func parseSize(size string) (int64, error) {
+	size = strings.TrimSpace(strings.ToUpper(size))
+	size = strings.TrimSuffix(size, "B")
+	if len(size) == 0 {
+		return 0, errors.New("empty size")
+	}
+	unit := int64(1)
+	switch size[len(size)-1] {
+	case 'K':
+		unit = 1 << 10
+	case 'M':
+		unit = 1 << 20
+	case 'G':
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		size = size[:len(size)-1]
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return n * unit, nil
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+const (
+	cgroupDaemonLeaf = "gshell-daemon"
+	cgroupCPUPeriod  = 100000
+)
+
+// cgroupRoot returns the cgroup v2 sub-tree in which GRG cgroups are created.
+// The daemon process is moved to a leaf cgroup so that controllers can be
+// enabled in the sub-tree, which is linked to workDir/cgroup for reference.
+func (gd *daemon) cgroupRoot() (string, error) {
+	gd.cgOnce.Do(func() {
+		gd.cgRoot, gd.cgErr = gd.setupCgroupRoot()
+		if gd.cgErr != nil {
+			gd.lg.Infof("cgroup v2 not available: %v", gd.cgErr)
+		}
+	})
+	return gd.cgRoot, gd.cgErr
+}
+
+func (gd *daemon) setupCgroupRoot() (string, error) {
+	mnt, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	self := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			self = strings.TrimPrefix(line, "0::")
+			break
+		}
+	}
+	if len(self) == 0 {
+		return "", errors.New("cgroup v2 path of self not found")
+	}
+	// daemon restarted by updater is already in the leaf
+	self = strings.TrimSuffix(self, "/"+cgroupDaemonLeaf)
+	root := filepath.Join(mnt, self)
+
+	leaf := filepath.Join(root, cgroupDaemonLeaf)
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return "", err
+	}
+	for _, ctrl := range []string{"memory", "cpu", "pids"} {
+		if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+"+ctrl), 0644); err != nil {
+			gd.lg.Warnf("enable cgroup controller %s failed: %v", ctrl, err)
+		}
+	}
+
+	link := filepath.Join(gd.workDir, "cgroup")
+	os.Remove(link)
+	os.Symlink(root, link)
+	return root, nil
+}
+
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 35 24 0:30 / /sys/fs/cgroup rw,nosuid shared:9 - cgroup2 cgroup2 rw
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	return "", errors.New("cgroup2 not mounted")
+}
+
+// cgroupInUse reports if GRG cgroups have been set up under workDir.
+func (gd *daemon) cgroupInUse() bool {
+	_, err := os.Lstat(filepath.Join(gd.workDir, "cgroup"))
+	return err == nil
+}
+
+func (gd *daemon) grgCgroupDir(grgName string) string {
+	if !gd.cgroupInUse() {
+		return ""
+	}
+	root, err := gd.cgroupRoot()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(root, "grg-"+grgName)
+}
+
+// setupGrgCgroup creates cgroup for the named GRG with the limits and moves pid into it.
+// An existing cgroup is reused with its limits unchanged if no limits are specified.
+func (gd *daemon) setupGrgCgroup(grgName string, pid int, limits ResourceLimits) error {
+	if limits.isZero() && !gd.cgroupInUse() {
+		return nil
+	}
+	root, err := gd.cgroupRoot()
+	if err != nil {
+		if limits.isZero() {
+			return nil
+		}
+		return err
+	}
+	cgDir := filepath.Join(root, "grg-"+grgName)
+	if limits.isZero() {
+		if _, err := os.Stat(cgDir); err != nil {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(cgDir, 0755); err != nil {
+		return err
+	}
+
+	write := func(file, value string) error {
+		return os.WriteFile(filepath.Join(cgDir, file), []byte(value), 0644)
+	}
+	if len(limits.MemoryMax) != 0 {
+		n, err := parseSize(limits.MemoryMax)
+		if err != nil {
+			return err
+		}
+		if err := write("memory.max", strconv.FormatInt(n, 10)); err != nil {
+			return err
+		}
+	}
+	if limits.CPUQuota != 0 {
+		quota := limits.CPUQuota * cgroupCPUPeriod / 100
+		if err := write("cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)); err != nil {
+			return err
+		}
+	}
+	if limits.PidsMax != 0 {
+		if err := write("pids.max", strconv.Itoa(limits.PidsMax)); err != nil {
+			return err
+		}
+	}
+	return write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// grgSettings is what the GRG is created with.
+type grgSettings struct {
+	RtPriority     int `yaml:"rt-priority,omitempty"`
+	Maxprocs       int `yaml:"max-procs,omitempty"`
+	ResourceLimits `yaml:",inline"`
+}
+
+// newGrgSettings returns the settings the GRG is actually created with.
+func newGrgSettings(rtPriority, maxprocs int, limits ResourceLimits) grgSettings {
+	if rtPriority < 0 {
+		rtPriority = 0
+	}
+	if maxprocs < 0 {
+		maxprocs = 0
+	}
+	if daemonMaxprocs := runtime.GOMAXPROCS(-1); maxprocs > daemonMaxprocs {
+		maxprocs = daemonMaxprocs
+	}
+	return grgSettings{rtPriority, maxprocs, limits}
+}
+
+// diff returns the settings changed from have to gs, empty if none changed.
+func (gs grgSettings) diff(have grgSettings) string {
+	var changes []string
+	add := func(name string, want, have interface{}) {
+		if want == have {
+			return
+		}
+		str := func(v interface{}) string {
+			if s := fmt.Sprint(v); s != "" && s != "0" {
+				return s
+			}
+			return "none"
+		}
+		changes = append(changes, fmt.Sprintf("%s %s -> %s", name, str(have), str(want)))
+	}
+	add("rt-priority", gs.RtPriority, have.RtPriority)
+	add("max-procs", gs.Maxprocs, have.Maxprocs)
+	add("memory-max", gs.MemoryMax, have.MemoryMax)
+	add("cpu-quota", gs.CPUQuota, have.CPUQuota)
+	add("pids-max", gs.PidsMax, have.PidsMax)
+	return strings.Join(changes, ", ")
+}
+
+// the settings of the GRG are kept in the status dir until the GRG exits
+// normally, so that the GRG restarted by grgRestarter gets the same limits,
+// and apply knows what the running GRG was created with.
+func (gd *daemon) grgLimitsFile(grgName string) string {
+	return filepath.Join(gd.workDir, "status", "limits-"+strings.Split(grgName, "-")[0]+".yaml")
+}
+
+func (gd *daemon) saveGrgSettings(grgName string, settings grgSettings) {
+	data, err := yaml.Marshal(settings)
+	if err == nil {
+		err = os.WriteFile(gd.grgLimitsFile(grgName), data, 0644)
+	}
+	if err != nil {
+		gd.lg.Warnf("save settings of grg %s failed: %v", grgName, err)
+	}
+}
+
+func (gd *daemon) loadGrgSettings(grgName string) grgSettings {
+	var settings grgSettings
+	data, err := os.ReadFile(gd.grgLimitsFile(grgName))
+	if err != nil {
+		return settings
+	}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		gd.lg.Warnf("load settings of grg %s failed: %v", grgName, err)
+	}
+	return settings
+}
+
+func (gd *daemon) removeGrgCgroup(grgName string) {
+	cgDir := gd.grgCgroupDir(grgName)
+	if len(cgDir) == 0 {
+		return
+	}
+	if err := os.Remove(cgDir); err == nil {
+		gd.lg.Debugf("cgroup %s removed", cgDir)
+	}
+}
+
+type resourceStat struct {
+	MemoryCurrent int64
+	MemoryMax     int64 // 0 means no limit
+	MemoryMaxHit  int   // times memory usage hit the limit
+	OOMKilled     int
+	CPUUsageUsec  int64
+	CPUQuota      int // in percentage of one CPU, 0 means no limit
+	CPUThrottled  int
+	PidsCurrent   int
+	PidsMax       int // 0 means no limit
+	PidsMaxHit    int
+}
+
+func (rs *resourceStat) String() string {
+	var b strings.Builder
+	mmax, cmax, pmax := "max", "max", "max"
+	if rs.MemoryMax != 0 {
+		mmax = formatSize(rs.MemoryMax)
+	}
+	if rs.CPUQuota != 0 {
+		cmax = strconv.Itoa(rs.CPUQuota) + "%"
+	}
+	if rs.PidsMax != 0 {
+		pmax = strconv.Itoa(rs.PidsMax)
+	}
+	fmt.Fprintf(&b, "memory %s/%s(limit hit %d, oom killed %d), ", formatSize(rs.MemoryCurrent), mmax, rs.MemoryMaxHit, rs.OOMKilled)
+	fmt.Fprintf(&b, "cpu %dms/%s(throttled %d), ", rs.CPUUsageUsec/1000, cmax, rs.CPUThrottled)
+	fmt.Fprintf(&b, "pids %d/%s(limit hit %d)", rs.PidsCurrent, pmax, rs.PidsMaxHit)
+	return b.String()
+}
+
+// readKeyValues reads cgroup flat keyed file like memory.events.
+func readKeyValues(file string) map[string]int64 {
+	kvs := make(map[string]int64)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return kvs
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			kvs[fields[0]] = v
+		}
+	}
+	return kvs
+}
+
+// readValue reads single value cgroup file, "max" is treated as 0.
+func readValue(file string) int64 {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	v, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return v
+}
+
+// grgResourceStat returns nil if the named GRG is not in a dedicated cgroup.
+func (gd *daemon) grgResourceStat(grgName string) *resourceStat {
+	cgDir := gd.grgCgroupDir(grgName)
+	if len(cgDir) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(cgDir); err != nil {
+		return nil
+	}
+
+	rs := &resourceStat{
+		MemoryCurrent: readValue(filepath.Join(cgDir, "memory.current")),
+		MemoryMax:     readValue(filepath.Join(cgDir, "memory.max")),
+		PidsCurrent:   int(readValue(filepath.Join(cgDir, "pids.current"))),
+		PidsMax:       int(readValue(filepath.Join(cgDir, "pids.max"))),
+	}
+	memEvents := readKeyValues(filepath.Join(cgDir, "memory.events"))
+	rs.MemoryMaxHit = int(memEvents["max"])
+	rs.OOMKilled = int(memEvents["oom_kill"])
+	cpuStat := readKeyValues(filepath.Join(cgDir, "cpu.stat"))
+	rs.CPUUsageUsec = cpuStat["usage_usec"]
+	rs.CPUThrottled = int(cpuStat["nr_throttled"])
+	pidsEvents := readKeyValues(filepath.Join(cgDir, "pids.events"))
+	rs.PidsMaxHit = int(pidsEvents["max"])
+
+	if data, err := os.ReadFile(filepath.Join(cgDir, "cpu.max")); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 {
+			quota, _ := strconv.Atoi(fields[0])
+			period, _ := strconv.Atoi(fields[1])
+			if period != 0 {
+				rs.CPUQuota = quota * 100 / period
+			}
+		}
+	}
+	return rs
+}
@@ -0,0 +1,262 @@
+package gshellos
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+)
+
+const codeCacheSizeDefault = "256M"
+
+// codeCache is the content addressed cache of code bundles in the work dir,
+// it is shared by the daemon, the codeRepo service and the GRGs of the node.
+// A bundle is stored as <sha256>.zip, and the key of its source, e.g. the
+// git commit and path or the code to be vendored, links to the bundle.
+// The least recently used bundles are evicted when the size exceeds the limit.
+type codeCache struct {
+	dir     string
+	maxSize int64 // 0 disables the cache
+}
+
+type cacheEntry struct {
+	Sum      string
+	Size     int64
+	LastUsed time.Time
+	Sources  []string // the keys linked to the bundle
+}
+
+func newCodeCache(workDir string, maxSize int64) *codeCache {
+	cc := &codeCache{dir: filepath.Join(workDir, "cache", "code"), maxSize: maxSize}
+	if maxSize != 0 {
+		os.MkdirAll(filepath.Join(cc.dir, "keys"), 0755)
+	}
+	return cc
+}
+
+func (cc *codeCache) bundleFile(sum string) string {
+	return filepath.Join(cc.dir, sum+".zip")
+}
+
+func (cc *codeCache) keyFile(key string) string {
+	return filepath.Join(cc.dir, "keys", fmt.Sprintf("%x", sha256.Sum256([]byte(key))))
+}
+
+// writeFile writes the file atomically as the cache is shared by processes.
+func writeFile(file string, data []byte) error {
+	tmp := fmt.Sprintf("%s.%s.tmp", file, genID(6))
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// get returns the bundle of the sum, nil if not cached.
+func (cc *codeCache) get(sum string) []byte {
+	if cc.maxSize == 0 || len(sum) == 0 {
+		return nil
+	}
+	file := cc.bundleFile(sum)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	if codeSum(data) != sum { // corrupted
+		os.Remove(file)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	return data
+}
+
+// put adds the bundle and returns its sum, the sources keys link to the bundle.
+func (cc *codeCache) put(data []byte, keys ...string) string {
+	sum := codeSum(data)
+	if cc.maxSize == 0 || int64(len(data)) > cc.maxSize {
+		return sum
+	}
+	if _, err := os.Stat(cc.bundleFile(sum)); err != nil {
+		if err := writeFile(cc.bundleFile(sum), data); err != nil {
+			return sum
+		}
+	}
+	for _, key := range keys {
+		writeFile(cc.keyFile(key), []byte(sum+"\n"+key))
+	}
+	cc.evict()
+	return sum
+}
+
+// lookup returns the bundle the source key links to, nil if not cached.
+func (cc *codeCache) lookup(key string) []byte {
+	if cc.maxSize == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(cc.keyFile(key))
+	if err != nil {
+		return nil
+	}
+	sum, _, _ := strings.Cut(string(data), "\n")
+	return cc.get(sum)
+}
+
+func (cc *codeCache) list() ([]*cacheEntry, error) {
+	files, err := filepath.Glob(filepath.Join(cc.dir, "*.zip"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*cacheEntry)
+	var list []*cacheEntry
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		sum := strings.TrimSuffix(filepath.Base(file), ".zip")
+		ce := &cacheEntry{Sum: sum, Size: fi.Size(), LastUsed: fi.ModTime()}
+		entries[sum] = ce
+		list = append(list, ce)
+	}
+
+	keyFiles, _ := filepath.Glob(filepath.Join(cc.dir, "keys", "*"))
+	for _, file := range keyFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		sum, key, _ := strings.Cut(string(data), "\n")
+		if ce := entries[sum]; ce != nil {
+			ce.Sources = append(ce.Sources, key)
+		} else if !strings.HasSuffix(file, ".tmp") {
+			os.Remove(file) // the bundle was evicted
+		}
+	}
+	for _, ce := range list {
+		sort.Strings(ce.Sources)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LastUsed.After(list[j].LastUsed) })
+	return list, nil
+}
+
+// evict removes the least recently used bundles until the size is within the limit.
+func (cc *codeCache) evict() {
+	list, err := cc.list()
+	if err != nil {
+		return
+	}
+	var size int64
+	for _, ce := range list {
+		size += ce.Size
+	}
+	for i := len(list) - 1; i >= 0 && size > cc.maxSize; i-- {
+		if err := os.Remove(cc.bundleFile(list[i].Sum)); err == nil {
+			size -= list[i].Size
+		}
+	}
+}
+
+// clear removes all the bundles and returns the number and size of them.
+func (cc *codeCache) clear() (n int, size int64, err error) {
+	list, err := cc.list()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, ce := range list {
+		if err := os.Remove(cc.bundleFile(ce.Sum)); err == nil {
+			n++
+			size += ce.Size
+		}
+	}
+	keyFiles, _ := filepath.Glob(filepath.Join(cc.dir, "keys", "*"))
+	for _, file := range keyFiles {
+		os.Remove(file)
+	}
+	return n, size, nil
+}
+
+func (cc *codeCache) args() []string {
+	return []string{"-cache-size", strconv.FormatInt(cc.maxSize, 10)}
+}
+
+type codeCacheStat struct {
+	MaxSize int64
+	Entries []*cacheEntry
+}
+
+// reply *codeCacheStat
+type cmdCacheList struct{}
+
+func (msg cmdCacheList) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleReadOnly, "repo cache ls"); err != nil {
+		return err
+	}
+	entries, err := gd.cache.list()
+	if err != nil {
+		return err
+	}
+	return &codeCacheStat{gd.cache.maxSize, entries}
+}
+
+// reply string
+type cmdCacheClear struct{}
+
+func (msg cmdCacheClear) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleAdmin, "repo cache clear"); err != nil {
+		return err
+	}
+	n, size, err := gd.cache.clear()
+	if err != nil {
+		return err
+	}
+	return fmt.Sprintf("%d bundles cleared, %s freed", n, formatSize(size))
+}
+
+// reply with the sha256 of the code bundle that getCode would reply, the
+// bundle is kept in the cache of the codeRepo node to be got by getCachedCode.
+type getCodeSum getCode
+
+func (msg getCodeSum) Handle(stream as.ContextStream) (reply interface{}) {
+	crs := stream.GetContext().(*codeRepoSvc)
+	zip, err := crs.code(getCode(msg))
+	if err != nil {
+		return err
+	}
+	return crs.cache.put(zip)
+}
+
+// reply with the code bundle of the sum in the cache of the codeRepo node
+type getCachedCode struct {
+	Sum string
+}
+
+func (msg getCachedCode) Handle(stream as.ContextStream) (reply interface{}) {
+	crs := stream.GetContext().(*codeRepoSvc)
+	zip := crs.cache.get(msg.Sum)
+	if zip == nil {
+		return fmt.Errorf("code bundle %s not cached", msg.Sum)
+	}
+	return zip
+}
+
+func init() {
+	as.RegisterType((*cacheEntry)(nil))
+	as.RegisterType((*codeCacheStat)(nil))
+	as.RegisterType(cmdCacheList{})
+	as.RegisterType(cmdCacheClear{})
+	as.RegisterType(getCodeSum{})
+	as.RegisterType(getCachedCode{})
+}
@@ -0,0 +1,178 @@
+package gshellos
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	as "github.com/godevsig/adaptiveservice"
+	"gopkg.in/yaml.v3"
+)
+
+// code signing policies
+const (
+	codeSignOff     = "off"     // run the code without checking the signature
+	codeSignWarn    = "warn"    // run the code and log a warning if not signed by trusted keys
+	codeSignEnforce = "enforce" // refuse the code not signed by trusted keys
+)
+
+type trustedKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"` // base64 ed25519 public key shown by gshell sign -genkey
+}
+
+// codeSignConfig is the code signing config in codesign.yaml of the work dir,
+// the policy is off if there is no such file.
+type codeSignConfig struct {
+	Policy string        `yaml:"policy"`
+	Keys   []*trustedKey `yaml:"keys,omitempty"`
+}
+
+func loadCodeSignConfig(workDir string) (*codeSignConfig, error) {
+	file := filepath.Join(workDir, "codesign.yaml")
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return &codeSignConfig{Policy: codeSignOff}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	csc := &codeSignConfig{}
+	if err := yaml.Unmarshal(data, csc); err != nil {
+		return nil, fmt.Errorf("parse %s error: %v", file, err)
+	}
+	if err := csc.validate(); err != nil {
+		return nil, fmt.Errorf("parse %s error: %v", file, err)
+	}
+	return csc, nil
+}
+
+func (csc *codeSignConfig) validate() error {
+	switch csc.Policy {
+	case codeSignOff, codeSignWarn, codeSignEnforce:
+	default:
+		return fmt.Errorf("wrong policy %q, one of off, warn or enforce expected", csc.Policy)
+	}
+	for _, tk := range csc.Keys {
+		if key, err := base64.StdEncoding.DecodeString(tk.Key); err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("wrong key %s", tk.Name)
+		}
+	}
+	return nil
+}
+
+// verify returns the name of the trusted key that the code is signed by.
+func (csc *codeSignConfig) verify(zip []byte, sig string) (string, error) {
+	if len(sig) == 0 {
+		return "", errors.New("code not signed")
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return "", fmt.Errorf("wrong signature: %v", err)
+	}
+	for _, tk := range csc.Keys {
+		key, _ := base64.StdEncoding.DecodeString(tk.Key)
+		if ed25519.Verify(key, zip, sigBytes) {
+			return tk.Name, nil
+		}
+	}
+	return "", errors.New("code signature not verified by trusted keys")
+}
+
+// verifyCode checks the signature of the code of the job according to the policy.
+func (grg *grg) verifyCode(runMsg *grgCmdRun) error {
+	csc, err := loadCodeSignConfig(grg.workDir)
+	if err != nil {
+		return err
+	}
+	if csc.Policy == codeSignOff {
+		return nil
+	}
+	name, err := csc.verify(runMsg.CodeZip, runMsg.CodeSig)
+	if err == nil {
+		grg.lg.Debugf("code of %s signed by %s", runMsg.name(), name)
+		return nil
+	}
+	if csc.Policy == codeSignWarn {
+		grg.lg.Warnf("code of %s: %v", runMsg.name(), err)
+		return nil
+	}
+	return fmt.Errorf("code of %s refused: %v", runMsg.name(), err)
+}
+
+// genSigningKey writes the new private key to the file and returns the public key.
+func genSigningKey(file string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+func readSigningKey(file string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("wrong signing key %s", file)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func signCode(key ed25519.PrivateKey, zip []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, zip))
+}
+
+// sigFile returns the default signature file of the code path.
+func sigFile(path string) string {
+	return filepath.Clean(path) + ".sig"
+}
+
+func readSigFile(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// reply with the signature of the code in the repo, empty if not signed
+type getCodeSig struct {
+	PathFile string
+}
+
+func (msg getCodeSig) Handle(stream as.ContextStream) (reply interface{}) {
+	crs := stream.GetContext().(*codeRepoSvc)
+	if crs.gitRepo != nil {
+		sig, err := crs.gitRepo.sig(msg.PathFile)
+		if err != nil {
+			return err
+		}
+		return sig
+	}
+	if crs.localRepoPath == "" {
+		return "" // signatures of http repo not supported
+	}
+	sig, err := readSigFile(sigFile(filepath.Join(crs.localRepoPath, msg.PathFile)))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		return err
+	}
+	return sig
+}
+
+func init() {
+	as.RegisterType(getCodeSig{})
+}
@@ -2,13 +2,16 @@ package gshellos
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,8 +24,18 @@ import (
 )
 
 type daemon struct {
-	lg      *log.Logger
-	workDir string
+	lg          *log.Logger
+	workDir     string
+	cgOnce      sync.Once
+	cgRoot      string // cgroup v2 sub-tree for GRGs
+	cgErr       error
+	events      eventHub
+	conns       connStat
+	logRotation LogRotation // of daemon.log, grg.log and GRE logs by default
+	secrets     *secretStore
+	access      *accessControl
+	applier     *applier
+	cache       *codeCache
 }
 
 // some grg processes were killed by oom or unexpected operations,
@@ -57,9 +70,10 @@ func (gd *daemon) grgRestarter() {
 					return
 				}
 				grgName := strs[1]
+				gd.events.publish(&event{Type: eventGRGDied, GRG: grgName})
 				rtprio, _ := strconv.Atoi(strs[2])
 				maxprocs, _ := strconv.Atoi(strs[3])
-				conn, err := gd.setupgrg(grgName, rtprio, maxprocs)
+				conn, err := gd.setupgrg(grgName, rtprio, maxprocs, gd.loadGrgSettings(grgName).ResourceLimits)
 				if err != nil {
 					gd.lg.Errorf("restart grg %s failed with error: %v", grgName, err)
 					return
@@ -75,21 +89,17 @@ func (gd *daemon) onNewStream(ctx as.Context) {
 	ctx.SetContext(gd)
 }
 
-func (gd *daemon) setupgrg(grgName string, rtPriority int, maxprocs int) (as.Connection, error) {
+func (gd *daemon) onDisconnect(netconn as.Netconn) {
+	gd.conns.onDisconnect(netconn)
+	gd.access.onDisconnect(netconn)
+}
+
+func (gd *daemon) setupgrg(grgName string, rtPriority int, maxprocs int, limits ResourceLimits) (as.Connection, error) {
 	if !strings.Contains(grgName, "-") {
 		grgName = grgName + "-" + version
 	}
-	if rtPriority < 0 {
-		rtPriority = 0
-	}
-	if maxprocs < 0 {
-		maxprocs = 0
-	}
-
-	daemonMaxprocs := runtime.GOMAXPROCS(-1)
-	if maxprocs > daemonMaxprocs {
-		maxprocs = daemonMaxprocs
-	}
+	settings := newGrgSettings(rtPriority, maxprocs, limits)
+	rtPriority, maxprocs = settings.RtPriority, settings.Maxprocs
 
 	opts := []as.Option{
 		as.WithLogger(gd.lg),
@@ -119,6 +129,14 @@ func (gd *daemon) setupgrg(grgName string, rtPriority int, maxprocs int) (as.Con
 			gd.lg.Errorf("start cmd %s failed: %w", cmd.String(), err)
 			return err
 		}
+		if err := gd.setupGrgCgroup(grgName, cmd.Process.Pid, limits); err != nil {
+			gd.lg.Infof("resource limits %v not applied: %v", limits, err)
+		}
+		if settings != (grgSettings{}) {
+			gd.saveGrgSettings(grgName, settings)
+		} else {
+			os.Remove(gd.grgLimitsFile(grgName))
+		}
 
 		go func() {
 			cmderr := cmd.Wait()
@@ -127,12 +145,22 @@ func (gd *daemon) setupgrg(grgName string, rtPriority int, maxprocs int) (as.Con
 			} else {
 				gd.lg.Infof("cmd: %s exited, output: %v", cmd.String(), buf.String())
 			}
+			// keep the cgroup if the grg is to be restarted by grgRestarter
+			grgStatDirs, _ := filepath.Glob(gd.workDir + "/status/grg-" + strings.Split(grgName, "-")[0] + "-*")
+			if len(grgStatDirs) == 0 {
+				gd.removeGrgCgroup(grgName)
+				os.Remove(gd.grgLimitsFile(grgName))
+			}
 		}()
 
 		return nil
 	}
 
 	args := fmt.Sprintf("-loglevel %s __start -group %s -wd %s", loglevel, grgName, gd.workDir)
+	if lrArgs := gd.logRotation.args(); len(lrArgs) != 0 {
+		args += " " + strings.Join(lrArgs, " ")
+	}
+	args += " " + strings.Join(gd.cache.args(), " ")
 	if os.Args[0] == "gshell.tester" {
 		args = "-test.run ^TestRunMain$ -test.coverprofile=.test/l2_grg" + grgName + genID(3) + ".cov -- " + args
 	}
@@ -156,6 +184,7 @@ func (gd *daemon) setupgrg(grgName string, rtPriority int, maxprocs int) (as.Con
 	c.SetDiscoverTimeout(3)
 	conn = <-c.Discover(godevsigPublisher, "grg-"+grgName)
 	if conn != nil {
+		gd.events.publish(&event{Type: eventGRGSpawned, GRG: grgName})
 		return conn, nil
 	}
 	return nil, ErrBrokenGRG
@@ -265,6 +294,9 @@ func (gd *daemon) doKill(msg *cmdKill) string {
 
 func (msg *cmdKill) Handle(stream as.ContextStream) (reply interface{}) {
 	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleAdmin, "kill"); err != nil {
+		return err
+	}
 	gd.lg.Debugf("handle cmdKill: %v", msg)
 
 	return gd.doKill(msg)
@@ -279,9 +311,19 @@ type cmdRun struct {
 
 func (msg *cmdRun) Handle(stream as.ContextStream) (reply interface{}) {
 	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleOperator, "run"); err != nil {
+		return err
+	}
+	// the job can reveal the secrets granted to it in its output
+	if len(msg.Secrets) != 0 {
+		if err := gd.authorize(stream, roleAdmin, "run with secrets"); err != nil {
+			return err
+		}
+	}
 	gd.lg.Debugf("handle cmdRun: args %v, interactive %v", msg.Args, msg.Interactive)
+	msg.RequestedBy = gd.requester(stream)
 
-	conn, err := gd.setupgrg(msg.GRGName, msg.RtPriority, msg.Maxprocs)
+	conn, err := gd.setupgrg(msg.GRGName, msg.RtPriority, msg.Maxprocs, msg.ResourceLimits)
 	if err != nil {
 		return err
 	}
@@ -330,6 +372,9 @@ type cmdQuery struct {
 
 func (msg *cmdQuery) Handle(stream as.ContextStream) (reply interface{}) {
 	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleReadOnly, "ps"); err != nil {
+		return err
+	}
 	gd.lg.Debugf("handle cmdQuery: %v", msg)
 
 	var ggis []*grgGREInfo
@@ -342,10 +387,17 @@ func (msg *cmdQuery) Handle(stream as.ContextStream) (reply interface{}) {
 			gd.lg.Warnf("cmdQuery: send recv error: %v", err)
 		}
 		if ggi != nil {
+			ggi.Resource = gd.grgResourceStat(ggi.Name)
 			for _, grei := range ggi.GREInfos {
 				if grei.Stat != "exited" {
 					grei.EndTime = time.Now()
 				}
+				var secrets []string
+				if runMsg, err := gd.greRunMsg("grg-"+strings.Split(ggi.Name, "-")[0]+"-*", grei.ID); err == nil {
+					secrets = runMsg.Secrets
+				}
+				grei.Args = gd.secrets.redactAll(grei.Args, secrets)
+				grei.GREErr = gd.secrets.redact(grei.GREErr, secrets)
 			}
 			ggis = append(ggis, ggi)
 		}
@@ -358,6 +410,7 @@ type cmdPatternAction struct {
 	GRGName   string
 	IDPattern []string
 	Cmd       string
+	Grace     time.Duration
 }
 
 type grgGREIDs struct {
@@ -367,6 +420,9 @@ type grgGREIDs struct {
 
 func (msg *cmdPatternAction) Handle(stream as.ContextStream) (reply interface{}) {
 	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleOperator, msg.Cmd); err != nil {
+		return err
+	}
 	gd.lg.Debugf("handle cmdPatternAction: %v", msg)
 
 	var ggreids []*grgGREIDs
@@ -375,7 +431,7 @@ func (msg *cmdPatternAction) Handle(stream as.ContextStream) (reply interface{})
 	for conn := range connChan {
 		var greids []string
 		conn.SetRecvTimeout(time.Second)
-		if err := conn.SendRecv(&grgCmdPatternAction{msg.IDPattern, msg.Cmd}, &greids); err != nil {
+		if err := conn.SendRecv(&grgCmdPatternAction{msg.IDPattern, msg.Cmd, msg.Grace}, &greids); err != nil {
 			gd.lg.Warnf("cmdPatternAction: send recv error: %v", err)
 		}
 		if greids != nil {
@@ -386,22 +442,132 @@ func (msg *cmdPatternAction) Handle(stream as.ContextStream) (reply interface{})
 	return ggreids
 }
 
+// findGRE returns the connection to the GRG where the GRE is and the GRG name,
+// nil connection if not found.
+func (gd *daemon) findGRE(greid string) (as.Connection, string) {
+	var grgConn as.Connection
+	var grgName string
+	c := as.NewClient(as.WithLogger(gd.lg), as.WithScope(as.ScopeOS)).SetDiscoverTimeout(0)
+	connChan := c.Discover(godevsigPublisher, "grg-*")
+	for conn := range connChan {
+		if grgConn != nil {
+			conn.Close()
+			continue
+		}
+		var ggi *grgGREInfo
+		conn.SetRecvTimeout(time.Second)
+		if err := conn.SendRecv(&grgCmdQuery{[]string{greid}}, &ggi); err != nil {
+			gd.lg.Warnf("findGRE: send recv error: %v", err)
+		}
+		if ggi != nil {
+			for _, grei := range ggi.GREInfos {
+				if grei.ID == greid {
+					grgConn = conn
+					grgName = ggi.Name
+				}
+			}
+		}
+		if grgConn != conn {
+			conn.Close()
+		}
+	}
+	return grgConn, grgName
+}
+
+// reply with string or error
+type cmdRegroup struct {
+	GREID      string
+	GRGName    string
+	RtPriority int
+	Maxprocs   int
+}
+
+func (msg *cmdRegroup) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleOperator, "regroup"); err != nil {
+		return err
+	}
+	gd.lg.Debugf("handle cmdRegroup: %v", msg)
+
+	grgName := msg.GRGName
+	if !strings.Contains(grgName, "-") {
+		grgName = grgName + "-" + version
+	}
+
+	srcConn, srcName := gd.findGRE(msg.GREID)
+	if srcConn == nil {
+		return fmt.Errorf("GRE %s not found", msg.GREID)
+	}
+	defer srcConn.Close()
+	if srcName == grgName {
+		return fmt.Errorf("GRE %s already in %s", msg.GREID, grgName)
+	}
+
+	var mig *greMigration
+	srcConn.SetRecvTimeout(5 * time.Second)
+	if err := srcConn.SendRecv(&grgCmdMigrateOut{msg.GREID}, &mig); err != nil {
+		return err
+	}
+
+	conn, err := gd.setupgrg(grgName, msg.RtPriority, msg.Maxprocs, mig.RunMsg.ResourceLimits)
+	if err == nil {
+		err = conn.SendRecv(&grgCmdMigrateIn{mig}, nil)
+		conn.Close()
+	}
+	// the GRE is kept in the source GRG until the target has it
+	if err := srcConn.SendRecv(&grgCmdMigrateEnd{msg.GREID, err == nil}, nil); err != nil {
+		gd.lg.Errorf("end migration of GRE %s in %s failed: %v", msg.GREID, srcName, err)
+	}
+	if err != nil {
+		gd.lg.Errorf("migrate GRE %s to %s failed: %v, kept in %s", msg.GREID, grgName, err, srcName)
+		return err
+	}
+	gd.lg.Infof("GRE %s regrouped from %s to %s", msg.GREID, srcName, grgName)
+	return fmt.Sprintf("%s regrouped to %s", msg.GREID, grgName)
+}
+
 type cmdLog struct {
 	Target string
 	Follow bool
+	All    bool      // including rotated files
+	Stream string    // stdout or stderr of GRE, both if empty
+	Since  time.Time // only the lines since the time
+	Tail   int       // only the last lines if not 0
 }
 
 func (msg *cmdLog) Handle(stream as.ContextStream) (reply interface{}) {
 	gd := stream.GetContext().(*daemon)
-	var file string
+	if err := gd.authorize(stream, roleReadOnly, "log"); err != nil {
+		return err
+	}
+	logDir := filepath.Join(gd.workDir, "logs")
+	var file, stderrFile string
 	switch msg.Target {
 	case "daemon":
-		file = gd.workDir + "/logs/daemon.log"
+		file = filepath.Join(logDir, "daemon.log")
 	case "grg":
-		file = gd.workDir + "/logs/grg.log"
+		file = filepath.Join(logDir, "grg.log")
 	default:
-		file = gd.workDir + "/logs/" + msg.Target
+		// only the logs of GREs, not other files in or out of the log dir
+		if !greIDRegexp.MatchString(msg.Target) || filepath.Base(msg.Target) != msg.Target {
+			return errors.New("wrong log target " + msg.Target)
+		}
+		file = filepath.Join(logDir, msg.Target)
+		if filepath.Dir(file) != logDir {
+			return errors.New("wrong log target " + msg.Target)
+		}
+		stderrFile = file + ".stderr"
+	}
+	switch msg.Stream {
+	case "stdout":
+		stderrFile = ""
+	case "stderr":
+		if len(stderrFile) == 0 {
+			return errors.New(msg.Target + " has no stderr stream")
+		}
+		file, stderrFile = stderrFile, ""
 	}
+	filtered := !isZeroTime(msg.Since) || msg.Tail > 0
 
 	if msg.Follow {
 		clientIO := as.NewStreamIO(stream)
@@ -410,15 +576,35 @@ func (msg *cmdLog) Handle(stream as.ContextStream) (reply interface{}) {
 			fmt.Fprintln(clientIO, msg.Target+" not found")
 			return
 		}
-		defer f.Close()
-		io.Copy(clientIO, endlessReader{f})
+		ff := &followFile{path: file, f: f}
+		defer ff.Close()
+		if filtered {
+			buf, _ := io.ReadAll(f)
+			clientIO.Write(filterLogLines(splitLogLines(buf), msg.Since, msg.Tail))
+		}
+		io.Copy(clientIO, endlessReader{ff})
 		gd.lg.Debugln("cmdLog: done")
 		clientIO.Close()
 	} else {
-		buf, err := os.ReadFile(file)
-		if err != nil {
+		withSegments := msg.All || filtered
+		buf, err := readLogFile(file, withSegments, false)
+		if os.IsNotExist(err) {
 			return errors.New(msg.Target + " not found")
 		}
+		if err != nil {
+			return err
+		}
+		if len(stderrFile) != 0 || filtered {
+			lines := splitLogLines(buf)
+			if len(stderrFile) != 0 {
+				errBuf, err := readLogFile(stderrFile, withSegments, true)
+				if err != nil {
+					return err
+				}
+				lines = mergeLogLines(lines, splitLogLines(errBuf))
+			}
+			buf = filterLogLines(lines, msg.Since, msg.Tail)
+		}
 		if err := stream.Send(buf); err != nil {
 			return err
 		}
@@ -430,6 +616,10 @@ func (msg *cmdLog) Handle(stream as.ContextStream) (reply interface{}) {
 type cmdInfo struct{}
 
 func (msg cmdInfo) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleReadOnly, "info"); err != nil {
+		return err
+	}
 	var b strings.Builder
 	fmt.Fprintf(&b, "Version: %s\n", version)
 	fmt.Fprintf(&b, "Build tags: %s\n", buildTags)
@@ -442,6 +632,78 @@ type joblist struct {
 	GRGs []grgJoblist
 }
 
+// seconds to wait for the service in wait-for-service of a job
+const serviceWaitTimeout = 30
+
+type loadJob struct {
+	grgName string
+	job     *JobInfo
+	deps    []*loadJob
+	started bool
+}
+
+// sortJobs returns all the jobs in the joblist in topological order of
+// their dependencies, independent jobs keep the order in the joblist.
+func (jlist *joblist) sortJobs() ([]*loadJob, error) {
+	var jobs []*loadJob
+	byName := make(map[string][]*loadJob)
+	for _, grgjl := range jlist.GRGs {
+		for _, job := range grgjl.Jobs {
+			lj := &loadJob{grgName: grgjl.Name, job: job}
+			jobs = append(jobs, lj)
+			byName[job.name()] = append(byName[job.name()], lj)
+		}
+	}
+
+	for _, lj := range jobs {
+		if svc := lj.job.WaitForService; len(svc) != 0 {
+			if strs := strings.Split(svc, "/"); len(strs) != 2 || len(strs[0]) == 0 || len(strs[1]) == 0 {
+				return nil, fmt.Errorf("job %s: wrong wait-for-service %s, publisher/service expected", lj.job.name(), svc)
+			}
+		}
+		for _, dep := range lj.job.DependsOn {
+			deps, has := byName[dep]
+			if !has {
+				return nil, fmt.Errorf("job %s depends on unknown job %s", lj.job.name(), dep)
+			}
+			lj.deps = append(lj.deps, deps...)
+		}
+	}
+
+	sorted := make([]*loadJob, 0, len(jobs))
+	placed := make(map[*loadJob]bool)
+	for len(sorted) < len(jobs) {
+		progress := false
+		for _, lj := range jobs {
+			if placed[lj] {
+				continue
+			}
+			ready := true
+			for _, dep := range lj.deps {
+				if !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				placed[lj] = true
+				sorted = append(sorted, lj)
+				progress = true
+			}
+		}
+		if !progress {
+			var names []string
+			for _, lj := range jobs {
+				if !placed[lj] {
+					names = append(names, lj.job.name())
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle among jobs: %s", strings.Join(names, ", "))
+		}
+	}
+	return sorted, nil
+}
+
 // reply joblist{}
 type cmdJoblistSave struct {
 	Tiny bool
@@ -449,7 +711,12 @@ type cmdJoblistSave struct {
 
 func (msg cmdJoblistSave) Handle(stream as.ContextStream) (reply interface{}) {
 	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleReadOnly, "joblist save"); err != nil {
+		return err
+	}
 	gd.lg.Debugf("handle cmdJoblistSave: %v", msg)
+	// the code and environment of the jobs are only for operators
+	full := gd.access.role(gd.access.caller(stream.GetNetconn())) >= roleOperator
 
 	jlist := &joblist{}
 	c := as.NewClient(as.WithLogger(gd.lg), as.WithScope(as.ScopeOS)).SetDiscoverTimeout(0)
@@ -457,10 +724,18 @@ func (msg cmdJoblistSave) Handle(stream as.ContextStream) (reply interface{}) {
 	for conn := range connChan {
 		var grgjl grgJoblist
 		conn.SetRecvTimeout(time.Second)
-		if err := conn.SendRecv(grgCmdJoblist{msg.Tiny}, &grgjl); err != nil {
+		if err := conn.SendRecv(grgCmdJoblist{msg.Tiny || !full}, &grgjl); err != nil {
 			gd.lg.Warnf("cmdJoblistSave: send recv error: %v", err)
 		} else {
 			grgjl.Name = strings.Split(grgjl.Name, "-")[0]
+			grgjl.ResourceLimits = gd.loadGrgSettings(grgjl.Name).ResourceLimits
+			for _, job := range grgjl.Jobs {
+				job.Args = gd.secrets.redactAll(job.Args, job.Secrets)
+				job.Env = gd.secrets.redactAll(job.Env, job.Secrets)
+				if !full {
+					job.Env = nil
+				}
+			}
 			jlist.GRGs = append(jlist.GRGs, grgjl)
 		}
 		conn.Close()
@@ -471,64 +746,134 @@ func (msg cmdJoblistSave) Handle(stream as.ContextStream) (reply interface{}) {
 // reply OK or error
 type cmdJoblistLoad struct {
 	joblist
-	requestedBy string // by which provider ID
 }
 
 func (msg *cmdJoblistLoad) Handle(stream as.ContextStream) (reply interface{}) {
 	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleAdmin, "joblist load"); err != nil {
+		return err
+	}
 	gd.lg.Debugf("handle cmdJoblistLoad: %v", msg)
 
+	jobs, err := msg.sortJobs()
+	if err != nil {
+		return fmt.Errorf("load joblist error: %v", err)
+	}
+
+	// the joblist loaded takes over the applied one
+	if err := gd.applier.stop(); err != nil {
+		gd.lg.Warnf("joblist reconciliation not stopped: %v", err)
+	}
 	out := gd.doKill(&cmdKill{GRGNames: []string{"*"}, Force: true})
 	gd.lg.Infoln("kill all GRGs:", out)
 
+	errChan := make(chan error, len(msg.GRGs)+len(jobs))
+	grgConns := gd.setupgrgs(msg.GRGs, errChan)
+	defer func() {
+		for _, grgconn := range grgConns {
+			grgconn.Close()
+		}
+	}()
+	gd.startJobs(jobs, grgConns, gd.requester(stream), errChan)
+
+	if len(errChan) == 0 {
+		return as.OK
+	}
+	close(errChan)
+	err = errors.New("load joblist error")
+	for e := range errChan {
+		err = fmt.Errorf("%v, %v", err, e)
+	}
+	return err
+}
+
+// setupgrgs sets up the GRGs concurrently, returns the connections by GRG name.
+func (gd *daemon) setupgrgs(grgs []grgJoblist, errChan chan<- error) map[string]as.Connection {
 	var wg sync.WaitGroup
-	errChan := make(chan error, len(msg.GRGs))
-	for _, grgjl := range msg.GRGs {
+	var mtx sync.Mutex
+	grgConns := make(map[string]as.Connection)
+	for _, grgjl := range grgs {
 		grgjl := grgjl
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			grgconn, err := gd.setupgrg(grgjl.Name, grgjl.RtPriority, grgjl.Maxprocs)
+			limits, err := grgjl.limits()
 			if err != nil {
 				gd.lg.Errorf("load grg %s failed with error: %v", grgjl.Name, err)
 				errChan <- err
 				return
 			}
-			defer grgconn.Close()
-
-			for _, job := range grgjl.Jobs {
-				runMsg := &grgCmdRun{
-					JobCmd:      job.JobCmd,
-					Interactive: false,
-					RequestedBy: msg.requestedBy,
-				}
-
-				if err := grgconn.SendRecv(runMsg, nil); err != nil {
-					gd.lg.Errorln(err)
-					errChan <- err
-					return
-				}
+			grgconn, err := gd.setupgrg(grgjl.Name, grgjl.RtPriority, grgjl.Maxprocs, limits)
+			if err != nil {
+				gd.lg.Errorf("load grg %s failed with error: %v", grgjl.Name, err)
+				errChan <- err
+				return
 			}
-			gd.lg.Infof("grg %s loaded", grgjl.Name)
+			mtx.Lock()
+			grgConns[grgjl.Name] = grgconn
+			mtx.Unlock()
 		}()
 	}
-
 	wg.Wait()
-	if len(errChan) == 0 {
-		return as.OK
-	}
-	close(errChan)
-	err := errors.New("load joblist error")
-	for e := range errChan {
-		err = fmt.Errorf("%v, %v", err, e)
+	return grgConns
+}
+
+// startJobs starts the jobs one by one, a job starts only after all its
+// dependencies started, the jobs already started are skipped.
+func (gd *daemon) startJobs(jobs []*loadJob, grgConns map[string]as.Connection, requestedBy string, errChan chan<- error) {
+	for _, lj := range jobs {
+		if lj.started {
+			continue
+		}
+		name := lj.job.name()
+		grgconn := grgConns[lj.grgName]
+		if grgconn == nil {
+			continue // error already reported
+		}
+		ready := true
+		for _, dep := range lj.deps {
+			if !dep.started {
+				errChan <- fmt.Errorf("job %s not started: dependency %s not started", name, dep.job.name())
+				ready = false
+				break
+			}
+		}
+		if !ready {
+			continue
+		}
+		if svc := lj.job.WaitForService; len(svc) != 0 {
+			strs := strings.Split(svc, "/")
+			c := as.NewClient(as.WithLogger(gd.lg)).SetDiscoverTimeout(serviceWaitTimeout)
+			conn := <-c.Discover(strs[0], strs[1])
+			if conn == nil {
+				errChan <- fmt.Errorf("job %s not started: service %s not found in %d seconds", name, svc, serviceWaitTimeout)
+				continue
+			}
+			conn.Close()
+		}
+
+		runMsg := &grgCmdRun{
+			JobCmd:      lj.job.JobCmd,
+			Interactive: false,
+			RequestedBy: requestedBy,
+		}
+		if err := grgconn.SendRecv(runMsg, nil); err != nil {
+			gd.lg.Errorln(err)
+			errChan <- fmt.Errorf("job %s not started: %v", name, err)
+			continue
+		}
+		lj.started = true
+		gd.lg.Infof("job %s loaded in grg %s", name, lj.grgName)
 	}
-	return err
 }
 
 type codeRepoAddrByNode struct{}
 
 func (msg codeRepoAddrByNode) Handle(stream as.ContextStream) (reply interface{}) {
 	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleReadOnly, "repo"); err != nil {
+		return err
+	}
 	c := as.NewClient(as.WithLogger(gd.lg)).SetDiscoverTimeout(0)
 	conn := <-c.Discover(godevsigPublisher, "codeRepo")
 	if conn == nil {
@@ -548,6 +893,9 @@ type codeRepoListByNode struct {
 
 func (msg codeRepoListByNode) Handle(stream as.ContextStream) (reply interface{}) {
 	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleReadOnly, "repo ls"); err != nil {
+		return err
+	}
 	c := as.NewClient(as.WithLogger(gd.lg)).SetDiscoverTimeout(0)
 	conn := <-c.Discover(godevsigPublisher, "codeRepo")
 	if conn == nil {
@@ -566,17 +914,124 @@ var daemonKnownMsgs = []as.KnownMessage{
 	(*cmdRun)(nil),
 	(*cmdQuery)(nil),
 	(*cmdPatternAction)(nil),
+	(*cmdRegroup)(nil),
+	(*cmdAttach)(nil),
+	(*cmdEval)(nil),
+	(*cmdSignal)(nil),
+	(*cmdSecretSet)(nil),
+	(*cmdSecretRm)(nil),
+	cmdSecretList{},
+	(*cmdSecretGet)(nil),
 	(*cmdLog)(nil),
+	(*cmdReportEvent)(nil),
+	(*cmdEvents)(nil),
 	cmdInfo{},
+	cmdNodeInfo{},
+	cmdCacheList{},
+	cmdCacheClear{},
 	cmdJoblistSave{},
 	(*cmdJoblistLoad)(nil),
+	(*cmdApply)(nil),
+	cmdAuthChallenge{},
+	(*cmdAuth)(nil),
+	(*cmdAuthSign)(nil),
 	codeRepoAddrByNode{},
 	codeRepoListByNode{},
 }
 
 type updater struct {
-	url string
-	lg  *log.Logger
+	sync.Mutex
+	url       string
+	lg        *log.Logger
+	rollout   *rollout
+	access    *accessControl
+	nonces    map[as.Netconn][]byte // issued challenges
+	reporters map[as.Netconn]string // verified provider IDs
+}
+
+func (updtr *updater) onDisconnect(netconn as.Netconn) {
+	updtr.Lock()
+	delete(updtr.nonces, netconn)
+	delete(updtr.reporters, netconn)
+	updtr.Unlock()
+}
+
+// reporter returns the provider ID verified by updateReport on the
+// connection, empty if not verified.
+func (updtr *updater) reporter(netconn as.Netconn) string {
+	updtr.Lock()
+	defer updtr.Unlock()
+	return updtr.reporters[netconn]
+}
+
+// updatePurpose is signed with the challenge so that the signature is only
+// valid for the report to the updater.
+const updatePurpose = "gshellos update v1"
+
+// updatePayload returns the bytes signed by the provider with the node key
+// to report its rev to the updater.
+func updatePayload(nonce []byte, providerID, rev, arch string) []byte {
+	var b bytes.Buffer
+	b.WriteString(updatePurpose)
+	b.WriteByte(0)
+	b.Write(nonce)
+	for _, str := range []string{providerID, rev, arch} {
+		b.WriteString(str)
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// reply with *authChallenge or error, the nonce is to be signed in the
+// following updateReport on the same connection.
+type updateChallenge struct{}
+
+func (msg updateChallenge) Handle(stream as.ContextStream) (reply interface{}) {
+	updtr := stream.GetContext().(*updater)
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	updtr.Lock()
+	updtr.nonces[stream.GetNetconn()] = nonce
+	updtr.Unlock()
+	return &authChallenge{Nonce: nonce}
+}
+
+// reply OK or error
+// The provider reports its rev signed with its node key before tryUpdateV2
+// on the same connection, the provider ID is then trusted by the updater.
+type updateReport struct {
+	providerID string
+	revInuse   string
+	arch       string
+	key        []byte // node key of the provider
+	sig        []byte // of updatePayload with the nonce of updateChallenge
+}
+
+func (msg *updateReport) Handle(stream as.ContextStream) (reply interface{}) {
+	updtr := stream.GetContext().(*updater)
+	netconn := stream.GetNetconn()
+	updtr.Lock()
+	nonce := updtr.nonces[netconn]
+	delete(updtr.nonces, netconn)
+	updtr.Unlock()
+	if nonce == nil {
+		return errors.New("no challenge")
+	}
+	if len(msg.key) != ed25519.PublicKeySize {
+		return errors.New("no key")
+	}
+	if !ed25519.Verify(msg.key, updatePayload(nonce, msg.providerID, msg.revInuse, msg.arch), msg.sig) {
+		return errors.New("wrong signature")
+	}
+	if err := updtr.rollout.seen(msg.providerID, msg.revInuse, msg.arch, msg.key); err != nil {
+		return err
+	}
+	updtr.Lock()
+	updtr.reporters[netconn] = msg.providerID
+	updtr.Unlock()
+	return as.OK
 }
 
 type gshellBin struct {
@@ -584,7 +1039,16 @@ type gshellBin struct {
 	md5 string
 }
 
+// gshellBinSigned is the new version with its signature for tryUpdateV2.
+type gshellBinSigned struct {
+	bin []byte
+	md5 string
+	sig string // base64 ed25519 signature of bin, empty if not provided
+	rev string
+}
+
 // reply with *gshellBin
+// Sent by the daemons of older versions, kept for them to be updated.
 type tryUpdate struct {
 	revInuse string
 	arch     string
@@ -593,26 +1057,59 @@ type tryUpdate struct {
 func (msg tryUpdate) Handle(stream as.ContextStream) (reply interface{}) {
 	updtr := stream.GetContext().(*updater)
 	updtr.lg.Debugf("tryUpdate: %v", msg)
+	gb, err := updtr.newVersion(stream.GetNetconn(), "", msg.revInuse, "", msg.arch)
+	if err != nil {
+		return err
+	}
+	return &gshellBin{gb.bin, gb.md5}
+}
 
-	rev, err := httpOp.readFile(updtr.url + "/rev")
+// reply with *gshellBinSigned
+// The provider is the one verified by updateReport, the daemons not verified
+// are only updated when all providers are selected.
+type tryUpdateV2 struct {
+	revInuse  string
+	revFailed string // rolled back before, not to update again
+	arch      string
+}
+
+func (msg tryUpdateV2) Handle(stream as.ContextStream) (reply interface{}) {
+	updtr := stream.GetContext().(*updater)
+	providerID := updtr.reporter(stream.GetNetconn())
+	updtr.lg.Debugf("tryUpdateV2: %s %v", providerID, msg)
+	gb, err := updtr.newVersion(stream.GetNetconn(), providerID, msg.revInuse, msg.revFailed, msg.arch)
 	if err != nil {
 		return err
 	}
+	return gb
+}
+
+// newVersion returns the new version for the provider if it is to be
+// updated, the provider ID is empty if not verified.
+func (updtr *updater) newVersion(netconn as.Netconn, providerID, revInuse, revFailed, arch string) (*gshellBinSigned, error) {
+	rev, err := httpOp.readFile(updtr.url + "/rev")
+	if err != nil {
+		return nil, err
+	}
 	revNew := strings.TrimSpace(string(rev))
 	updtr.lg.Debugf("tryUpdate rev: %s", revNew)
+	root := netconn.LocalAddr().Network() == "chan"
 	if revNew != commitRev { // check root registry rev
 		// not update other gshell daemons if root registry is not the latest
-		if stream.GetNetconn().LocalAddr().Network() != "chan" {
-			return ErrNoUpdate
+		if !root {
+			return nil, ErrNoUpdate
 		}
 	}
-	if revNew == msg.revInuse {
-		return ErrNoUpdate
+	if revNew == revInuse || revNew == revFailed {
+		return nil, ErrNoUpdate
+	}
+	if err := updtr.rollout.admit(providerID, revNew, root); err != nil {
+		return nil, err
 	}
 
 	checksum, err := httpOp.readFile(updtr.url + "/md5sum")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var md5 string
@@ -622,36 +1119,89 @@ func (msg tryUpdate) Handle(stream as.ContextStream) (reply interface{}) {
 		if err != nil {
 			break
 		}
-		if strings.Contains(line, msg.arch) {
+		if strings.Contains(line, arch) {
 			md5 = strings.Split(line, " ")[0]
 			break
 		}
 	}
 	if len(md5) == 0 {
-		return fmt.Errorf("arch %s not supported", msg.arch)
+		return nil, fmt.Errorf("arch %s not supported", arch)
 	}
 
-	bin, err := httpOp.readFile(updtr.url + "/gshell." + msg.arch)
+	bin, err := httpOp.readFile(updtr.url + "/gshell." + arch)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// the signature is optional for the daemons not configured with -update-key
+	sig, _ := httpOp.readFile(updtr.url + "/gshell." + arch + ".sig")
+
+	return &gshellBinSigned{bin, md5, strings.TrimSpace(string(sig)), revNew}, nil
+}
+
+// verify checks the new version against the md5 and the trusted key if any.
+func (gb *gshellBinSigned) verify(updateKey ed25519.PublicKey) error {
+	if fmt.Sprintf("%x", md5.Sum(gb.bin)) != gb.md5 {
+		return errors.New("md5 mismatch")
+	}
+	if updateKey == nil {
+		return nil
+	}
+	if len(gb.sig) == 0 {
+		return errors.New("not signed")
 	}
+	sig, err := base64.StdEncoding.DecodeString(gb.sig)
+	if err != nil || !ed25519.Verify(updateKey, gb.bin, sig) {
+		return errors.New("signature not verified")
+	}
+	return nil
+}
 
-	return &gshellBin{bin, md5}
+// waitDaemon waits for the new daemon to publish gshellDaemon, false if the
+// new daemon exited or not published within the timeout.
+func waitDaemon(cmd *exec.Cmd, timeout time.Duration, lg *log.Logger) bool {
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	c := as.NewClient(as.WithLogger(lg), as.WithScope(as.ScopeOS)).SetDiscoverTimeout(0)
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		select {
+		case <-exited:
+			return false
+		case <-time.After(time.Second):
+		}
+		if conn := <-c.Discover(godevsigPublisher, "gshellDaemon"); conn != nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
 }
 
 var updaterKnownMsgs = []as.KnownMessage{
+	updateChallenge{},
+	(*updateReport)(nil),
 	tryUpdate{},
+	tryUpdateV2{},
+	updateStatus{},
+	(*updateControl)(nil),
 }
 
 type codeRepoSvc struct {
 	localRepoPath string
 	httpRepoInfo  []string // site/org/proj/branch
+	gitRepo       *gitRepo
+	cache         *codeCache
 }
 
 type codeRepoAddr struct{}
 
 func (msg codeRepoAddr) Handle(stream as.ContextStream) (reply interface{}) {
 	crs := stream.GetContext().(*codeRepoSvc)
+	if crs.gitRepo != nil {
+		return crs.gitRepo.String()
+	}
 	if crs.localRepoPath != "" {
 		return crs.localRepoPath
 	}
@@ -695,15 +1245,36 @@ type getCode struct {
 
 func (msg getCode) Handle(stream as.ContextStream) (reply interface{}) {
 	crs := stream.GetContext().(*codeRepoSvc)
+	zip, err := crs.code(msg)
+	if err != nil {
+		return err
+	}
+	return zip
+}
+
+// code returns the code bundle, the code from git repo and the vendored code
+// are cached by their sources.
+func (crs *codeRepoSvc) code(msg getCode) ([]byte, error) {
 	HTTPAddr := ""
 	if strings.HasPrefix(msg.PathFile, "http://") || strings.HasPrefix(msg.PathFile, "https://") {
 		HTTPAddr = msg.PathFile // raw URL
 	}
 	var zip []byte
 	var err error
-	if HTTPAddr != "" || len(crs.httpRepoInfo) != 0 {
+	if HTTPAddr == "" && crs.gitRepo != nil {
+		var object string
+		if _, object, err = crs.gitRepo.object(msg.PathFile); err != nil {
+			return nil, err
+		}
+		key := "git:" + object
+		if zip = crs.cache.lookup(key); zip == nil {
+			if zip, err = crs.gitRepo.zip(msg.PathFile); err == nil {
+				crs.cache.put(zip, key)
+			}
+		}
+	} else if HTTPAddr != "" || len(crs.httpRepoInfo) != 0 {
 		if httpOp == nil {
-			return errors.New("No http functionality, check the build tags")
+			return nil, errors.New("No http functionality, check the build tags")
 		}
 
 		if HTTPAddr == "" {
@@ -713,7 +1284,7 @@ func (msg getCode) Handle(stream as.ContextStream) (reply interface{}) {
 			} else if strings.Contains(domain, "gitlab") {
 				HTTPAddr = fmt.Sprintf("https://%s/%s/%s/-/tree/%s/%s", domain, owner, repo, branch, msg.PathFile)
 			} else {
-				return fmt.Errorf("%s not supported", domain)
+				return nil, fmt.Errorf("%s not supported", domain)
 			}
 		}
 
@@ -725,17 +1296,22 @@ func (msg getCode) Handle(stream as.ContextStream) (reply interface{}) {
 	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !msg.AutoImport {
-		return zip
+		return zip, nil
 	}
 
+	key := "vendor:" + codeSum(zip)
+	if vendored := crs.cache.lookup(key); vendored != nil {
+		return vendored, nil
+	}
 	zip, err = goModVendor(zip)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return zip
+	crs.cache.put(zip, key)
+	return zip, nil
 }
 
 // reply with []dirEntry
@@ -751,6 +1327,13 @@ type dirEntry struct {
 func (msg codeRepoList) Handle(stream as.ContextStream) (reply interface{}) {
 	crs := stream.GetContext().(*codeRepoSvc)
 	var entries []dirEntry
+	if crs.gitRepo != nil && !strings.HasPrefix(msg.path, "http://") && !strings.HasPrefix(msg.path, "https://") {
+		entries, err := crs.gitRepo.list(msg.path)
+		if err != nil {
+			return err
+		}
+		return entries
+	}
 	// local dir
 	if crs.localRepoPath != "" {
 		path := filepath.Join(crs.localRepoPath, msg.path)
@@ -801,6 +1384,10 @@ func (msg codeRepoList) Handle(stream as.ContextStream) (reply interface{}) {
 var codeRepoKnownMsgs = []as.KnownMessage{
 	codeRepoAddr{},
 	getCode{},
+	getCodeSig{},
+	getCodeRev{},
+	getCodeSum{},
+	getCachedCode{},
 	codeRepoList{},
 }
 
@@ -811,6 +1398,7 @@ func init() {
 	as.RegisterType([]*grgGREInfo(nil))
 	as.RegisterType((*cmdPatternAction)(nil))
 	as.RegisterType([]*grgGREIDs(nil))
+	as.RegisterType((*cmdRegroup)(nil))
 	as.RegisterType((*cmdLog)(nil))
 	as.RegisterType(cmdInfo{})
 	as.RegisterType(cmdJoblistSave{})
@@ -822,6 +1410,10 @@ func init() {
 	as.RegisterType(getCode{})
 	as.RegisterType(codeRepoList{})
 	as.RegisterType([]dirEntry(nil))
+	as.RegisterType(updateChallenge{})
 	as.RegisterType(tryUpdate{})
 	as.RegisterType((*gshellBin)(nil))
+	as.RegisterType((*updateReport)(nil))
+	as.RegisterType(tryUpdateV2{})
+	as.RegisterType((*gshellBinSigned)(nil))
 }
@@ -0,0 +1,225 @@
+package gshellos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/gshellos/extension"
+	"github.com/godevsig/gshellos/stdlib"
+	"github.com/godevsig/gshellos/stdlib/unsafe"
+)
+
+const evalTimeoutDefault = 10 // in seconds
+
+// evalPkgs maps the package names to the import paths of the pre-compiled
+// packages, the shortest path wins if packages have the same name.
+var evalPkgs = func() map[string]string {
+	pkgs := make(map[string]string)
+	for _, symbols := range []map[string]map[string]reflect.Value{stdlib.Symbols, unsafe.Symbols, extension.Symbols} {
+		for key := range symbols {
+			i := strings.LastIndex(key, "/")
+			if i < 0 {
+				continue
+			}
+			path, name := key[:i], key[i+1:]
+			if old, has := pkgs[name]; !has || len(path) < len(old) || len(path) == len(old) && path < old {
+				pkgs[name] = path
+			}
+		}
+	}
+	return pkgs
+}()
+
+var evalSeq int32
+
+var predeclared = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, name := range strings.Fields(`any bool byte comparable complex64 complex128 error float32 float64
+		int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr
+		true false iota nil
+		append cap close complex copy delete imag len make new panic print println real recover`) {
+		m[name] = true
+	}
+	return m
+}()
+
+// wrapSnippet wraps the snippet in the init function of a new package, evaluating
+// the snippet in package main would run main function of the GRE again.
+// Package-level identifiers of the GRE are referenced through package main, and
+// the pre-compiled packages are imported on use. The value of a non-call
+// expression is printed.
+func wrapSnippet(snippet string) (string, error) {
+	if expr, err := parser.ParseExpr(snippet); err == nil {
+		if _, ok := expr.(*ast.CallExpr); !ok {
+			snippet = "fmt.Println(" + snippet + ")"
+		}
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", "package p\nfunc init() {\n"+snippet+"\n}", 0)
+	if err != nil {
+		return "", err
+	}
+	if err := checkInterruptible(f); err != nil {
+		return "", err
+	}
+
+	pkgIdents := make(map[*ast.Ident]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				pkgIdents[id] = true
+			}
+		}
+		return true
+	})
+	imports := make(map[string]bool)
+	for _, id := range f.Unresolved {
+		if path, has := evalPkgs[id.Name]; has && pkgIdents[id] {
+			imports[path] = true
+			continue
+		}
+		if predeclared[id.Name] {
+			continue
+		}
+		id.Name = "main." + id.Name
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "package gshelleval%d\n", atomic.AddInt32(&evalSeq, 1))
+	// the code of GREs is evaluated from the code dir which is imported as "."
+	b.WriteString("import main \".\"\n")
+	paths := make([]string, 0, len(imports))
+	for path := range imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(&b, "import %q\n", path)
+	}
+	if err := printer.Fprint(&b, fset, f.Decls[0]); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// checkInterruptible rejects the snippet that may run on its own after the
+// eval timeout. The interpreter can only be stopped as a whole, which would
+// stop the GRE, so such snippets are not run at all.
+func checkInterruptible(f *ast.File) error {
+	var what string
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ForStmt, *ast.RangeStmt:
+			what = "loops"
+		case *ast.GoStmt:
+			what = "goroutines"
+		case *ast.SelectStmt, *ast.SendStmt:
+			what = "channel operations"
+		case *ast.UnaryExpr:
+			if n.Op == token.ARROW {
+				what = "channel operations"
+			}
+		case *ast.LabeledStmt:
+			what = "labels"
+		}
+		return len(what) == 0
+	})
+	if len(what) != 0 {
+		return fmt.Errorf("snippet with %s can not be interrupted, not supported", what)
+	}
+	return nil
+}
+
+// stream of output of the snippet
+type grgCmdEval struct {
+	GREID   string
+	Snippet string
+	Timeout int // in seconds
+}
+
+func (msg *grgCmdEval) Handle(stream as.ContextStream) (reply interface{}) {
+	grg := stream.GetContext().(*grg)
+	grg.RLock()
+	gc := grg.gres[msg.GREID]
+	grg.RUnlock()
+	if gc == nil {
+		return fmt.Errorf("GRE %s not found", msg.GREID)
+	}
+	if gc.runMsg.Isolate {
+		return fmt.Errorf("GRE %s is isolated, eval not supported", msg.GREID)
+	}
+	gsh := gc.gsh
+	if stat := atomic.LoadInt32(&gc.stat); gsh == nil || stat != greStatRunning && stat != greStatUnhealthy {
+		return fmt.Errorf("GRE %s is %s", msg.GREID, greStatString[stat])
+	}
+	code, err := wrapSnippet(msg.Snippet)
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	grg.lg.Debugf("gre %s eval: %s", gc.ID, code)
+
+	// the snippet blocked in a call can not be interrupted, only one is
+	// allowed to run in the GRE
+	if !atomic.CompareAndSwapInt32(&gc.evaluating, 0, 1) {
+		return fmt.Errorf("GRE %s is still running the previous eval", msg.GREID)
+	}
+
+	clientIO := as.NewStreamIO(stream)
+	gc.attacher.tap(clientIO)
+	defer gc.attacher.untap(clientIO)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := gsh.interpreter.Eval(code)
+		atomic.StoreInt32(&gc.evaluating, 0)
+		done <- err
+	}()
+	timeout := msg.Timeout
+	if timeout <= 0 {
+		timeout = evalTimeoutDefault
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			// errors of the interpreter reference its internal nodes and can not be sent
+			err = errors.New(err.Error())
+		}
+	case <-time.After(time.Duration(timeout) * time.Second):
+		err = fmt.Errorf("eval not finished in %d seconds, no more eval of the GRE until it finishes", timeout)
+	}
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// stream of output of the snippet
+type cmdEval struct {
+	grgCmdEval
+}
+
+func (msg *cmdEval) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleOperator, "eval"); err != nil {
+		return err
+	}
+	gd.lg.Debugf("handle cmdEval: %v", msg)
+	return gd.streamGRE(stream, msg.GREID, &msg.grgCmdEval)
+}
+
+func init() {
+	as.RegisterType((*grgCmdEval)(nil))
+	as.RegisterType((*cmdEval)(nil))
+}
@@ -0,0 +1,216 @@
+package gshellos
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/glib/sys/log"
+)
+
+const (
+	eventGRECreated   = "gre-created"
+	eventGREStarted   = "gre-started"
+	eventGREExited    = "gre-exited"
+	eventGRERestarted = "gre-restarted"
+	eventGRERemoved   = "gre-removed"
+	eventGRGSpawned   = "grg-spawned"
+	eventGRGDied      = "grg-died"
+)
+
+// event is the lifecycle event of GRE or GRG, empty Type is keepalive.
+type event struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	GRG   string    `json:"grg"`
+	GREID string    `json:"greid,omitempty"`
+	Name  string    `json:"name,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+func (ev *event) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s  %-14s  %-18s", ev.Time.Format("2006/01/02 15:04:05"), ev.Type, ev.GRG)
+	if len(ev.GREID) != 0 {
+		fmt.Fprintf(&b, "  %s  %s", ev.GREID, ev.Name)
+	}
+	if len(ev.Error) != 0 {
+		fmt.Fprintf(&b, "  error: %s", strings.TrimSpace(ev.Error))
+	}
+	return b.String()
+}
+
+// matchGRG matches the GRG name with or without version against the pattern.
+func matchGRG(pattern, grgName string) bool {
+	if ok, _ := filepath.Match(pattern, grgName); ok {
+		return true
+	}
+	ok, _ := filepath.Match(pattern, strings.Split(grgName, "-")[0])
+	return ok
+}
+
+// eventHub dispatches events to the subscribers in daemon.
+type eventHub struct {
+	sync.Mutex
+	subs map[chan *event]struct{}
+}
+
+// publish drops the event for slow subscribers.
+func (hub *eventHub) publish(ev *event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	hub.Lock()
+	defer hub.Unlock()
+	for ch := range hub.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (hub *eventHub) subscribe() chan *event {
+	ch := make(chan *event, 128)
+	hub.Lock()
+	if hub.subs == nil {
+		hub.subs = make(map[chan *event]struct{})
+	}
+	hub.subs[ch] = struct{}{}
+	hub.Unlock()
+	return ch
+}
+
+func (hub *eventHub) unsubscribe(ch chan *event) {
+	hub.Lock()
+	delete(hub.subs, ch)
+	hub.Unlock()
+}
+
+// eventReporter sends the events of the GRG to daemon in background.
+type eventReporter struct {
+	sync.Mutex
+	closed  bool
+	grgName string
+	lg      *log.Logger
+	events  chan *event
+	done    chan struct{}
+}
+
+func newEventReporter(grgName string, lg *log.Logger) *eventReporter {
+	er := &eventReporter{grgName: grgName, lg: lg, events: make(chan *event, 128), done: make(chan struct{})}
+	go er.run()
+	return er
+}
+
+func (er *eventReporter) report(ev *event) {
+	if er == nil {
+		return
+	}
+	ev.Time = time.Now()
+	ev.GRG = er.grgName
+	er.Lock()
+	defer er.Unlock()
+	if er.closed {
+		return
+	}
+	select {
+	case er.events <- ev:
+	default:
+		er.lg.Debugf("event %s dropped", ev)
+	}
+}
+
+// close waits a while for the pending events to be sent.
+func (er *eventReporter) close() {
+	er.Lock()
+	er.closed = true
+	close(er.events)
+	er.Unlock()
+	select {
+	case <-er.done:
+	case <-time.After(3 * time.Second):
+	}
+}
+
+func (er *eventReporter) run() {
+	defer close(er.done)
+	var conn as.Connection
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for ev := range er.events {
+		if conn == nil {
+			c := as.NewClient(as.WithLogger(er.lg), as.WithScope(as.ScopeOS)).SetDiscoverTimeout(3)
+			conn = <-c.Discover(godevsigPublisher, "gshellDaemon")
+			if conn == nil {
+				er.lg.Debugf("event %s dropped: daemon not found", ev)
+				continue
+			}
+		}
+		// wait for the reply to keep the order of events
+		if err := conn.SendRecv(&cmdReportEvent{ev}, nil); err != nil {
+			er.lg.Debugf("event %s dropped: %v", ev, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// reply OK
+type cmdReportEvent struct {
+	Event *event
+}
+
+func (msg *cmdReportEvent) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.localOnly(stream, "report event"); err != nil {
+		return err
+	}
+	gd.events.publish(msg.Event)
+	return as.OK
+}
+
+// reply stream of *event until the client closes the connection
+type cmdEvents struct {
+	GRGName string
+}
+
+func (msg *cmdEvents) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleReadOnly, "events"); err != nil {
+		return err
+	}
+	ch := gd.events.subscribe()
+	defer gd.events.unsubscribe(ch)
+
+	// keepalive to detect the closed client
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	for {
+		var ev *event
+		select {
+		case ev = <-ch:
+			if !matchGRG(msg.GRGName, ev.GRG) {
+				continue
+			}
+		case <-ticker.C:
+			ev = &event{Time: time.Now()}
+		}
+		if err := stream.Send(ev); err != nil {
+			gd.lg.Debugln("cmdEvents: done")
+			return nil
+		}
+	}
+}
+
+func init() {
+	as.RegisterType((*event)(nil))
+	as.RegisterType((*cmdReportEvent)(nil))
+	as.RegisterType((*cmdEvents)(nil))
+}
@@ -0,0 +1,213 @@
+package gshellos
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/glib/sys/log"
+)
+
+var (
+	allProviders bool
+	fleetTimeout = 10 // per node timeout in seconds
+)
+
+// the commands that run on multiple providers
+var fleetCmds = map[string]bool{
+	"ps":      true,
+	"info":    true,
+	"log":     true,
+	"stop":    true,
+	"start":   true,
+	"joblist": true,
+}
+
+// isFleet tells if -p targets multiple providers by wildcard or comma list, or -all is set.
+func isFleet() bool {
+	return allProviders || strings.ContainsAny(providerID, "*?[,")
+}
+
+// listDaemons returns the provider IDs of all the gshellDaemon services in scope.
+func listDaemons(selfID string, lg *log.Logger) ([]string, error) {
+	c := as.NewClient(as.WithScope(as.ScopeProcess|as.ScopeOS), as.WithLogger(lg)).SetDiscoverTimeout(0)
+	conn := <-c.Discover(as.BuiltinPublisher, as.SrvServiceLister)
+	if conn == nil {
+		return nil, as.ErrServiceNotFound(as.BuiltinPublisher, as.SrvServiceLister)
+	}
+	defer conn.Close()
+
+	msg := as.ListService{TargetScope: as.ScopeAll, Publisher: godevsigPublisher, Service: "gshellDaemon"}
+	var scopes [4][]*as.ServiceInfo
+	if err := conn.SendRecv(&msg, &scopes); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, services := range scopes {
+		for _, svc := range services {
+			id := svc.ProviderID
+			if id == "self" {
+				id = selfID
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// targetProviders returns the sorted provider IDs targeted by -p or -all,
+// the daemons are discovered only if -all or wildcard is used.
+func targetProviders(selfID string, lg *log.Logger) ([]string, error) {
+	var patterns []string
+	if !allProviders {
+		for _, p := range strings.Split(providerID, ",") {
+			if p = strings.TrimSpace(p); len(p) != 0 {
+				patterns = append(patterns, p)
+			}
+		}
+	}
+
+	targets := make(map[string]bool)
+	var wildcards []string
+	for _, p := range patterns {
+		if p == "self" && len(selfID) != 0 {
+			p = selfID
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("wrong provider pattern %s", p)
+		}
+		if strings.ContainsAny(p, "*?[") {
+			wildcards = append(wildcards, p)
+		} else {
+			targets[p] = true
+		}
+	}
+	if allProviders || len(wildcards) != 0 {
+		ids, err := listDaemons(selfID, lg)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if allProviders {
+				targets[id] = true
+			}
+			for _, p := range wildcards {
+				if matched, _ := path.Match(p, id); matched {
+					targets[id] = true
+				}
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(targets))
+	for id := range targets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// fleetFile returns the file name with the provider ID added before the extension.
+func fleetFile(file, id string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "." + id + ext
+}
+
+type fleetResult struct {
+	out []byte
+	err error
+}
+
+// onDaemons runs fn with the connection to the gshellDaemon of the target provider.
+// If multiple providers are targeted, fn runs for each provider concurrently
+// within the per node timeout, and the outputs are aggregated with a provider
+// column. The header, if not empty, is the first line fn writes and is only
+// printed once.
+func onDaemons(header string, fn func(conn as.Connection, id string, w io.Writer) error) error {
+	lg := newLogger(log.DefaultStream, "main")
+	if !isFleet() {
+		conn := connectDaemon(providerID, lg)
+		if conn == nil {
+			return as.ErrServiceNotFound(godevsigPublisher, "gshellDaemon")
+		}
+		defer conn.Close()
+		return fn(conn, providerID, os.Stdout)
+	}
+
+	selfID, _ := getSelfID()
+	ids, err := targetProviders(selfID, lg)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no provider matches %s", providerID)
+	}
+
+	results := make([]*fleetResult, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			done := make(chan *fleetResult, 1)
+			go func() {
+				connID := id
+				if id == selfID {
+					connID = "self"
+				}
+				conn := connectDaemon(connID, lg)
+				if conn == nil {
+					done <- &fleetResult{err: as.ErrServiceNotFound(godevsigPublisher, "gshellDaemon")}
+					return
+				}
+				defer conn.Close()
+				var buf bytes.Buffer
+				err := fn(conn, id, &buf)
+				done <- &fleetResult{buf.Bytes(), err}
+			}()
+			select {
+			case results[i] = <-done:
+			case <-time.After(time.Duration(fleetTimeout) * time.Second):
+				results[i] = &fleetResult{err: fmt.Errorf("timeout after %d seconds", fleetTimeout)}
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	if len(header) != 0 {
+		fmt.Printf("%-12s  %s\n", "PROVIDER", header)
+	}
+	failed := 0
+	for i, id := range ids {
+		res := results[i]
+		if len(res.out) != 0 {
+			lines := strings.Split(strings.TrimSuffix(string(res.out), "\n"), "\n")
+			if len(header) != 0 && lines[0] == header {
+				lines = lines[1:]
+			}
+			for _, line := range lines {
+				fmt.Println(strings.TrimRight(fmt.Sprintf("%-12s  %s", id, line), " "))
+			}
+		}
+		if res.err != nil {
+			failed++
+			fmt.Printf("%-12s  error: %v\n", id, res.err)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d providers failed", failed, len(ids))
+	}
+	return nil
+}
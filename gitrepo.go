@@ -0,0 +1,245 @@
+package gshellos
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	as "github.com/godevsig/adaptiveservice"
+)
+
+// gitRepo is the code repo backed by a local git repository, the code is
+// read from the trees at refs so no work tree or network is needed.
+type gitRepo struct {
+	dir string // the git dir, bare or not
+	ref string // default ref, the branch in -repo or HEAD
+}
+
+// newGitRepo returns the git repo of addr in format git:/path/to/repo.git[#branch].
+func newGitRepo(addr string) (*gitRepo, error) {
+	dir, ref, _ := strings.Cut(strings.TrimPrefix(addr, "git:"), "#")
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	gr := &gitRepo{dir: dir, ref: ref}
+	if _, err := gr.resolve(""); err != nil {
+		return nil, fmt.Errorf("wrong git repo %s: %v", addr, err)
+	}
+	return gr, nil
+}
+
+func (gr *gitRepo) String() string {
+	return "git:" + gr.dir + "#" + gr.ref
+}
+
+func (gr *gitRepo) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", gr.dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) != 0 {
+			return nil, fmt.Errorf("git %s failed with %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s failed: %v", args[0], err)
+	}
+	return out, nil
+}
+
+// splitRef splits path[@ref] to path and ref.
+func splitRef(pathRef string) (path, ref string) {
+	if i := strings.LastIndex(pathRef, "@"); i >= 0 {
+		return pathRef[:i], pathRef[i+1:]
+	}
+	return pathRef, ""
+}
+
+// resolve returns the commit hash of the ref, or of the default ref if empty.
+func (gr *gitRepo) resolve(ref string) (string, error) {
+	if len(ref) == 0 {
+		ref = gr.ref
+	}
+	out, err := gr.git("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown ref %s", ref)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// object returns the commit of path[@ref] and the object name of the path in it.
+func (gr *gitRepo) object(pathRef string) (commit, object string, err error) {
+	path, ref := splitRef(pathRef)
+	commit, err = gr.resolve(ref)
+	if err != nil {
+		return "", "", err
+	}
+	path = strings.Trim(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+	return commit, commit + ":" + path, nil
+}
+
+func (gr *gitRepo) objectType(object string) (string, error) {
+	out, err := gr.git("cat-file", "-t", object)
+	if err != nil {
+		path := object[strings.Index(object, ":")+1:]
+		return "", fmt.Errorf("%s not found in %s", path, object[:12])
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// zip returns the code at path[@ref] zipped the same way as from a local dir,
+// so that the code signature made on a checkout still verifies.
+func (gr *gitRepo) zip(pathRef string) ([]byte, error) {
+	_, object, err := gr.object(pathRef)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := gr.objectType(object)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := os.MkdirTemp(gshellTempDir, "gitcode-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	switch typ {
+	case "blob":
+		data, err := gr.git("cat-file", "blob", object)
+		if err != nil {
+			return nil, err
+		}
+		file := filepath.Join(tmpDir, filepath.Base(object[strings.Index(object, ":")+1:]))
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			return nil, err
+		}
+		return zipPathToBuffer(file)
+	case "tree":
+		data, err := gr.git("archive", "--format=tar", object)
+		if err != nil {
+			return nil, err
+		}
+		if err := untarBufferToPath(data, tmpDir); err != nil {
+			return nil, err
+		}
+		return zipPathToBuffer(tmpDir)
+	}
+	return nil, fmt.Errorf("%s is not a file or directory", pathRef)
+}
+
+// list returns the entries at path[@ref].
+func (gr *gitRepo) list(pathRef string) ([]dirEntry, error) {
+	_, object, err := gr.object(pathRef)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := gr.objectType(object)
+	if err != nil {
+		return nil, err
+	}
+	if typ == "blob" {
+		path, _ := splitRef(pathRef)
+		return []dirEntry{{filepath.Base(path), false}}, nil
+	}
+
+	out, err := gr.git("ls-tree", object)
+	if err != nil {
+		return nil, err
+	}
+	var entries []dirEntry
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// <mode> SP <type> SP <object> TAB <file>
+		meta, name, found := strings.Cut(scanner.Text(), "\t")
+		if !found {
+			continue
+		}
+		entries = append(entries, dirEntry{name, strings.Contains(meta, " tree ")})
+	}
+	return entries, nil
+}
+
+// sig returns the content of the signature file of path[@ref], empty if not signed.
+func (gr *gitRepo) sig(pathRef string) (string, error) {
+	path, ref := splitRef(pathRef)
+	_, object, err := gr.object(sigFile(path) + "@" + ref)
+	if err != nil {
+		return "", err
+	}
+	if _, err := gr.git("cat-file", "-e", object); err != nil {
+		return "", nil
+	}
+	data, err := gr.git("cat-file", "blob", object)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// untar data in tar format to folder, only directories and regular files are extracted.
+func untarBufferToPath(data []byte, path string) error {
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(path, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&0777)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reply with the commit hash the code path[@ref] resolves to, empty if the
+// code repo is not backed by git
+type getCodeRev struct {
+	PathFile string
+}
+
+func (msg getCodeRev) Handle(stream as.ContextStream) (reply interface{}) {
+	crs := stream.GetContext().(*codeRepoSvc)
+	if crs.gitRepo == nil || strings.HasPrefix(msg.PathFile, "http://") || strings.HasPrefix(msg.PathFile, "https://") {
+		return ""
+	}
+	_, ref := splitRef(msg.PathFile)
+	commit, err := crs.gitRepo.resolve(ref)
+	if err != nil {
+		return err
+	}
+	return commit
+}
+
+func init() {
+	as.RegisterType(getCodeRev{})
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -16,6 +17,7 @@ import (
 
 	as "github.com/godevsig/adaptiveservice"
 	"github.com/godevsig/glib/sys/log"
+	"github.com/godevsig/gshellos/stdlib"
 	"github.com/traefik/yaegi/interp"
 )
 
@@ -31,11 +33,15 @@ type processInfo struct {
 type grg struct {
 	sync.RWMutex
 	processInfo
-	workDir string
-	server  *as.Server
-	lg      *log.Logger
-	greids  []string // keep the order
-	gres    map[string]*greCtl
+	workDir     string
+	server      *as.Server
+	lg          *log.Logger
+	greids      []string // keep the order
+	gres        map[string]*greCtl
+	events      *eventReporter
+	conns       connStat
+	logRotation LogRotation // default log rotation of GREs
+	cache       *codeCache
 }
 
 func (grg *grg) onNewStream(ctx as.Context) {
@@ -44,6 +50,8 @@ func (grg *grg) onNewStream(ctx as.Context) {
 
 const greIDWidth = 6
 
+var greIDRegexp = regexp.MustCompile(`^[0-9a-f]+$`)
+
 func (grg *grg) loadGREs() error {
 	gres, err := filepath.Glob(grg.statDir + "/*")
 	if err != nil {
@@ -86,7 +94,11 @@ func (grg *grg) loadGREs() error {
 			grg.addGRE(gc)
 
 			switch gi.Stat {
-			case "starting", "running":
+			case "starting", "running", "scheduled", "unhealthy":
+				if err := gc.reset(); err != nil {
+					grg.lg.Errorln(err)
+					return
+				}
 				go grg.runGRE(gc)
 				grg.lg.Infof("gre %s restarted", greid)
 			case "aborting", "exited":
@@ -108,6 +120,14 @@ func (grg *grg) addGRE(gc *greCtl) {
 }
 
 func (grg *grg) rmGRE(gc *greCtl) {
+	gc.report(eventGRERemoved, "")
+	grg.detachGRE(gc)
+	removeLogFiles(gc.outputFile)
+	removeLogFiles(gc.stderrFile)
+}
+
+// detachGRE removes the GRE from grg but keeps its output file.
+func (grg *grg) detachGRE(gc *greCtl) {
 	grg.Lock()
 	delete(grg.gres, gc.ID)
 	greids := make([]string, 0, len(grg.greids)-1)
@@ -119,7 +139,7 @@ func (grg *grg) rmGRE(gc *greCtl) {
 	grg.greids = greids
 	grg.Unlock()
 	gc.close()
-	grg.lg.Debugln("gre " + gc.ID + " removed")
+	grg.lg.Debugln("gre " + gc.ID + " detached")
 
 	grg.Lock()
 	if len(grg.greids) == 0 {
@@ -133,13 +153,27 @@ const (
 	greStatRunning
 	greStatAborting
 	greStatExited
+	greStatScheduled
+	greStatUnhealthy
+	greStatRestarting
 )
 
 var greStatString = []string{
-	greStatStarting: "starting",
-	greStatRunning:  "running",
-	greStatAborting: "aborting",
-	greStatExited:   "exited",
+	greStatStarting:   "starting",
+	greStatRunning:    "running",
+	greStatAborting:   "aborting",
+	greStatExited:     "exited",
+	greStatScheduled:  "scheduled",
+	greStatUnhealthy:  "unhealthy",
+	greStatRestarting: "restarting",
+}
+
+const greHistoryMax = 10
+
+type runRecord struct {
+	StartTime time.Time
+	EndTime   time.Time
+	GREErr    string
 }
 
 type greInfo struct {
@@ -151,51 +185,84 @@ type greInfo struct {
 	StartTime          time.Time
 	EndTime            time.Time
 	RestartedNum       int
-	AutoRestartBalance uint   // the remaining number of auto restart
-	RequestedBy        string // by which provider ID
+	AutoRestartBalance uint        // the remaining number of auto restart
+	RequestedBy        string      // by which provider ID
+	Pid                int         // pid of the helper process if isolated
+	Schedule           string      // cron expression
+	NextRun            time.Time   // of scheduled or restarting GRE
+	History            []runRecord // the latest runs of scheduled GRE
+	HealthCheck        string
+	Health             string // result of the latest health check
+	CodeRev            string // commit of the code read from git repo
 }
 
 type greCtl struct {
 	*greInfo
-	cancel     context.CancelFunc
-	log        *os.File
-	stdin      io.Reader
-	stdout     io.Writer
-	stderr     *strings.Builder
-	args       []string
-	stat       int32
-	greErr     error // returned error when GRE exits
-	runMsg     *grgCmdRun
-	outputFile string
-	statDir    string
-	gsh        *gshell
-	codeDir    string
+	cancel      context.CancelFunc
+	log         *logFile // of stdout
+	errLog      *logFile // of stderr
+	stdin       io.Reader
+	stdout      io.Writer
+	stderr      io.Writer
+	attacher    *attacher
+	runEnd      chan struct{} // closed when the run ends
+	signals     *sigRelay     // of the current run
+	args        []string
+	stat        int32
+	evaluating  int32         // 1 if an eval snippet is running
+	greErr      error         // returned error when GRE exits
+	aborted     bool          // stopped by user in last run
+	cancelWait  chan struct{} // to cancel waiting for the next run
+	runMsg      *grgCmdRun
+	outputFile  string
+	stderrFile  string
+	statDir     string
+	gsh         *gshell
+	codeDir     string
+	events      *eventReporter
+	logRotation LogRotation
+	grgName     string
+	mu          sync.Mutex // protects Pid, Health, isolation and migration
+	isolation   *isolation
+	migration   *greMigration // being migrated out
+	health      *healthCheck
+}
+
+func (gc *greCtl) report(evType, errStr string) {
+	gc.events.report(&event{Type: evType, GREID: gc.ID, Name: gc.Name, Error: errStr})
 }
 
-// gi is not nil when loading from file
+// gi is not nil when loading from file or adopting from other GRG
 func (grg *grg) newGRE(gi *greInfo, runMsg *grgCmdRun) (*greCtl, error) {
-	gc := &greCtl{args: runMsg.Args, runMsg: runMsg}
+	if err := grg.verifyCode(runMsg); err != nil {
+		return nil, err
+	}
+	gc := &greCtl{args: runMsg.Args, runMsg: runMsg, cancelWait: make(chan struct{}, 1), attacher: newAttacher()}
 	gc.greInfo = gi
 	if gi == nil {
 		gc.greInfo = &greInfo{}
-		name := filepath.Base(runMsg.Args[0])
-		gc.Name = strings.TrimSuffix(name, filepath.Ext(name))
+		gc.Name = runMsg.name()
 		gc.ID = genID(greIDWidth)
 		gc.greInfo.Args = runMsg.Args
 		gc.RestartedNum = 0
 		gc.AutoRestartBalance = runMsg.AutoRestartMax
 		gc.RequestedBy = runMsg.RequestedBy
+		gc.Schedule = runMsg.Schedule
+		gc.HealthCheck = runMsg.HealthCheck
+		gc.CodeRev = runMsg.CodeRev
 	}
+	gc.events = grg.events
+	gc.grgName = grg.name
+	gc.logRotation = runMsg.LogRotation
+	gc.logRotation.merge(grg.logRotation)
 	gc.outputFile = filepath.Join(grg.workDir, "logs", gc.ID)
+	gc.stderrFile = gc.outputFile + ".stderr"
 	gc.statDir = filepath.Join(grg.statDir, gc.ID)
 
-	if gi == nil {
+	if _, err := os.Stat(gc.statDir); err != nil { // new or adopted GRE
 		if err := os.MkdirAll(gc.statDir, 0755); err != nil {
 			return nil, err
 		}
-		if err := gc.reset(); err != nil {
-			return nil, err
-		}
 		if err := gc.runMsgToFile(); err != nil {
 			return nil, err
 		}
@@ -217,18 +284,147 @@ func (grg *grg) newGRE(gi *greInfo, runMsg *grgCmdRun) (*greCtl, error) {
 }
 
 func (grg *grg) runGRE(gc *greCtl) {
+	if len(gc.runMsg.Schedule) != 0 {
+		grg.runScheduledGRE(gc)
+	} else {
+		policy := gc.runMsg.RestartPolicy
+		var n uint // consecutive restarts
+		for {
+			gc.runGRE()
+			if window := policy.ResetWindow; window != 0 && gc.EndTime.Sub(gc.StartTime) >= time.Duration(window)*time.Second {
+				gc.AutoRestartBalance = gc.runMsg.AutoRestartMax
+				n = 0
+			}
+			if !gc.needRestart() {
+				break
+			}
+			d := policy.delay(n)
+			if gc.restartsUnlimited() {
+				if d < unlimitedRestartDelayMin {
+					d = unlimitedRestartDelayMin // not to spin on the GRE exiting at once
+				}
+			} else {
+				gc.AutoRestartBalance--
+			}
+			if !gc.waitRestart(d) {
+				break
+			}
+			n++
+			if err := gc.reset(); err != nil {
+				break
+			}
+			gc.RestartedNum++
+			gc.report(eventGRERestarted, "")
+		}
+	}
+	if gc.runMsg.AutoRemove {
+		grg.rmGRE(gc)
+	}
+}
+
+// runScheduledGRE runs the GRE each time the schedule fires until the GRE is stopped.
+func (grg *grg) runScheduledGRE(gc *greCtl) {
+	exit := func(errStr string) {
+		gc.closeLogs()
+		gc.NextRun = time.Time{}
+		if len(errStr) != 0 {
+			gc.GREErr = errStr
+		}
+		gc.changeStat(greStatExited)
+		gc.greInfoToFile()
+	}
+
+	sched, err := parseCron(gc.runMsg.Schedule)
+	if err != nil {
+		exit(err.Error())
+		return
+	}
+	select { // discard stale request
+	case <-gc.cancelWait:
+	default:
+	}
+
 	for {
+		gc.NextRun = sched.next(time.Now())
+		if gc.NextRun.IsZero() {
+			exit("no next run time for schedule " + gc.runMsg.Schedule)
+			return
+		}
+		gc.changeStat(greStatScheduled)
+		gc.greInfoToFile()
+
+		timer := time.NewTimer(time.Until(gc.NextRun))
+		select {
+		case <-timer.C:
+		case <-gc.cancelWait:
+			timer.Stop()
+			exit("")
+			return
+		}
+
 		gc.runGRE()
-		if gc.AutoRestartBalance == 0 {
-			break
+		gc.History = append(gc.History, runRecord{gc.StartTime, gc.EndTime, gc.GREErr})
+		if len(gc.History) > greHistoryMax {
+			gc.History = gc.History[len(gc.History)-greHistoryMax:]
+		}
+		if gc.aborted {
+			gc.NextRun = time.Time{}
+			gc.greInfoToFile()
+			return
 		}
 		if err := gc.reset(); err != nil {
-			break
+			grg.lg.Errorln(err)
+			return
 		}
-		gc.RestartedNum++
 	}
-	if gc.runMsg.AutoRemove {
-		grg.rmGRE(gc)
+}
+
+// canRestart reports if the GRE can be auto restarted by its policy and balance.
+func (gc *greCtl) canRestart() bool {
+	if gc.restartsUnlimited() {
+		return true
+	}
+	return gc.runMsg.RestartPolicy.Mode != "never" && gc.AutoRestartBalance > 0
+}
+
+// restartsUnlimited tells if the GRE is always restarted with no max restart count.
+func (gc *greCtl) restartsUnlimited() bool {
+	return gc.runMsg.RestartPolicy.Mode == "always" && gc.runMsg.AutoRestartMax == 0
+}
+
+// needRestart decides if the exited GRE should be auto restarted.
+func (gc *greCtl) needRestart() bool {
+	if gc.aborted || !gc.canRestart() {
+		return false
+	}
+	return gc.runMsg.RestartPolicy.Mode == "always" || gc.greErr != nil
+}
+
+// waitRestart waits d before restart, returns false if the GRE is stopped in between.
+func (gc *greCtl) waitRestart(d time.Duration) bool {
+	if d == 0 {
+		return true
+	}
+	select { // discard stale request
+	case <-gc.cancelWait:
+	default:
+	}
+	gc.NextRun = time.Now().Add(d)
+	gc.changeStat(greStatRestarting)
+	gc.greInfoToFile()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		gc.NextRun = time.Time{}
+		return true
+	case <-gc.cancelWait:
+		gc.NextRun = time.Time{}
+		gc.aborted = true
+		gc.changeStat(greStatExited)
+		gc.greInfoToFile()
+		return false
 	}
 }
 
@@ -254,12 +450,38 @@ func (gc *greCtl) greInfoToFile() error {
 	defer f.Close()
 
 	enc := gob.NewEncoder(f)
-	if err := enc.Encode(gc.greInfo); err != nil {
+	if err := enc.Encode(gc.info()); err != nil {
 		return err
 	}
 	return nil
 }
 
+// info returns a copy of the greInfo which is safe to encode while the GRE runs.
+func (gc *greCtl) info() *greInfo {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gi := *gc.greInfo
+	return &gi
+}
+
+func (gc *greCtl) pid() int {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.Pid
+}
+
+func (gc *greCtl) setHealth(health string) {
+	gc.mu.Lock()
+	gc.Health = health
+	gc.mu.Unlock()
+}
+
+func (gc *greCtl) migrating() bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.migration != nil
+}
+
 func (gc *greCtl) changeStat(newStat int32) {
 	atomic.StoreInt32(&gc.stat, newStat)
 	gc.Stat = greStatString[gc.stat]
@@ -271,36 +493,82 @@ func (gc *greCtl) changeStatIf(oldStat, newStat int32) {
 	}
 }
 
+// stop aborts the running GRE or cancels the schedule, returns false if nothing to stop.
+func (gc *greCtl) stop() bool {
+	switch atomic.LoadInt32(&gc.stat) {
+	case greStatRunning, greStatUnhealthy, greStatAborting:
+		gc.cancel()
+		gc.changeStatIf(greStatRunning, greStatAborting)
+		gc.changeStatIf(greStatUnhealthy, greStatAborting)
+	case greStatScheduled, greStatRestarting:
+		select {
+		case gc.cancelWait <- struct{}{}:
+		default:
+		}
+	default:
+		return false
+	}
+	return true
+}
+
 func (gc *greCtl) reset() error {
 	gc.changeStat(greStatStarting)
-	output, err := os.OpenFile(gc.outputFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	output, err := openLogFile(gc.outputFile, gc.logRotation)
 	if err != nil {
 		return fmt.Errorf("GRE output file not created: %v", err)
 	}
+	errOutput, err := openLogFile(gc.stderrFile, gc.logRotation)
+	if err != nil {
+		output.Close()
+		return fmt.Errorf("GRE stderr file not created: %v", err)
+	}
 	gc.log = output
-	gc.stdin = nullIO{}
-	gc.stdout = output
-	gc.stderr = &strings.Builder{}
+	gc.errLog = errOutput
+	gc.runEnd = make(chan struct{})
+	gc.signals = newSigRelay()
+	gc.stdin = gc.attacher.reader(gc.runEnd)
+	gc.stdout = io.MultiWriter(newLineStamper(output), gc.attacher)
+	gc.stderr = io.MultiWriter(newLineStamper(errOutput), gc.attacher)
 	return nil
 }
 
+func (gc *greCtl) closeLogs() {
+	gc.log.Close()
+	gc.errLog.Close()
+}
+
 func (gc *greCtl) close() {
 	if gc.gsh != nil {
 		gc.gsh.close()
 	}
-	os.Remove(gc.outputFile)
 	os.RemoveAll(gc.statDir)
 	os.RemoveAll(gc.codeDir)
 }
 
 func (gc *greCtl) newShell() (err error) {
+	dir, err := gc.runMsg.workdir()
+	if err != nil {
+		return err
+	}
 	gc.gsh, err = newShell(interp.Options{
 		Stdin:  gc.stdin,
 		Stdout: gc.stdout,
 		Stderr: gc.stderr,
 		Args:   gc.args,
 	})
-	return
+	if err != nil {
+		return
+	}
+	secrets, err := gc.fetchSecrets()
+	if err != nil {
+		return err
+	}
+	// the GRE has its own environment, working directory and signals,
+	// changes do not affect the GRG process and other GREs
+	exports := interp.Exports(stdlib.NewOSView(append(os.Environ(), gc.runMsg.Env...), dir).Symbols())
+	exports["os/signal/signal"] = gc.signals.symbols()
+	exports[secretPkgPath+"/secret"] = secretSymbols(secrets)
+	return gc.gsh.interpreter.Use(exports)
 }
 
 func (gc *greCtl) runGRE() {
@@ -312,23 +580,45 @@ func (gc *greCtl) runGRE() {
 	gc.greErr = nil
 	gc.GREErr = ""
 	gc.EndTime = time.Time{}
+	gc.setHealth("")
 
 	gc.changeStat(greStatRunning)
 	gc.greInfoToFile()
+	gc.report(eventGREStarted, "")
+
+	var healthErr chan error
+	if len(gc.runMsg.HealthCheck) != 0 && gc.health == nil {
+		if hc, err := parseHealthCheck(gc.runMsg.HealthCheck); err != nil {
+			gc.setHealth(err.Error())
+		} else {
+			gc.health = hc // kept for all the runs of the GRE
+		}
+	}
+	if hc := gc.health; hc != nil {
+		healthErr = make(chan error, 1)
+		go func() { healthErr <- gc.healthLoop(ctx, hc) }()
+	}
 
-	if err := gc.newShell(); err != nil {
-		fmt.Fprintln(gc.stderr, err)
-	} else {
-		if err := gc.gsh.evalPathWithContext(ctx, gc.codeDir); err != nil {
-			fmt.Fprintln(gc.stderr, err)
-			if p, ok := err.(interp.Panic); ok {
-				fmt.Fprintln(gc.stderr, string(p.Stack))
-			}
+	var err error
+	if gc.runMsg.Isolate {
+		err = gc.runIsolated(ctx)
+	} else if err = gc.newShell(); err == nil {
+		err = gc.gsh.evalPathWithContext(ctx, gc.codeDir)
+	}
+	var stderrStr string
+	if err != nil {
+		stderrStr = fmt.Sprintln(err)
+		if p, ok := err.(interp.Panic); ok {
+			stderrStr += fmt.Sprintln(string(p.Stack))
 		}
 	}
 
 	gc.EndTime = time.Now()
-	stderrStr := gc.stderr.String()
+	cancel()
+	var unhealthy error
+	if healthErr != nil {
+		unhealthy = <-healthErr
+	}
 	if len(stderrStr) != 0 {
 		errstr := stderrStr
 		index := strings.Index(errstr, "goroutine")
@@ -348,31 +638,255 @@ func (gc *greCtl) runGRE() {
 		if stderrStr != "" {
 			gc.greErr = errors.New(stderrStr)
 			gc.GREErr = stderrStr
-			//fmt.Fprint(gc.stdout, stderrStr)
+			if _, ok := err.(reportedError); !ok {
+				fmt.Fprint(gc.stderr, stderrStr)
+			}
 		}
 	}
-	gc.log.Close()
-	if gc.greErr == nil {
-		gc.AutoRestartBalance = 0
-	}
-	if gc.AutoRestartBalance > 0 {
-		gc.AutoRestartBalance--
+	if unhealthy != nil { // stopped by health check
+		gc.greErr = unhealthy
+		gc.GREErr = unhealthy.Error()
 	}
+	gc.closeLogs()
+	close(gc.runEnd)
+	gc.aborted = atomic.LoadInt32(&gc.stat) == greStatAborting
 	gc.changeStat(greStatExited)
 	gc.greInfoToFile()
+	gc.report(eventGREExited, gc.GREErr)
+	gc.attacher.end(fmt.Errorf("GRE %s exited", gc.ID))
+}
+
+// isolation is the state of the isolated GRE shared with the helper process.
+type isolation struct {
+	token   string // to authenticate the helper
+	secrets map[string]string
+	stdio   bool          // stdio of the helper is being proxied
+	outDone chan struct{} // closed when stdout of the helper ends
+}
+
+// runIsolated runs the GRE in a dedicated helper process, the helper connects
+// back to the GRG with grgCmdIsolate to get its secrets and proxy its stdio.
+func (gc *greCtl) runIsolated(ctx context.Context) error {
+	secrets, err := gc.fetchSecrets()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"__isolate", "-group", gc.grgName, "-gre", gc.ID, "-code", gc.codeDir, "--"}, gc.args...)
+	if selfExe == "gshell.tester" {
+		cov, _ := filepath.Abs(".test/l2_isolate" + genID(3) + ".cov") // the helper may run in other dir
+		args = append([]string{"-test.run", "^TestRunMain$", "-test.coverprofile=" + cov, "--"}, args...)
+	}
+	dir, err := gc.runMsg.workdir()
+	if err != nil {
+		return err
+	}
+	iso := &isolation{token: genID(16), secrets: secrets, outDone: make(chan struct{})}
+	cmd := exec.CommandContext(ctx, selfExe, args...)
+	cmd.Dir = dir
+	// the token is not to be seen in the args, the helper removes it from its environment
+	cmd.Env = append(append(os.Environ(), gc.runMsg.Env...), isolateTokenEnv+"="+iso.token)
+	tail := &tailBuffer{max: stderrTailMax}
+	cmd.Stderr = io.MultiWriter(gc.stderr, tail)
+
+	gc.mu.Lock()
+	gc.isolation = iso
+	gc.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		gc.mu.Lock()
+		gc.isolation = nil
+		gc.mu.Unlock()
+		return err
+	}
+	gc.mu.Lock()
+	gc.Pid = cmd.Process.Pid
+	gc.mu.Unlock()
+	gc.greInfoToFile()
+
+	err = cmd.Wait()
+	gc.mu.Lock()
+	gc.Pid = 0
+	gc.isolation = nil
+	stdio := iso.stdio
+	gc.mu.Unlock()
+	if stdio {
+		<-iso.outDone // all the output is logged before the GRE exits
+	}
+	if _, ok := err.(*exec.ExitError); ok && len(tail.buf) != 0 {
+		return reportedError(tail.buf) // the helper has reported the error
+	}
+	return err
+}
+
+const isolateTokenEnv = "GSHELL_ISOLATE_TOKEN"
+
+// reply with the secrets of the GRE then stream of stdio of the isolated GRE,
+// only the helper process started by the GRG is accepted
+type grgCmdIsolate struct {
+	GREID string
+	Token string
+}
+
+func (msg *grgCmdIsolate) Handle(stream as.ContextStream) (reply interface{}) {
+	grg := stream.GetContext().(*grg)
+	grg.RLock()
+	gc := grg.gres[msg.GREID]
+	grg.RUnlock()
+	if gc == nil {
+		return fmt.Errorf("GRE %s not found", msg.GREID)
+	}
+	gc.mu.Lock()
+	iso := gc.isolation
+	if iso == nil || iso.stdio || iso.token != msg.Token {
+		gc.mu.Unlock()
+		return fmt.Errorf("GRE %s is not waiting for isolated helper", msg.GREID)
+	}
+	iso.stdio = true
+	gc.mu.Unlock()
+	defer close(iso.outDone)
+
+	if err := stream.Send(iso.secrets); err != nil {
+		return err
+	}
+	helperIO := as.NewStreamIO(stream)
+	go io.Copy(helperIO, gc.stdin)
+	io.Copy(gc.stdout, helperIO)
+	grg.lg.Debugf("gre %s isolated stdio ended", gc.ID)
+	return io.EOF
+}
+
+// reportedError is the error that has been written to stderr of the GRE.
+type reportedError string
+
+func (e reportedError) Error() string { return strings.TrimSuffix(string(e), "\n") }
+
+const stderrTailMax = 64 * 1024
+
+// tailBuffer keeps the last max bytes written.
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.buf = append(tb.buf, p...)
+	if len(tb.buf) > tb.max {
+		tb.buf = tb.buf[len(tb.buf)-tb.max:]
+	}
+	return len(p), nil
 }
 
 type grgGREInfo struct {
 	Name     string
 	GREInfos []*greInfo
+	Resource *resourceStat // filled by daemon if the GRG is in a dedicated cgroup
+	Process  *processInfo
+	Conns    connStat
 }
 
 // JobCmd is the job in grgCmdRun
 type JobCmd struct {
-	Args           []string `yaml:"args,omitempty"`
-	AutoRemove     bool     `yaml:"auto-remove,omitempty"`
-	AutoRestartMax uint     `yaml:"auto-restart-max,omitempty"` // user defined max auto restart count
-	CodeZip        []byte   `yaml:"code-zip,omitempty"`
+	Name           string        `yaml:"name,omitempty"` // default to the file name in args
+	Args           []string      `yaml:"args,omitempty"`
+	Env            []string      `yaml:"env,omitempty"`     // KEY=VAL added to the environment of the GRE
+	Workdir        string        `yaml:"workdir,omitempty"` // working directory of the GRE, default to that of the GRG
+	Secrets        []string      `yaml:"secrets,omitempty"` // names of the secrets granted to the GRE
+	AutoRemove     bool          `yaml:"auto-remove,omitempty"`
+	AutoRestartMax uint          `yaml:"auto-restart-max,omitempty"` // user defined max auto restart count
+	RestartPolicy  RestartPolicy `yaml:"restart-policy,omitempty"`
+	CodeZip        []byte        `yaml:"code-zip,omitempty"`
+	CodeSig        string        `yaml:"code-sig,omitempty"`         // base64 ed25519 signature of CodeZip
+	Isolate        bool          `yaml:"isolate,omitempty"`          // run in a dedicated helper process
+	Schedule       string        `yaml:"schedule,omitempty"`         // cron expression, run on schedule instead of once
+	HealthCheck    string        `yaml:"health-check,omitempty"`     // service:publisher/service, tcp:host:port or go:snippet
+	HealthInterval uint          `yaml:"health-interval,omitempty"`  // in seconds
+	HealthRestart  bool          `yaml:"health-restart,omitempty"`   // restart unhealthy GRE if auto restart balance remains
+	DependsOn      []string      `yaml:"depends-on,omitempty"`       // names of the jobs to be started before this job
+	WaitForService string        `yaml:"wait-for-service,omitempty"` // publisher/service to be published before this job starts
+	ResourceLimits `yaml:",inline"`
+	LogRotation    `yaml:",inline"`
+}
+
+// RestartPolicy is how the GRE is auto restarted, the number of restarts is
+// limited by AutoRestartMax, or unlimited for mode always if AutoRestartMax is 0.
+type RestartPolicy struct {
+	Mode        string `yaml:"mode,omitempty"`         // on-failure(default), always or never
+	Backoff     uint   `yaml:"backoff,omitempty"`      // initial delay in seconds before restart, doubled each time
+	MaxDelay    uint   `yaml:"max-delay,omitempty"`    // max backoff delay in seconds
+	ResetWindow uint   `yaml:"reset-window,omitempty"` // in seconds, the restart balance refills if the GRE has run longer
+}
+
+const restartMaxDelayDefault = 300 // in seconds
+
+// unlimitedRestartDelayMin is the min delay before the restarts of mode always
+// with no max restart count.
+const unlimitedRestartDelayMin = time.Second
+
+func (rp RestartPolicy) validate() error {
+	switch rp.Mode {
+	case "", "on-failure", "always", "never":
+	default:
+		return fmt.Errorf("wrong restart mode %s, on-failure, always or never expected", rp.Mode)
+	}
+	return nil
+}
+
+// delay returns the backoff delay before the restart after n consecutive restarts.
+func (rp RestartPolicy) delay(n uint) time.Duration {
+	if rp.Backoff == 0 {
+		return 0
+	}
+	max := rp.MaxDelay
+	if max == 0 {
+		max = restartMaxDelayDefault
+	}
+	d := rp.Backoff
+	for i := uint(0); i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return time.Duration(d) * time.Second
+}
+
+// validateEnv checks the environment variables are in the form KEY=VAL.
+func validateEnv(env []string) error {
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i <= 0 {
+			return fmt.Errorf("wrong env %q, KEY=VAL expected", kv)
+		}
+	}
+	return nil
+}
+
+// workdir returns the absolute working directory of the job.
+func (jc *JobCmd) workdir() (string, error) {
+	dir, err := filepath.Abs(jc.Workdir)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("workdir: %v", err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("workdir %s is not a directory", jc.Workdir)
+	}
+	return dir, nil
+}
+
+func (jc *JobCmd) name() string {
+	if len(jc.Name) != 0 {
+		return jc.Name
+	}
+	return codeName(jc.Args[0])
+}
+
+// codeName returns the file name without extension of path[/file.go][@ref].
+func codeName(pathFile string) string {
+	path, _ := splitRef(pathFile)
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
 }
 
 // JobInfo is the job in joblist
@@ -387,6 +901,7 @@ type grgCmdRun struct {
 	Interactive bool
 	AutoImport  bool
 	RequestedBy string // by which provider ID
+	CodeRev     string // commit of the code read from git repo
 }
 
 func (msg *grgCmdRun) Handle(stream as.ContextStream) (reply interface{}) {
@@ -402,11 +917,28 @@ func (msg *grgCmdRun) Handle(stream as.ContextStream) (reply interface{}) {
 		}
 		defer conn.Close()
 
-		var zip []byte
-		if err := conn.SendRecv(getCode{filePath, msg.AutoImport}, &zip); err != nil {
+		var rev string
+		if err := conn.SendRecv(getCodeRev{filePath}, &rev); err != nil {
+			grg.lg.Debugf("code rev of %s not available: %v", filePath, err)
+		}
+		if len(rev) != 0 { // pin the ref to the commit
+			path, _ := splitRef(filePath)
+			filePath = path + "@" + rev
+			msg.CodeRev = rev
+		}
+
+		zip, err := grg.getCode(conn, getCode{filePath, msg.AutoImport})
+		if err != nil {
 			return err
 		}
 		msg.CodeZip = zip
+		if len(msg.CodeSig) == 0 {
+			var sig string
+			if err := conn.SendRecv(getCodeSig{filePath}, &sig); err != nil {
+				grg.lg.Debugf("code signature of %s not available: %v", filePath, err)
+			}
+			msg.CodeSig = sig
+		}
 	}
 
 	gc, err := grg.newGRE(nil, msg)
@@ -414,14 +946,20 @@ func (msg *grgCmdRun) Handle(stream as.ContextStream) (reply interface{}) {
 		grg.lg.Errorln(err)
 		return err
 	}
+	if err := gc.reset(); err != nil {
+		gc.close()
+		grg.lg.Errorln(err)
+		return err
+	}
 	grg.addGRE(gc)
+	gc.report(eventGRECreated, "")
 
 	if msg.Interactive {
 		grg.lg.Debugln("grgCmdRun: interactive")
 		clientIO := as.NewStreamIO(stream)
 		defer clientIO.Close()
 		gc.stdin = clientIO
-		gc.stdout = multiWriter(clientIO, gc.log)
+		gc.stdout = multiWriter(clientIO, gc.stdout)
 		gc.runGRE()
 		if msg.AutoRemove {
 			grg.rmGRE(gc)
@@ -433,13 +971,40 @@ func (msg *grgCmdRun) Handle(stream as.ContextStream) (reply interface{}) {
 	return gc.ID
 }
 
+// getCode gets the code bundle from the local cache if the codeRepo has the
+// same bundle, or else from the codeRepo and adds it to the local cache.
+func (grg *grg) getCode(conn as.Connection, msg getCode) ([]byte, error) {
+	var sum string
+	if err := conn.SendRecv(getCodeSum(msg), &sum); err != nil {
+		grg.lg.Debugf("code sum of %s not available: %v", msg.PathFile, err)
+	}
+	if zip := grg.cache.get(sum); zip != nil {
+		grg.lg.Debugf("code %s hit the cache: %s", msg.PathFile, sum)
+		return zip, nil
+	}
+
+	var zip []byte
+	if len(sum) != 0 {
+		if err := conn.SendRecv(getCachedCode{sum}, &zip); err != nil {
+			zip = nil
+		}
+	}
+	if zip == nil {
+		if err := conn.SendRecv(msg, &zip); err != nil {
+			return nil, err
+		}
+	}
+	grg.cache.put(zip)
+	return zip, nil
+}
+
 type grgCmdQuery struct {
 	IDPatten []string
 }
 
 func (msg *grgCmdQuery) Handle(stream as.ContextStream) (reply interface{}) {
 	grg := stream.GetContext().(*grg)
-	ggi := &grgGREInfo{Name: grg.name}
+	ggi := &grgGREInfo{Name: grg.name, Process: &grg.processInfo, Conns: grg.conns.load()}
 	pattenStr := ""
 	if len(msg.IDPatten) == 0 { // list all
 		ggi.GREInfos = make([]*greInfo, 0, len(grg.greids))
@@ -454,7 +1019,7 @@ func (msg *grgCmdQuery) Handle(stream as.ContextStream) (reply interface{}) {
 		if len(pattenStr) == 0 || // match all
 			strings.Contains(pattenStr, "^"+greid+"$") || // match greid
 			strings.Contains(pattenStr, "^"+gc.Name+"$") { // match name
-			ggi.GREInfos = append(ggi.GREInfos, gc.greInfo)
+			ggi.GREInfos = append(ggi.GREInfos, gc.info())
 		}
 	}
 	grg.RUnlock()
@@ -462,10 +1027,24 @@ func (msg *grgCmdQuery) Handle(stream as.ContextStream) (reply interface{}) {
 }
 
 type grgJoblist struct {
-	Name       string
-	RtPriority int `yaml:"rt-priority,omitempty"`
-	Maxprocs   int `yaml:"max-procs,omitempty"`
-	Jobs       []*JobInfo
+	Name           string
+	RtPriority     int `yaml:"rt-priority,omitempty"`
+	Maxprocs       int `yaml:"max-procs,omitempty"`
+	ResourceLimits `yaml:",inline"`
+	Jobs           []*JobInfo
+}
+
+// limits returns the resource limits of the GRG, the limits set in the jobs
+// are taken if they do not conflict with each other and with the GRG.
+func (grgjl *grgJoblist) limits() (ResourceLimits, error) {
+	limits := grgjl.ResourceLimits
+	for _, job := range grgjl.Jobs {
+		if limits.conflicts(job.ResourceLimits) {
+			return limits, fmt.Errorf("resource limits of job %s conflict with others in grg %s", job.name(), grgjl.Name)
+		}
+		limits.merge(job.ResourceLimits)
+	}
+	return limits, nil
 }
 
 // reply grgJoblist{}
@@ -511,6 +1090,7 @@ func (msg grgCmdJoblist) Handle(stream as.ContextStream) (reply interface{}) {
 type grgCmdPatternAction struct {
 	IDPattern []string
 	Cmd       string
+	Grace     time.Duration // before aborting the GRE on stop
 }
 
 func (msg *grgCmdPatternAction) Handle(stream as.ContextStream) (reply interface{}) {
@@ -530,24 +1110,21 @@ func (msg *grgCmdPatternAction) Handle(stream as.ContextStream) (reply interface
 	for _, gc := range gcs {
 		switch msg.Cmd {
 		case "stop":
-			if gc.stat == greStatRunning { // no need to atomic
-				gc.cancel()
-				gc.changeStatIf(greStatRunning, greStatAborting)
+			if gc.terminate(msg.Grace) {
 				ids = append(ids, gc.ID)
 			}
 		case "rm":
-			if gc.stat == greStatExited {
+			if gc.stat == greStatExited && !gc.migrating() {
 				grg.rmGRE(gc)
 				ids = append(ids, gc.ID)
 			}
 		case "start":
-			if gc.stat == greStatExited {
+			if gc.stat == greStatExited && !gc.migrating() {
 				if err := gc.reset(); err != nil {
 					grg.lg.Errorln(err)
 					break
 				}
-				gc := gc
-				go gc.runGRE()
+				go grg.runGRE(gc)
 				ids = append(ids, gc.ID)
 			}
 		}
@@ -556,6 +1133,152 @@ func (msg *grgCmdPatternAction) Handle(stream as.ContextStream) (reply interface
 	return ids
 }
 
+type greMigration struct {
+	Info    *greInfo
+	RunMsg  *grgCmdRun
+	Running bool
+}
+
+// reply with *greMigration
+// The GRE is stopped but kept in the GRG until grgCmdMigrateEnd.
+type grgCmdMigrateOut struct {
+	GREID string
+}
+
+func (msg *grgCmdMigrateOut) Handle(stream as.ContextStream) (reply interface{}) {
+	grg := stream.GetContext().(*grg)
+	grg.RLock()
+	gc := grg.gres[msg.GREID]
+	grg.RUnlock()
+	if gc == nil {
+		return fmt.Errorf("GRE %s not found", msg.GREID)
+	}
+	if gc.runMsg.Interactive {
+		return errors.New("interactive GRE can not be regrouped")
+	}
+
+	// read before stopping: runMsg in memory has no code
+	file, err := os.Open(filepath.Join(gc.statDir, "runMsg"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	runMsg := &grgCmdRun{}
+	if err := gob.NewDecoder(file).Decode(runMsg); err != nil {
+		return err
+	}
+
+	gc.mu.Lock()
+	migrating := gc.migration != nil
+	if !migrating {
+		gc.migration = &greMigration{RunMsg: runMsg}
+	}
+	gc.mu.Unlock()
+	if migrating {
+		return fmt.Errorf("GRE %s is being regrouped", gc.ID)
+	}
+
+	running := atomic.LoadInt32(&gc.stat) != greStatExited
+	gc.runMsg.AutoRemove = false // keep the GRE after it stops
+	for i := 0; atomic.LoadInt32(&gc.stat) != greStatExited; i++ {
+		if i == 30 {
+			gc.runMsg.AutoRemove = runMsg.AutoRemove
+			gc.mu.Lock()
+			gc.migration = nil
+			gc.mu.Unlock()
+			return fmt.Errorf("GRE %s not stopped", gc.ID)
+		}
+		gc.stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	gi := gc.info()
+	gc.mu.Lock()
+	mig := gc.migration
+	mig.Info = gi
+	mig.Running = running
+	gc.mu.Unlock()
+	grg.lg.Infof("gre %s migrating out", gc.ID)
+	return mig
+}
+
+// reply OK or error
+// The GRE migrated out is detached from the GRG if Done, or else restored
+// to what it was.
+type grgCmdMigrateEnd struct {
+	GREID string
+	Done  bool
+}
+
+func (msg *grgCmdMigrateEnd) Handle(stream as.ContextStream) (reply interface{}) {
+	grg := stream.GetContext().(*grg)
+	grg.RLock()
+	gc := grg.gres[msg.GREID]
+	grg.RUnlock()
+	if gc == nil {
+		return fmt.Errorf("GRE %s not found", msg.GREID)
+	}
+	gc.mu.Lock()
+	mig := gc.migration
+	gc.migration = nil
+	gc.mu.Unlock()
+	if mig == nil {
+		return fmt.Errorf("GRE %s not being regrouped", msg.GREID)
+	}
+	if msg.Done {
+		grg.detachGRE(gc)
+		grg.lg.Infof("gre %s migrated out", gc.ID)
+		return as.OK
+	}
+
+	gc.runMsg.AutoRemove = mig.RunMsg.AutoRemove
+	if mig.Running {
+		if err := gc.reset(); err != nil {
+			return err
+		}
+		go grg.runGRE(gc)
+	}
+	grg.lg.Infof("gre %s migration canceled", gc.ID)
+	return as.OK
+}
+
+// reply OK or error
+type grgCmdMigrateIn struct {
+	*greMigration
+}
+
+func (msg *grgCmdMigrateIn) Handle(stream as.ContextStream) (reply interface{}) {
+	grg := stream.GetContext().(*grg)
+	grg.RLock()
+	_, has := grg.gres[msg.Info.ID]
+	grg.RUnlock()
+	if has {
+		return fmt.Errorf("GRE %s already in %s", msg.Info.ID, grg.name)
+	}
+
+	gc, err := grg.newGRE(msg.Info, msg.RunMsg)
+	if err != nil {
+		grg.lg.Errorln(err)
+		return err
+	}
+	if msg.Running {
+		if err := gc.reset(); err != nil {
+			gc.close()
+			grg.lg.Errorln(err)
+			return err
+		}
+	}
+	grg.addGRE(gc)
+	if msg.Running {
+		go grg.runGRE(gc)
+	} else {
+		gc.changeStat(greStatExited)
+		gc.greInfoToFile()
+	}
+	grg.lg.Infof("gre %s migrated in", gc.ID)
+	return as.OK
+}
+
 // reply with &processInfo
 type grgCmdKill struct{}
 
@@ -592,7 +1315,15 @@ var grgKnownMsgs = []as.KnownMessage{
 	(*grgCmdRun)(nil),
 	(*grgCmdQuery)(nil),
 	grgCmdJoblist{},
+	grgCmdJobStates{},
 	(*grgCmdPatternAction)(nil),
+	(*grgCmdMigrateOut)(nil),
+	(*grgCmdMigrateIn)(nil),
+	(*grgCmdMigrateEnd)(nil),
+	(*grgCmdAttach)(nil),
+	(*grgCmdIsolate)(nil),
+	(*grgCmdEval)(nil),
+	(*grgCmdSignal)(nil),
 	grgCmdKill{},
 }
 
@@ -603,6 +1334,11 @@ func init() {
 	as.RegisterType(grgCmdJoblist{})
 	as.RegisterType((*grgJoblist)(nil))
 	as.RegisterType((*grgCmdPatternAction)(nil))
+	as.RegisterType((*grgCmdMigrateOut)(nil))
+	as.RegisterType((*greMigration)(nil))
+	as.RegisterType((*grgCmdMigrateIn)(nil))
+	as.RegisterType((*grgCmdMigrateEnd)(nil))
 	as.RegisterType(grgCmdKill{})
+	as.RegisterType((*grgCmdIsolate)(nil))
 	as.RegisterType((*processInfo)(nil))
 }
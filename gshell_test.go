@@ -3,12 +3,15 @@ package gshellos_test
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"sort"
@@ -380,6 +383,208 @@ func TestCmdRunRT(t *testing.T) {
 	}
 }
 
+func TestCmdRunLimits(t *testing.T) {
+	out, err := gshellRunCmd("run -group limits -mem 64M -cpu 50 -pids 100 sleep.go 300")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "STATUS       : running") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("run -mem 64X hello.go")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "wrong memory limit") {
+		t.Fatal("expected wrong memory limit error")
+	}
+
+	file := ".test/limits.joblist.yaml"
+	if err := os.WriteFile(file, []byte(`grgs:
+- name: limits2
+  memory-max: 64M
+  jobs:
+  - cmd: sleep.go 300
+    memory-max: 32M
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("diff -f " + file)
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "resource limits of job sleep conflict") {
+		t.Fatal("expected conflicting limits error")
+	}
+}
+
+func TestCmdRunIsolate(t *testing.T) {
+	out, err := gshellRunCmd("run -group testisolate -isolate crash.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashID := strings.TrimSpace(out)
+
+	out, err = gshellRunCmd("run -group testisolate -isolate hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	time.Sleep(2 * time.Second)
+
+	out, _ = gshellRunCmdTimeout("log "+id, 1)
+	if !strings.Contains(out, "Hello, playground\n") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("ps " + crashID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "STATUS       : exited") || !strings.Contains(out, "crash") {
+		t.Fatal("unexpected output")
+	}
+}
+
+func TestCmdRunHealth(t *testing.T) {
+	out, err := gshellRunCmd("run -group health -health go:1==1 -health-interval 1 sleep.go 300")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthyID := strings.TrimSpace(out)
+
+	out, err = gshellRunCmd("run -group health -health tcp:127.0.0.1:1 -health-interval 1 -restart 2 -health-restart sleep.go 300")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	time.Sleep(5 * time.Second)
+
+	out, err = gshellRunCmd("ps " + healthyID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "STATUS       : running") || !strings.Contains(out, "HEALTH       : ok") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "RESTARTED    : 1") || !strings.Contains(out, "connection refused") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("run -health udp:127.0.0.1:1 hello.go")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "unknown kind udp") {
+		t.Fatal("expected invalid health check error")
+	}
+}
+
+func TestCmdRunRestartPolicy(t *testing.T) {
+	out, err := gshellRunCmd("run -group testrestart -restart 2 -restart-mode always hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+
+	out, err = gshellRunCmd("run -group testrestart -restart 2 -restart-mode always -restart-backoff 10 hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backoffID := strings.TrimSpace(out)
+	time.Sleep(time.Second)
+
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "STATUS       : exited") || !strings.Contains(out, "RESTARTED    : 2") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("ps " + backoffID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "STATUS       : restarting") || !strings.Contains(out, "RESTART AT") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("stop " + backoffID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	out, err = gshellRunCmd("ps " + backoffID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "STATUS       : exited") || !strings.Contains(out, "RESTARTED    : 0") {
+		t.Fatal("unexpected output")
+	}
+
+	// started again under the same restart policy
+	out, err = gshellRunCmd("start " + backoffID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("ps " + backoffID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "STATUS       : restarting") {
+		t.Fatal("unexpected output")
+	}
+	gshellRunCmd("stop " + backoffID)
+
+	// always without max restarts without limit
+	out, err = gshellRunCmd("run -group testrestart -restart-mode always hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alwaysID := strings.TrimSpace(out)
+	time.Sleep(2500 * time.Millisecond)
+	out, err = gshellRunCmd("ps " + alwaysID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "STATUS       : restarting") || !strings.Contains(out, "RESTARTED    : 2") {
+		t.Fatal("unexpected output")
+	}
+	gshellRunCmd("stop " + alwaysID)
+
+	out, err = gshellRunCmd("run -restart-mode sometimes hello.go")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "wrong restart mode") {
+		t.Fatal("expected wrong restart mode error")
+	}
+}
+
 func TestCmdRunDir(t *testing.T) {
 	// single file without vendor dir will not compile
 	out, err := gshellRunCmd("run -i figure/figure.go")
@@ -540,6 +745,29 @@ func TestCmdJoblist(t *testing.T) {
 	}
 }
 
+func TestCmdJoblistDeps(t *testing.T) {
+	out, err := gshellRunCmd("joblist -file testdata/cycle.joblist.yaml load")
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "dependency cycle among jobs: ping, pong") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("joblist -file testdata/deps.joblist.yaml load")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = gshellRunCmd("ps")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "worker") || !strings.Contains(out, "server") {
+		t.Fatal("unexpected output")
+	}
+}
+
 func TestCmdPsID(t *testing.T) {
 	out, err := gshellRunCmd("run hello.go")
 	t.Logf("\n%s", out)
@@ -554,6 +782,11 @@ func TestCmdPsID(t *testing.T) {
 	if !strings.Contains(out, "NAME         : hello") {
 		t.Fatal("unexpected output")
 	}
+	// the requester is the caller verified by the daemon
+	selfID, _ := gshellRunCmd("id")
+	if !strings.Contains(out, "REQUESTED BY : "+strings.TrimSpace(selfID)) {
+		t.Fatal("unexpected output")
+	}
 }
 
 func TestCmdStopRm(t *testing.T) {
@@ -582,155 +815,1404 @@ func TestCmdStopRm(t *testing.T) {
 	}
 }
 
-func TestCmdStart(t *testing.T) {
-	out, err := gshellRunCmd("run hello.go")
+func TestCmdRunSchedule(t *testing.T) {
+	out, err := gshellRunCmd("run -schedule @hourly hello.go")
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
 	id := strings.TrimSpace(out)
-	out, err = gshellRunCmd("start " + id)
+	time.Sleep(time.Second)
+
+	out, err = gshellRunCmd("ps " + id)
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(out, "started") {
+	if !strings.Contains(out, "STATUS       : scheduled") || !strings.Contains(out, "SCHEDULE     : @hourly") {
 		t.Fatal("unexpected output")
 	}
-}
 
-func TestCmdInfo(t *testing.T) {
-	out, err := gshellRunCmd("info")
+	out, err = gshellRunCmd("stop " + id)
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(out, "stdbase") {
+	if !strings.Contains(out, "stopped") {
 		t.Fatal("unexpected output")
 	}
+
+	out, err = gshellRunCmd("run -schedule @never hello.go")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "invalid cron expression") {
+		t.Fatal("expected invalid cron expression error")
+	}
 }
 
-func TestCmdLog(t *testing.T) {
-	out, err := gshellRunCmd("run hello.go")
+func TestCmdRegroup(t *testing.T) {
+	out, err := gshellRunCmd("run -group regroupsrc sleep.go 300")
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
 	id := strings.TrimSpace(out)
-	out, err = gshellRunCmdTimeout("log "+id, 1)
+	time.Sleep(time.Second)
+
+	out, err = gshellRunCmd("regroup -group regroupdst " + id)
 	t.Logf("\n%s", out)
-	if !strings.Contains(out, "Hello, playground\n") {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "regrouped to regroupdst") {
 		t.Fatal("unexpected output")
 	}
-	// to increase coverage rate
-	go gshellRunCmd("log -f grg")
-}
 
-func TestCmdRepo(t *testing.T) {
-	out, err := gshellRunCmd("repo")
+	out, err = gshellRunCmd("ps " + id)
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if !strings.Contains(out, "gshellos") {
+	if !strings.Contains(out, "IN GROUP     : regroupdst") || !strings.Contains(out, "STATUS       : running") {
 		t.Fatal("unexpected output")
 	}
 
-	out, err = gshellRunCmd("run nosuchfile.go")
+	out, err = gshellRunCmd("regroup -group regroupdst " + id)
 	t.Logf("\n%s", out)
-	if err == nil {
-		t.Fatal("expected 404 error or *net/url.Error")
+	if !strings.Contains(out, "already in") {
+		t.Fatal("unexpected output")
 	}
-}
 
-func TestCmdRepoRunRaw(t *testing.T) {
-	out, err := gshellRunCmd("run -i https://github.com/godevsig/ghub/tree/master/example/hello")
+	out, err = gshellRunCmd("stop " + id)
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if out != "Hello, world!\n" {
-		t.Fatal("unexpected output")
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("regroup -group regroupsrc " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	out, err = gshellRunCmd("run -i https://github.com/godevsig/ghub/tree/master/example/hello/hello.go")
+	out, err = gshellRunCmd("ps " + id)
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if out != "Hello, world!\n" {
+	if !strings.Contains(out, "IN GROUP     : regroupsrc") || !strings.Contains(out, "STATUS       : exited") {
 		t.Fatal("unexpected output")
 	}
+}
 
-	out, err = gshellRunCmd("run -i https://gitlab.com/godevsig/ghub/-/tree/master/example/hello")
+func TestCmdAttach(t *testing.T) {
+	out, err := gshellRunCmd("run -group attach echo.go")
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if out != "Hello, world!\n" {
+	id := strings.TrimSpace(out)
+	time.Sleep(time.Second)
+
+	cmd := makeCmd("attach " + id)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stdin, "hello\n")
+	time.Sleep(time.Second)
+	io.WriteString(stdin, "~.\n")
+	cmd.Wait()
+	out = output.String()
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "echo: hello") || !strings.Contains(out, "detached") {
 		t.Fatal("unexpected output")
 	}
 
-	out, err = gshellRunCmd("run -i https://gitlab.com/godevsig/ghub/-/tree/master/example/hello/hello.go")
+	out, err = gshellRunCmd("ps " + id)
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if out != "Hello, world!\n" {
+	if !strings.Contains(out, "STATUS       : running") {
 		t.Fatal("unexpected output")
 	}
 
-	out, err = gshellRunCmd("run -i https://gitlab.com/godevsig/ghub/-/tree/master//local/file.go")
+	cmd = makeCmd("attach " + id)
+	cmd.Stdin = strings.NewReader("quit\n")
+	output.Reset()
+	cmd.Stdout = &output
+	cmd.Run()
+	out = output.String()
 	t.Logf("\n%s", out)
-	if err == nil {
-		t.Fatal("run local file directly should return error")
-	}
-	if !strings.Contains(out, "not found") {
+	if !strings.Contains(out, "exited") {
 		t.Fatal("unexpected output")
 	}
 
-	out, err = gshellTestCmd("run -i -import https://github.com/godevsig/gshellos/tree/master/testdata/figure", "testdata/figure/figure.go")
+	out, err = gshellRunCmd("attach " + id)
 	t.Logf("\n%s", out)
-	if err != nil {
-		t.Fatal(err)
+	if !strings.Contains(out, "is exited") {
+		t.Fatal("expected GRE not running error")
 	}
-	out, err = gshellTestCmd("run -i -import https://github.com/godevsig/gshellos/tree/master/testdata/figure/figure.go", "testdata/figure/figure.go")
+}
+
+func TestCmdEval(t *testing.T) {
+	out, err := gshellRunCmd("run -group eval counter.go")
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
+	id := strings.TrimSpace(out)
+	time.Sleep(time.Second)
 
-	out, err = gshellTestCmd("run -i -import https://gitlab.com/godevsig/gshellos/-/tree/master/testdata/figure", "testdata/figure/figure.go")
+	out, err = gshellRunCmd("eval " + id + " counter>0")
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-	out, err = gshellTestCmd("run -i -import https://gitlab.com/godevsig/gshellos/-/tree/master/testdata/figure/figure.go", "testdata/figure/figure.go")
+	if !strings.Contains(out, "true") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("eval " + id + " fmt.Println(status())")
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
+	if !strings.Contains(out, "counter is") {
+		t.Fatal("unexpected output")
+	}
 
-func TestCmdRepoList(t *testing.T) {
-	out, err := gshellRunCmd("repo ls")
+	out, err = gshellRunCmd("eval " + id + " counter=-100")
 	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
-
-func TestCmdREPL(t *testing.T) {
-	inFile, err := os.Open("testdata/repl.go")
+	out, err = gshellRunCmd("eval " + id + " counter<0")
+	t.Logf("\n%s", out)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer inFile.Close()
-
-	oldStdin := os.Stdin
-	defer func() { os.Stdin = oldStdin }()
-	os.Stdin = inFile
+	if !strings.Contains(out, "true") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("eval " + id + " undefined(")
+	t.Logf("\n%s", out)
+	if err == nil {
+		t.Fatal("expected syntax error")
+	}
+
+	out, err = gshellRunCmd("eval " + id + " for{counter=0}")
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "can not be interrupted") {
+		t.Fatal("expected not interruptible error")
+	}
+	out, err = gshellRunCmd("eval -timeout 1 " + id + " time.Sleep(2*time.Second);counter=-200")
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "not finished in 1 seconds") {
+		t.Fatal("expected timeout error")
+	}
+	out, err = gshellRunCmd("eval " + id + " counter")
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "still running the previous eval") {
+		t.Fatal("expected previous eval running error")
+	}
+	time.Sleep(2 * time.Second)
+	out, err = gshellRunCmd("eval " + id + " counter<0")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "true") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("log " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "counting") != 1 {
+		t.Fatal("main function run again")
+	}
+
+	out, err = gshellRunCmd("stop " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = gshellRunCmd("run -group eval -isolate counter.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id = strings.TrimSpace(out)
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("eval " + id + " counter")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "is isolated") {
+		t.Fatal("expected isolated GRE error")
+	}
+	gshellRunCmd("kill -f eval*")
+}
+
+func TestCmdSignal(t *testing.T) {
+	out, err := gshellRunCmd("run -group signal graceful.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	time.Sleep(time.Second)
+
+	out, err = gshellRunCmd("signal USR1 " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("signal BOGUS " + id)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "unknown signal") {
+		t.Fatal("expected unknown signal error")
+	}
+
+	out, err = gshellRunCmd("stop -t 5s " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	out, err = gshellRunCmd("log " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "got user defined signal 1") || !strings.Contains(out, "bye") {
+		t.Fatal("unexpected output")
+	}
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "STATUS       : exited") || !strings.Contains(out, "ERROR        : \n") {
+		t.Fatal("unexpected output")
+	}
+	out, err = gshellRunCmd("signal TERM " + id)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "is exited") {
+		t.Fatal("expected GRE not running error")
+	}
+
+	out, err = gshellRunCmd("run -group signal graceful.go stubborn")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id = strings.TrimSpace(out)
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("stop -t 2s " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "STATUS       : aborting") {
+		t.Fatal("unexpected output")
+	}
+	time.Sleep(2 * time.Second)
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "STATUS       : exited") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("run -group signal sleep.go 300")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id = strings.TrimSpace(out)
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("signal TERM " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "STATUS       : exited") {
+		t.Fatal("unexpected output")
+	}
+	gshellRunCmd("kill -f signal*")
+}
+
+func TestCmdRunEnv(t *testing.T) {
+	for _, isolate := range []string{"", "-isolate "} {
+		dir := t.TempDir()
+		out, err := gshellRunCmd("run -group env " + isolate + "-e GREETING=hello -w " + dir + " env.go")
+		t.Logf("\n%s", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := strings.TrimSpace(out)
+		time.Sleep(time.Second)
+
+		out, err = gshellRunCmd("log " + id)
+		t.Logf("\n%s", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := filepath.Join(dir, "sub")
+		for _, want := range []string{"workdir: " + dir, "GREETING: hello", "chdir: " + sub, "exec: " + sub, "] changed"} {
+			if !strings.Contains(out, want) {
+				t.Fatalf("%q expected", want)
+			}
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "env.out"))
+		if err != nil || string(data) != "changed" {
+			t.Fatalf("unexpected file content %q: %v", data, err)
+		}
+	}
+
+	// not affected by other GREs in the same GRG
+	out, err := gshellRunCmd("run -group env -w /tmp env.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("log " + id)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "GREETING: \n") {
+		t.Fatal("unexpected output")
+	}
+	os.RemoveAll("/tmp/sub")
+	os.Remove("/tmp/env.out")
+
+	out, err = gshellRunCmd("run -group env -w /nonexistent env.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id = strings.TrimSpace(out)
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "ERROR        : workdir:") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("run -group env -e GREETING env.go")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "KEY=VAL expected") {
+		t.Fatal("expected wrong env error")
+	}
+	gshellRunCmd("kill -f env*")
+}
+
+func TestCmdSecret(t *testing.T) {
+	const token = "s3cr3t-t0ken"
+	out, err := gshellRunCmd("secret set api-token " + token)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("secret ls")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "api-token") || strings.Contains(out, token) {
+		t.Fatal("unexpected output")
+	}
+
+	for _, isolate := range []string{"", "-isolate "} {
+		out, err = gshellRunCmd("run -group secret " + isolate + "-secret api-token token.go " + token)
+		t.Logf("\n%s", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := strings.TrimSpace(out)
+		time.Sleep(time.Second)
+
+		out, err = gshellRunCmd("log " + id)
+		t.Logf("\n%s", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"token length: 12", "token matched", "secret other not granted"} {
+			if !strings.Contains(out, want) {
+				t.Fatalf("%q expected", want)
+			}
+		}
+
+		out, err = gshellRunCmd("ps " + id)
+		t.Logf("\n%s", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(out, token) || !strings.Contains(out, "token.go ******") {
+			t.Fatal("secret not redacted")
+		}
+	}
+
+	// only the long enough values of the granted secrets are redacted
+	out, err = gshellRunCmd("secret set short 1")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("run -group secret -secret short token.go 1 " + token)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "token.go 1 "+token) {
+		t.Fatal("unexpected output")
+	}
+	gshellRunCmd("secret rm short")
+
+	out, err = gshellRunCmd("run -group secret -secret nonexistent token.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id = strings.TrimSpace(out)
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "secret nonexistent not found") {
+		t.Fatal("expected secret not found error")
+	}
+
+	out, err = gshellRunCmd("secret rm api-token")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "api-token removed") {
+		t.Fatal("unexpected output")
+	}
+	out, err = gshellRunCmd("secret set bad/name value")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "wrong secret name") {
+		t.Fatal("expected wrong secret name error")
+	}
+	gshellRunCmd("kill -f secret*")
+}
+
+func TestCmdCodeSign(t *testing.T) {
+	keyFile := ".test/sign.key"
+	os.Remove(keyFile)
+	out, err := gshellRunCmd("sign -genkey -key " + keyFile)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := strings.TrimSpace(out)
+
+	out, err = gshellRunCmd("sign -key " + keyFile + " -o .test/hello.sig testdata/hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoSig := "testdata/hello.go.sig"
+	defer os.Remove(repoSig)
+	out, err = gshellRunCmd("sign -key " + keyFile + " testdata/hello.go")
+	t.Logf("\n%s", out)
+	if err != nil || !strings.Contains(out, repoSig+" written") {
+		t.Fatal("signature not written")
+	}
+
+	configFile := ".working/codesign.yaml"
+	defer os.Remove(configFile)
+	config := fmt.Sprintf("policy: enforce\nkeys:\n  - name: test\n    key: %s\n", pub)
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runHello := func(args string) string {
+		out, err := gshellRunCmd("run -group codesign " + args)
+		t.Logf("\n%s", out)
+		if err != nil {
+			return out
+		}
+		time.Sleep(500 * time.Millisecond)
+		out, err = gshellRunCmd("log " + strings.TrimSpace(out))
+		t.Logf("\n%s", out)
+		return out
+	}
+
+	if out := runHello("-sig .test/hello.sig testdata/hello.go"); !strings.Contains(out, "Hello, playground") {
+		t.Fatal("signed code not run")
+	}
+	// from the code repo with the signature in the repo
+	if out := runHello("hello.go"); !strings.Contains(out, "Hello, playground") {
+		t.Fatal("signed code in repo not run")
+	}
+	if out := runHello("testdata/hellolog.go"); !strings.Contains(out, "refused: code not signed") {
+		t.Fatal("unsigned code not refused")
+	}
+
+	tampered := ".test/hello.go"
+	data, _ := os.ReadFile("testdata/hello.go")
+	os.WriteFile(tampered, append(data, []byte("\n// tampered\n")...), 0644)
+	defer os.Remove(tampered)
+	if out := runHello("-sig .test/hello.sig " + tampered); !strings.Contains(out, "refused: code signature not verified") {
+		t.Fatal("tampered code not refused")
+	}
+
+	config = "policy: warn\n"
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out := runHello(tampered); !strings.Contains(out, "Hello, playground") {
+		t.Fatal("code not run with warn policy")
+	}
+	gshellRunCmd("kill -f codesign*")
+}
+
+func TestCmdACL(t *testing.T) {
+	out, err := gshellRunCmd("id -key")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		t.Fatal("provider ID and key expected")
+	}
+	if key, err := base64.StdEncoding.DecodeString(fields[1]); err != nil || len(key) != 32 {
+		t.Fatalf("wrong key: %v", err)
+	}
+
+	out, err = gshellRunCmd("run -group aclsave -e ACL_TOKEN=abc sleep.go 300")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	defer gshellRunCmd("stop " + id)
+
+	aclFile := ".working/acl.yaml"
+	defer os.Remove(aclFile)
+	acl := fmt.Sprintf(`default: none
+providers:
+  - id: self
+    role: read-only
+  - id: %s
+    role: operator
+    key: %s
+`, fields[0], fields[1])
+	if err := os.WriteFile(aclFile, []byte(acl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = gshellRunCmd("ps")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("run hello.go")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "permission denied: run requires operator role") {
+		t.Fatal("expected permission denied")
+	}
+	out, err = gshellRunCmd("kill -f nonexistent")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "permission denied: kill requires admin role") {
+		t.Fatal("expected permission denied")
+	}
+	// no code and environment for read-only callers
+	out, err = gshellRunCmd("joblist -file .test/readonly.joblist.yaml save")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(".test/readonly.joblist.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(saved), "aclsave") || strings.Contains(string(saved), "ACL_TOKEN") || strings.Contains(string(saved), "code-zip") {
+		t.Fatalf("unexpected joblist:\n%s", saved)
+	}
+
+	// operators can not run the jobs granted secrets
+	if err := os.WriteFile(aclFile, []byte(strings.Replace(acl, "role: read-only", "role: operator", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("run -secret api-token hello.go")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "permission denied: run with secrets requires admin role") {
+		t.Fatal("expected permission denied")
+	}
+	if err := os.WriteFile(aclFile, []byte(acl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// authenticated with the node key
+	out, err = gshellRunCmd("-p " + fields[0] + " ps")
+	t.Logf("\n%s", out)
+	if err != nil || strings.Contains(out, "authentication") {
+		t.Fatal("unexpected output")
+	}
+	// failure is reported
+	wrongKey := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if err := os.WriteFile(aclFile, []byte(strings.Replace(acl, fields[1], wrongKey, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("-p " + fields[0] + " ps")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "authentication to "+fields[0]+" failed") || !strings.Contains(out, "key mismatch") {
+		t.Fatal("expected auth failure reported")
+	}
+	data, err := os.ReadFile(".working/logs/audit.log")
+	t.Logf("\n%s", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "denied: run from self") || !strings.Contains(string(data), "denied: kill from self") {
+		t.Fatal("denial not audited")
+	}
+
+	// self is admin if the acl file is wrong
+	if err := os.WriteFile(aclFile, []byte("default: root\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("kill -f nonexistent")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdStart(t *testing.T) {
+	out, err := gshellRunCmd("run hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	out, err = gshellRunCmd("start " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "started") {
+		t.Fatal("unexpected output")
+	}
+}
+
+func TestCmdEvents(t *testing.T) {
+	go func() {
+		time.Sleep(time.Second)
+		gshellRunCmd("run -group testevents -rm hello.go")
+		gshellRunCmd("run -group otherevents -rm hello.go")
+	}()
+	out, err := gshellRunCmdTimeout("events -group testevents", 4)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, evType := range []string{"grg-spawned", "gre-created", "gre-started", "gre-exited", "gre-removed"} {
+		if !strings.Contains(out, evType) {
+			t.Fatalf("%s expected", evType)
+		}
+	}
+	if strings.Contains(out, "otherevents") {
+		t.Fatal("unexpected output")
+	}
+
+	go func() {
+		time.Sleep(time.Second)
+		gshellRunCmd("run -group testevents -rm hello.go")
+	}()
+	out, err = gshellRunCmdTimeout("events -json", 4)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"type":"gre-started","grg":"testevents-`) {
+		t.Fatal("unexpected output")
+	}
+}
+
+func TestCmdMetrics(t *testing.T) {
+	out, err := gshellRunCmd("run -group testmetrics sleep.go 300")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+
+	resp, err := http.Get("http://127.0.0.1:9100/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = string(body)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "# TYPE gshell_daemon_connections_total counter") ||
+		!strings.Contains(out, `gshell_grg_pid{grg="testmetrics-`) ||
+		!strings.Contains(out, `greid="`+id+`",name="sleep",state="running"} 1`) {
+		t.Fatal("unexpected output")
+	}
+}
+
+func TestCmdLogRotation(t *testing.T) {
+	out, err := gshellRunCmd("run -log-max-size 1K -log-max-files 2 -log-compress lines.go 200")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	time.Sleep(time.Second)
+
+	out, err = gshellRunCmd("log " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > 1024 || !strings.Contains(out, "line 0199") {
+		t.Fatal("unexpected output")
+	}
+
+	all, err := gshellRunCmd("log -all " + id)
+	t.Logf("\n%s", all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) < 2048 || len(all) > 4096 || !strings.HasSuffix(all, out) {
+		t.Fatal("unexpected output")
+	}
+}
+
+func TestCmdInfo(t *testing.T) {
+	out, err := gshellRunCmd("info")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "stdbase") {
+		t.Fatal("unexpected output")
+	}
+}
+
+func TestCmdFleet(t *testing.T) {
+	out, err := gshellRunCmd("id")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfID := strings.TrimSpace(out)
+
+	out, err = gshellRunCmd("run -group fleet sleep.go 300")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	greID := strings.TrimSpace(out)
+
+	out, err = gshellRunCmd("-all ps -group fleet*")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "PROVIDER      GRE ID        IN GROUP") ||
+		!strings.Contains(out, selfID+"  "+greID) {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("-p " + selfID[:4] + "*,000000000000 -timeout 5 info")
+	t.Logf("\n%s", out)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if !strings.Contains(out, selfID+"  Version:") ||
+		!strings.Contains(out, "000000000000  error:") ||
+		!strings.Contains(out, "1 of 2 providers failed") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("-p self,self stop -t 0 " + greID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, selfID+"  "+greID) || !strings.Contains(out, selfID+"  stopped") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("-all joblist -file .test/fleet.joblist.yaml save")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(".test/fleet.joblist." + selfID + ".yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gshellRunCmd("-all-providers run hello.go"); err == nil {
+		t.Fatal("run on multiple providers should fail")
+	}
+	if _, err := gshellRunCmd("-all log -f daemon"); err == nil {
+		t.Fatal("log -f on multiple providers should fail")
+	}
+	gshellRunCmd("rm " + greID)
+}
+
+func TestCmdApply(t *testing.T) {
+	file := ".test/apply.joblist.yaml"
+	writeJoblist := func(jl string) {
+		if err := os.WriteFile(file, []byte(jl), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeJoblist(`grgs:
+- name: apply
+  jobs:
+  - cmd: sleep.go 300
+  - cmd: sleep.go 200
+    name: sleep2
+`)
+
+	out, err := gshellRunCmd("diff -f " + file)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "start    apply               sleep                             missing") ||
+		!strings.Contains(out, "start    apply               sleep2                            missing") {
+		t.Fatal("unexpected output")
+	}
+	out, err = gshellRunCmd("ps -group apply*")
+	t.Logf("\n%s", out)
+	if strings.Contains(out, "sleep") {
+		t.Fatal("diff should not start jobs")
+	}
+
+	out, err = gshellRunCmd("apply -f " + file)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gshellRunCmd("kill -f apply*")
+	defer gshellRunCmd("apply -stop")
+	out, err = gshellRunCmd("apply -f " + file)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "no change\n" {
+		t.Fatal("unexpected output")
+	}
+
+	writeJoblist(`grgs:
+- name: apply
+  jobs:
+  - cmd: sleep.go 100
+    name: sleep2
+`)
+	out, err = gshellRunCmd("apply -f " + file)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "changed") || !strings.Contains(out, "not in joblist") {
+		t.Fatal("unexpected output")
+	}
+	out, err = gshellRunCmd("ps -group apply*")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "running") != 1 || !strings.Contains(out, "sleep2") {
+		t.Fatal("unexpected output")
+	}
+
+	// the GRG is recreated if its settings changed
+	writeJoblist(`grgs:
+- name: apply
+  max-procs: 1
+  pids-max: 100
+  jobs:
+  - cmd: sleep.go 100
+    name: sleep2
+`)
+	out, err = gshellRunCmd("diff -f " + file)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "restart  apply               sleep2") ||
+		!strings.Contains(out, "grg changed: max-procs none -> 1, pids-max none -> 100") {
+		t.Fatal("unexpected output")
+	}
+	out, err = gshellRunCmd("apply -f " + file)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("diff -f " + file)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "no change\n" {
+		t.Fatal("unexpected output")
+	}
+
+	// the removed job comes back
+	out, err = gshellRunCmd("stop -t 0 sleep2")
+	t.Logf("\n%s", out)
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("rm sleep2")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Second)
+	out, err = gshellRunCmd("ps -group apply*")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "running") != 1 {
+		t.Fatal("job not reconciled")
+	}
+}
+
+func TestCmdJoblistTemplate(t *testing.T) {
+	writeFile := func(file, content string) {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(".test/base.joblist.yaml", `vars:
+  SECS: "300"
+grgs:
+- name: tmpl
+  jobs:
+  - cmd: sleep.go ${SECS}
+    name: worker
+  - cmd: hello.go
+`)
+	file := ".test/tmpl.joblist.yaml"
+	writeFile(file, `include:
+- base.joblist.yaml
+vars:
+  SECS: "200"
+overrides:
+- arch: `+runtime.GOARCH+`
+  grgs:
+  - name: tmpl
+    jobs:
+    - cmd: sleep.go ${SECS} ${ARCH}
+      name: archjob
+- provider: nomatch*
+  grgs:
+  - name: tmpl
+    jobs:
+    - cmd: sleep.go 100
+      name: never
+`)
+
+	out, err := gshellRunCmd("diff -f " + file)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "worker") || !strings.Contains(out, "hello") ||
+		!strings.Contains(out, "archjob") || strings.Contains(out, "never") {
+		t.Fatal("unexpected output")
+	}
+
+	writeFile(file, `include:
+- base.joblist.yaml
+grgs:
+- name: tmpl
+  jobs:
+  - cmd: sleep.go ${NOPE}
+    name: worker
+`)
+	out, err = gshellRunCmd("diff -f " + file)
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "line 6: undefined variable NOPE") {
+		t.Fatal("undefined variable expected")
+	}
+
+	writeFile(file, `grgs:
+- name: tmpl
+  jobs:
+  - cmdd: sleep.go 300
+    max-procs: many
+`)
+	out, err = gshellRunCmd("diff -f " + file)
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "line 4: unknown key cmdd") || !strings.Contains(out, "line 5: unknown key max-procs") {
+		t.Fatal("unknown key expected")
+	}
+
+	writeFile(file, `grgs:
+- name: tmpl
+  max-procs: many
+`)
+	out, err = gshellRunCmd("diff -f " + file)
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "line 3: cannot unmarshal") {
+		t.Fatal("type error expected")
+	}
+
+	writeFile(file, `include:
+- tmpl.joblist.yaml
+`)
+	out, err = gshellRunCmd("diff -f " + file)
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "include cycle") {
+		t.Fatal("include cycle expected")
+	}
+}
+
+func TestCmdLog(t *testing.T) {
+	out, err := gshellRunCmd("run hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	out, err = gshellRunCmdTimeout("log "+id, 1)
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "Hello, playground\n") {
+		t.Fatal("unexpected output")
+	}
+	for _, target := range []string{"../acl.yaml", "../keys/node.key", "audit.log"} {
+		out, _ = gshellRunCmd("log " + target)
+		t.Logf("\n%s", out)
+		if !strings.Contains(out, "wrong log target") {
+			t.Fatal("unexpected output")
+		}
+	}
+	if _, err := os.Stat(".working/keys/node.key"); err != nil {
+		t.Fatal(err)
+	}
+	// to increase coverage rate
+	go gshellRunCmd("log -f grg")
+}
+
+func TestCmdLogStderr(t *testing.T) {
+	out, err := gshellRunCmd("run stdio.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	time.Sleep(time.Second)
+
+	out, err = gshellRunCmd("log " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i0, i1, i2 := strings.Index(out, "stdout line 0"), strings.Index(out, "stderr line 0"), strings.Index(out, "stdout line 1")
+	if i0 < 0 || i1 < i0 || i2 < i1 || !strings.HasPrefix(out, "[") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("log -stderr " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "stderr line 2") || strings.Contains(out, "stdout") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("log -tail 2 " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "\n") != 2 || !strings.Contains(out, "stdout line 2") || !strings.Contains(out, "stderr line 2") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("log -stdout -since 1h " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "stdout line") != 3 || strings.Contains(out, "stderr") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("log -since 2200-01-01 " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("log -stderr daemon")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "daemon has no stderr stream") {
+		t.Fatal("expected no stderr stream error")
+	}
+}
+
+func TestCmdRepo(t *testing.T) {
+	out, err := gshellRunCmd("repo")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out, "gshellos") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("run nosuchfile.go")
+	t.Logf("\n%s", out)
+	if err == nil {
+		t.Fatal("expected 404 error or *net/url.Error")
+	}
+}
+
+func TestCmdRepoRunRaw(t *testing.T) {
+	out, err := gshellRunCmd("run -i https://github.com/godevsig/ghub/tree/master/example/hello")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Hello, world!\n" {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("run -i https://github.com/godevsig/ghub/tree/master/example/hello/hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Hello, world!\n" {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("run -i https://gitlab.com/godevsig/ghub/-/tree/master/example/hello")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Hello, world!\n" {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("run -i https://gitlab.com/godevsig/ghub/-/tree/master/example/hello/hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Hello, world!\n" {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("run -i https://gitlab.com/godevsig/ghub/-/tree/master//local/file.go")
+	t.Logf("\n%s", out)
+	if err == nil {
+		t.Fatal("run local file directly should return error")
+	}
+	if !strings.Contains(out, "not found") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellTestCmd("run -i -import https://github.com/godevsig/gshellos/tree/master/testdata/figure", "testdata/figure/figure.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellTestCmd("run -i -import https://github.com/godevsig/gshellos/tree/master/testdata/figure/figure.go", "testdata/figure/figure.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = gshellTestCmd("run -i -import https://gitlab.com/godevsig/gshellos/-/tree/master/testdata/figure", "testdata/figure/figure.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellTestCmd("run -i -import https://gitlab.com/godevsig/gshellos/-/tree/master/testdata/figure/figure.go", "testdata/figure/figure.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdRepoList(t *testing.T) {
+	out, err := gshellRunCmd("repo ls")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdRepoCache(t *testing.T) {
+	out, err := gshellRunCmd("repo cache clear")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		out, err = gshellRunCmd("run -rm -i hello.go")
+		t.Logf("\n%s", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, "Hello, playground") {
+			t.Fatal("unexpected output")
+		}
+	}
+
+	out, err = gshellRunCmd("repo cache ls")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "1 bundles, ") {
+		t.Fatal("code bundle not cached")
+	}
+
+	out, err = gshellRunCmd("repo cache clear")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "1 bundles cleared") {
+		t.Fatal("unexpected output")
+	}
+	out, err = gshellRunCmd("repo cache ls")
+	t.Logf("\n%s", out)
+	if !strings.Contains(out, "0 bundles, ") {
+		t.Fatal("cache not cleared")
+	}
+}
+
+func TestCmdRepoGit(t *testing.T) {
+	os.RemoveAll(".test/gitwork")
+	os.MkdirAll(".test/gitwork/hello", 0755)
+	git := func(args ...string) string {
+		args = append([]string{"-C", ".test/gitwork", "-c", "user.name=gshell", "-c", "user.email=gshell@godevsig"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	hello := func(msg string) {
+		code := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"" + msg + "\")\n}\n"
+		os.WriteFile(".test/gitwork/hello/hello.go", []byte(code), 0644)
+		git("add", "-A")
+		git("commit", "-q", "-m", msg)
+	}
+	git("init", "-q")
+	hello("hello v1")
+	git("tag", "v1")
+	rev1 := git("rev-parse", "HEAD")
+	hello("hello v2")
+	os.RemoveAll(".test/gitrepo.git")
+	git("clone", "-q", "--bare", ".", "../gitrepo.git")
+
+	restartDaemon(t, "git:.test/gitrepo.git")
+	defer restartDaemon(t, "testdata")
+
+	out, err := gshellRunCmd("repo")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "git:") || !strings.Contains(out, "gitrepo.git#HEAD") {
+		t.Fatal("unexpected output")
+	}
+
+	out, err = gshellRunCmd("repo ls hello@v1")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "hello.go\n" {
+		t.Fatal("unexpected output")
+	}
+	if _, err := gshellRunCmd("repo ls hello@nosuchref"); err == nil {
+		t.Fatal("unknown ref accepted")
+	}
+
+	out, err = gshellRunCmd("run -i hello/hello.go")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "hello v2\n" {
+		t.Fatal("unexpected output")
+	}
+	out, err = gshellRunCmd("run -i hello/hello.go@v1")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "hello v1\n" {
+		t.Fatal("unexpected output")
+	}
+
+	// the ref is resolved to the commit when the job starts
+	out, err = gshellRunCmd("run -group gitrepo hello@v1")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSpace(out)
+	time.Sleep(time.Second)
+	out, err = gshellRunCmd("ps " + id)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "CODE REV     : "+rev1) {
+		t.Fatal("unexpected output")
+	}
+}
+
+func TestCmdREPL(t *testing.T) {
+	inFile, err := os.Open("testdata/repl.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inFile.Close()
+
+	oldStdin := os.Stdin
+	defer func() { os.Stdin = oldStdin }()
+	os.Stdin = inFile
 
 	os.Args = []string{"main"}
 	out, err := getShellMainOutput()
@@ -743,12 +2225,21 @@ func TestCmdREPL(t *testing.T) {
 }
 
 func TestAutoUpdate(t *testing.T) {
-	os.WriteFile("bin/rev", []byte("11111111111111111111111111111111\n"), 0644)
-	shell.Run("cp -f bin/gshell.tester bin/gshell." + runtime.GOARCH)
-	md5sum, _ := shell.Run("md5sum bin/gshell." + runtime.GOARCH)
-	os.WriteFile("bin/md5sum", []byte(md5sum), 0644)
-	out, _ := shell.Run("cat bin/rev bin/md5sum")
-	t.Logf("\n%s", out)
+	newBin := "bin/gshell." + runtime.GOARCH
+	release := func(rev string) {
+		md5sum, _ := shell.Run("md5sum " + newBin)
+		os.WriteFile("bin/md5sum", []byte(md5sum), 0644)
+		out, err := gshellRunCmd("sign -raw -key testdata/update.key -o " + newBin + ".sig " + newBin)
+		t.Logf("\n%s", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile("bin/rev", []byte(rev+"\n"), 0644)
+		out, _ = shell.Run("cat bin/rev bin/md5sum " + newBin + ".sig")
+		t.Logf("\n%s", out)
+	}
+	shell.Run("cp -f bin/gshell.tester " + newBin)
+	release("11111111111111111111111111111111")
 	oldpid, _ := shell.Run("pidof gshell.tester")
 	t.Logf("\n%s", oldpid)
 
@@ -783,6 +2274,103 @@ func TestAutoUpdate(t *testing.T) {
 	if !strings.Contains(out, "GRE ID        IN GROUP            NAME                START AT             STATUS") {
 		t.Fatal("unexpected output")
 	}
+	if _, err := os.Stat("bin/gshell.tester.prev"); err != nil {
+		t.Fatal("previous version not kept")
+	}
+
+	// no update when the rollout is paused
+	if _, err := gshellRunCmd("update rollout 101"); err == nil {
+		t.Fatal("wrong percent accepted")
+	}
+	out, err = gshellRunCmd("update pause")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(newBin+".tmp", []byte("#!/bin/sh\nexit 1\n"), 0755)
+	os.Rename(newBin+".tmp", newBin)
+	release("22222222222222222222222222222222")
+	time.Sleep(8 * time.Second)
+	if _, err := os.Stat(".working/update.failed"); err == nil {
+		t.Fatal("updated while paused")
+	}
+	out, err = gshellRunCmd("update status")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "LATEST: 22222222222222222222222222222222") ||
+		!strings.Contains(out, "ROLLOUT: 100% [] (paused)") ||
+		!strings.Contains(out, "paused\n") {
+		t.Fatal("unexpected output")
+	}
+
+	// the reports are signed and kept with the node key
+	out, err = gshellRunCmd("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfID := strings.TrimSpace(out)
+	data, _ := os.ReadFile(".working/rollout.providers.yaml")
+	if !strings.Contains(string(data), "provider-id: "+selfID) || !strings.Contains(string(data), "key: ") {
+		t.Fatal("provider not kept")
+	}
+	out, err = gshellRunCmd("update hold " + selfID + " 33333333333333333333333333333333")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gshellRunCmd("update resume")
+	out, err = gshellRunCmd("update status")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "held until 33333333333333333333333333333333\n") {
+		t.Fatal("unexpected output")
+	}
+	time.Sleep(8 * time.Second)
+	if _, err := os.Stat(".working/update.failed"); err == nil {
+		t.Fatal("updated while held")
+	}
+
+	// forget the provider and its key
+	out, err = gshellRunCmd("update forget 0123456789ab")
+	t.Logf("\n%s", out)
+	if err == nil || !strings.Contains(out, "provider 0123456789ab not found") {
+		t.Fatal("unexpected output")
+	}
+	out, err = gshellRunCmd("update forget " + selfID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = gshellRunCmd("update unhold " + selfID)
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new version failing to start is rolled back
+	out, err = gshellRunCmd("update resume")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Second)
+	data, _ = os.ReadFile(".working/update.failed")
+	if !strings.Contains(string(data), "22222222222222222222222222222222") {
+		t.Fatal("failed version not recorded")
+	}
+	out, err = gshellRunCmd("ps")
+	t.Logf("\n%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(".working/logs/daemon.log")
+	if !strings.Contains(string(data), "gshell rolled back to") {
+		t.Fatal("not rolled back")
+	}
 }
 
 func TestRunMain(t *testing.T) {
@@ -793,15 +2381,58 @@ func TestRunMain(t *testing.T) {
 	}
 }
 
+func daemonArgs(repo string) []string {
+	cmdstr := "-test.run ^TestRunMain$ -test.coverprofile=.test/l2_gshelld" + randID() + ".cov -- "
+	cmdstr += "-loglevel debug daemon -wd .working -registry 127.0.0.1:11985 -bcast 9923 "
+	cmdstr += "-root -repo " + repo + " -metrics 127.0.0.1:9100 "
+	cmdstr += "-update http://127.0.0.1:9001 -update-key XQ7Tg4xVyGRid0I2Erm+KawYwKyw45d8FMChbEApWbM="
+	return strings.Split(cmdstr, " ")
+}
+
+// restartDaemon restarts the test daemon with the code repo, the GRGs keep running.
+func restartDaemon(t *testing.T, repo string) {
+	pid, _ := shell.Run("pgrep -f 'daemon -wd [.]working'")
+	pid = strings.TrimSpace(pid)
+	if len(pid) == 0 || strings.Contains(pid, "\n") {
+		t.Fatalf("daemon pid not found: %q", pid)
+	}
+	exited := func() bool {
+		for i := 0; i < 50; i++ {
+			if _, err := os.Stat("/proc/" + pid); err != nil {
+				return true
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+	shell.Run("kill -INT " + pid)
+	if !exited() {
+		// still serving the streaming clients
+		shell.Run("kill -KILL " + pid)
+		if !exited() {
+			t.Fatal("daemon not stopped")
+		}
+	}
+
+	cmd := exec.Command("gshell.tester", daemonArgs(repo)...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+	for i := 0; i < 50; i++ {
+		if out, err := gshellRunCmd("repo"); err == nil && !strings.Contains(out, "NA") {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatal("daemon not restarted")
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	if len(flag.Args()) == 0 {
-		cmdstr := "-test.run ^TestRunMain$ -test.coverprofile=.test/l2_gshelld" + randID() + ".cov -- "
-		cmdstr += "-loglevel debug daemon -wd .working -registry 127.0.0.1:11985 -bcast 9923 "
-		cmdstr += "-root -repo testdata "
-		cmdstr += "-update http://127.0.0.1:9001"
 		go func() {
-			output, _ := exec.Command("gshell.tester", strings.Split(cmdstr, " ")...).CombinedOutput()
+			output, _ := exec.Command("gshell.tester", daemonArgs("testdata")...).CombinedOutput()
 			fmt.Println(string(output))
 		}()
 
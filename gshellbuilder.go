@@ -1,9 +1,11 @@
 package gshellos
 
 import (
-	"crypto/md5"
+	"bufio"
+	"crypto/ed25519"
 	_ "embed" // go embed
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -18,6 +20,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,6 +29,7 @@ import (
 	as "github.com/godevsig/adaptiveservice"
 	"github.com/godevsig/glib/sys/log"
 	"github.com/godevsig/glib/sys/shell"
+	"github.com/godevsig/gshellos/stdlib"
 	"github.com/traefik/yaegi/interp"
 )
 
@@ -110,6 +114,7 @@ func newCmd(name, usage string, helps ...string) string {
 }
 
 var updateInterval = "600"
+var updateStartTimeout = "30" // in seconds for the new version to publish gshellDaemon
 
 func addDaemonCmd() {
 	cmd := flag.NewFlagSet(newCmd("daemon", "[options]", "Start local gshell daemon"), flag.ExitOnError)
@@ -118,8 +123,15 @@ func addDaemonCmd() {
 	invisible := cmd.Bool("invisible", false, "make gshell daemon invisible in gshell service network")
 	registryAddr := cmd.String("registry", "", "root registry address")
 	lanBroadcastPort := cmd.String("bcast", "", "broadcast port for LAN")
-	codeRepo := cmd.String("repo", "", "code repo local path or https address in format site/org/proj/branch")
+	codeRepo := cmd.String("repo", "", `code repo local path, https address in format site/org/proj/branch
+or local git repo in format git:/path/to/repo.git[#branch]`)
 	updateURL := cmd.String("update", "", "url of artifacts to update gshell, require -root")
+	updateKeyStr := cmd.String("update-key", "", "base64 ed25519 public key to verify the signature of gshell new versions")
+	var logRotation LogRotation
+	logRotation.addFlags(cmd, "daemon.log, grg.log and GRE logs")
+	metricsAddr := cmd.String("metrics", "", "serve Prometheus metrics at http://<address>/metrics, e.g. :9100")
+	cacheSize := cmd.String("cache-size", codeCacheSizeDefault, "max size of the code bundle cache in the work dir, 0 to disable")
+	secretKey := cmd.String("secret-key", "", "file of the key to encrypt the secrets, keys/secret.key in the work dir if not specified")
 
 	action := func() error {
 		if providerID != "self" {
@@ -140,6 +152,14 @@ func addDaemonCmd() {
 		if len(*lanBroadcastPort) == 0 {
 			scope &= ^as.ScopeLAN // not ScopeLAN
 		}
+		var updateKey ed25519.PublicKey
+		if len(*updateKeyStr) != 0 {
+			key, err := base64.StdEncoding.DecodeString(*updateKeyStr)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				return errors.New("wrong update key")
+			}
+			updateKey = key
+		}
 		updateURL := *updateURL
 		if len(updateURL) != 0 || *rootRegistry {
 			if scope&as.ScopeWAN != as.ScopeWAN {
@@ -147,9 +167,27 @@ func addDaemonCmd() {
 			}
 		}
 
+		if err := logRotation.validate(); err != nil {
+			return err
+		}
+		if len(*metricsAddr) != 0 && metricsService == nil {
+			return errors.New("http feature not enabled, check build tags")
+		}
+		cacheMaxSize, err := parseSize(*cacheSize)
+		if err != nil {
+			return err
+		}
+		cache := newCodeCache(workDir, cacheMaxSize)
+
 		codeRepo := *codeRepo
-		crs := &codeRepoSvc{}
-		if len(codeRepo) != 0 {
+		crs := &codeRepoSvc{cache: cache}
+		if strings.HasPrefix(codeRepo, "git:") {
+			gr, err := newGitRepo(codeRepo)
+			if err != nil {
+				return err
+			}
+			crs.gitRepo = gr
+		} else if len(codeRepo) != 0 {
 			fi, err := os.Stat(codeRepo)
 			if err != nil || !fi.Mode().IsDir() {
 				crs.httpRepoInfo = strings.Split(codeRepo, "/")
@@ -174,9 +212,11 @@ func addDaemonCmd() {
 		}
 
 		logStream := log.NewStream("daemon")
-		if err := logStream.SetOutput("file:" + workDir + "/logs/daemon.log"); err != nil {
+		logFile, err := openLogFile(workDir+"/logs/daemon.log", logRotation)
+		if err != nil {
 			return err
 		}
+		logStream.SetOutputter(logFile)
 		lg := newLogger(logStream, "daemon")
 		lg.Infof("daemon version: %s", version)
 
@@ -201,6 +241,7 @@ func addDaemonCmd() {
 			s.EnableAutoReverseProxy()
 		}
 
+		access := newAccessControl(workDir, lg)
 		if *rootRegistry {
 			s.EnableRootRegistry()
 			s.EnableIPObserver()
@@ -210,19 +251,24 @@ func addDaemonCmd() {
 					return errors.New("http feature not enabled, check build tags")
 				}
 				updateURL = strings.TrimSuffix(updateURL, "/")
-				updtr := &updater{url: updateURL, lg: lg}
+				ro, err := newRollout(workDir)
+				if err != nil {
+					return err
+				}
+				updtr := &updater{url: updateURL, lg: lg, rollout: ro, access: access, nonces: make(map[as.Netconn][]byte), reporters: make(map[as.Netconn]string)}
 				if err := s.Publish("updater",
 					updaterKnownMsgs,
 					as.OnNewStreamFunc(func(ctx as.Context) { ctx.SetContext(updtr) }),
+					as.OnDisconnectFunc(updtr.onDisconnect),
 				); err != nil {
 					return err
 				}
 			}
 		}
 
-		if len(crs.localRepoPath) != 0 || len(crs.httpRepoInfo) != 0 {
+		if len(crs.localRepoPath) != 0 || len(crs.httpRepoInfo) != 0 || crs.gitRepo != nil {
 			scope := scope
-			if len(crs.localRepoPath) != 0 {
+			if len(crs.localRepoPath) != 0 || crs.gitRepo != nil {
 				scope &= ^as.ScopeWAN // not ScopeWAN
 				scope &= ^as.ScopeLAN // not ScopeLAN
 			}
@@ -248,6 +294,33 @@ func addDaemonCmd() {
 				return
 			}
 			lg.Debugf("executable path: %s", exe)
+			if updateKey == nil {
+				lg.Warnf("no update key, signature of new versions not verified")
+			}
+			startTimeout, _ := strconv.Atoi(updateStartTimeout)
+			prevFile := exe + ".prev"
+			failedFile := workDir + "/update.failed"
+			installFile := func(src, dst string) error {
+				if err := os.Rename(src, dst); err != nil {
+					lg.Infof("failed to rename %s to %s: %s", src, dst, err)
+					if output, _ := shell.Run("mv -f " + src + " " + dst); len(output) != 0 {
+						return errors.New(output)
+					}
+				}
+				if output, _ := shell.Run("chmod ugo+s " + dst); len(output) != 0 {
+					return errors.New(output)
+				}
+				return nil
+			}
+			startDaemon := func() (*exec.Cmd, error) {
+				cmd := cmdArgs[0]
+				args := cmdArgs[1:]
+				if cmdArgs[0] == "gshell.tester" {
+					args = append([]string{"-test.run", "^TestRunMain$", "--"}, args...)
+				}
+				c := exec.Command(cmd, args...)
+				return c, c.Start()
+			}
 			for {
 				time.Sleep(time.Duration(i) * time.Second)
 				c := as.NewClient(as.WithLogger(lg)).SetDiscoverTimeout(0)
@@ -255,8 +328,24 @@ func addDaemonCmd() {
 				if conn == nil {
 					continue
 				}
-				var gshellbin *gshellBin
-				err := conn.SendRecv(tryUpdate{revInuse: commitRev, arch: runtime.GOARCH}, &gshellbin)
+				revFailed, _ := os.ReadFile(failedFile)
+				// sign the report with the node key to prove the provider ID
+				var challenge *authChallenge
+				if err := conn.SendRecv(updateChallenge{}, &challenge); err != nil {
+					lg.Debugf("update challenge error: %v", err)
+				} else if key, err := access.nodeKey(); err != nil {
+					lg.Warnf("node key error: %v", err)
+				} else {
+					selfID, _ := access.selfProviderID()
+					report := &updateReport{providerID: selfID, revInuse: commitRev, arch: runtime.GOARCH, key: key.Public().(ed25519.PublicKey)}
+					report.sig = ed25519.Sign(key, updatePayload(challenge.Nonce, report.providerID, report.revInuse, report.arch))
+					if err := conn.SendRecv(report, nil); err != nil {
+						lg.Warnf("update report rejected: %v", err)
+					}
+				}
+				msg := tryUpdateV2{revInuse: commitRev, revFailed: strings.TrimSpace(string(revFailed)), arch: runtime.GOARCH}
+				var gshellbin *gshellBinSigned
+				err := conn.SendRecv(msg, &gshellbin)
 				conn.Close()
 				if err != nil {
 					if strings.Contains(err.Error(), ErrNoUpdate.Error()) {
@@ -266,8 +355,8 @@ func addDaemonCmd() {
 					}
 					continue
 				}
-				if fmt.Sprintf("%x", md5.Sum(gshellbin.bin)) != gshellbin.md5 {
-					lg.Warnf("gshell new version md5 mismatch")
+				if err := gshellbin.verify(updateKey); err != nil {
+					lg.Warnf("gshell new version %s rejected: %v", gshellbin.rev, err)
 					continue
 				}
 				newFile := workDir + "/gshell.updating"
@@ -277,32 +366,41 @@ func addDaemonCmd() {
 				}
 
 				lg.Debugf(shell.Run("ls -lh " + newFile))
-				lg.Infof("updating gshell version...")
+				lg.Infof("updating gshell version to %s...", gshellbin.rev)
 
-				if err := os.Rename(newFile, exe); err != nil {
-					lg.Infof("failed to rename new gshell to %s: %s", exe, err)
-					output, _ := shell.Run("mv -f " + newFile + " " + exe)
-					if len(output) != 0 {
-						lg.Warnf("failed to mv new gshell to %s: %s", exe, output)
-						continue
-					}
+				// keep the previous version to roll back
+				if err := installFile(exe, prevFile); err != nil {
+					lg.Warnf("failed to keep previous gshell: %s", err)
+					continue
 				}
-				if output, _ := shell.Run("chmod ugo+s " + exe); len(output) != 0 {
-					lg.Warnf("failed to set gshell bin permission : %s", output)
+				if err := installFile(newFile, exe); err != nil {
+					lg.Warnf("failed to install new gshell to %s: %s", exe, err)
+					installFile(prevFile, exe)
 					continue
 				}
 
 				updateChan = make(chan struct{})
 				s.CloseWait()
-				cmd := cmdArgs[0]
-				args := cmdArgs[1:]
-				if cmdArgs[0] == "gshell.tester" {
-					args = append([]string{"-test.run", "^TestRunMain$", "--"}, args...)
+				cmd, err := startDaemon()
+				if err == nil && !waitDaemon(cmd, time.Duration(startTimeout)*time.Second, lg) {
+					err = errors.New("gshellDaemon not published")
 				}
-				if err := exec.Command(cmd, args...).Start(); err != nil {
-					lg.Errorf("start new gshell failed: %v", err)
-				} else {
+				if err == nil {
 					lg.Infof("new version gshell started")
+					close(updateChan)
+					return
+				}
+				lg.Errorf("new version gshell %s not started: %v, rolling back", gshellbin.rev, err)
+				if cmd.Process != nil {
+					cmd.Process.Kill()
+				}
+				os.WriteFile(failedFile, []byte(gshellbin.rev+"\n"), 0644)
+				if err := installFile(prevFile, exe); err != nil {
+					lg.Errorf("failed to restore previous gshell: %s", err)
+				} else if _, err := startDaemon(); err != nil {
+					lg.Errorf("start previous gshell failed: %v", err)
+				} else {
+					lg.Infof("gshell rolled back to %s", commitRev)
 				}
 				close(updateChan)
 				return
@@ -310,8 +408,13 @@ func addDaemonCmd() {
 		}()
 
 		gd := &daemon{
-			lg:      lg,
-			workDir: workDir,
+			lg:          lg,
+			workDir:     workDir,
+			logRotation: logRotation,
+			secrets:     newSecretStore(workDir, *secretKey),
+			access:      access,
+			applier:     newApplier(workDir),
+			cache:       cache,
 		}
 		visibleScope := scope
 		if *invisible {
@@ -320,15 +423,21 @@ func addDaemonCmd() {
 		if err := s.PublishIn(visibleScope, "gshellDaemon",
 			daemonKnownMsgs,
 			as.OnNewStreamFunc(gd.onNewStream),
+			as.OnConnectFunc(gd.conns.onConnect),
+			as.OnDisconnectFunc(gd.onDisconnect),
 		); err != nil {
 			return err
 		}
+		if len(*metricsAddr) != 0 {
+			go metricsService(*metricsAddr, gd)
+		}
 		if debugService != nil {
 			go debugService(lg)
 		}
 
 		go gd.grgRestarter()
-		err := s.Serve()
+		go gd.reconciler()
+		err = s.Serve()
 		if updateChan != nil {
 			<-updateChan
 		}
@@ -419,12 +528,27 @@ func addListCmd() {
 }
 
 func addIDCmd() {
-	cmd := flag.NewFlagSet(newCmd("id", "", "Print self provider ID"), flag.ExitOnError)
+	cmd := flag.NewFlagSet(newCmd("id", "[options]", "Print self provider ID"), flag.ExitOnError)
+	key := cmd.Bool("key", false, "also print the node key to be added in acl.yaml of other nodes")
 
 	action := func() error {
 		if providerID != "self" {
 			return errors.New("command does not run on remote node")
 		}
+		if *key {
+			lg := newLogger(log.DefaultStream, "main")
+			conn := connectDaemon(providerID, lg)
+			if conn == nil {
+				return as.ErrServiceNotFound(godevsigPublisher, "gshellDaemon")
+			}
+			defer conn.Close()
+			var proof *authProof
+			if err := conn.SendRecv(&cmdAuthSign{}, &proof); err != nil {
+				return err
+			}
+			fmt.Println(proof.ProviderID, base64.StdEncoding.EncodeToString(proof.Key))
+			return nil
+		}
 		selfID, err := getSelfID()
 		if err != nil {
 			selfID = "NA"
@@ -435,6 +559,64 @@ func addIDCmd() {
 	cmds = append(cmds, subCmd{cmd, action})
 }
 
+func addSignCmd() {
+	cmd := flag.NewFlagSet(newCmd("sign",
+		"[options] <path[/file.go]>",
+		"Sign the code to be run on the nodes with code signing policy",
+		"The signature is written to <path[/file.go]>.sig by default, which is sent",
+		"along with the code by run, or read from the code repo"),
+		flag.ExitOnError)
+	keyFile := cmd.String("key", "gshell.key", "the signing key file")
+	genKey := cmd.Bool("genkey", false, "generate the signing key file and print the public key to be trusted in codesign.yaml")
+	output := cmd.String("o", "", "the signature file")
+	raw := cmd.Bool("raw", false, "sign the file as is instead of the code, e.g. gshell.<arch> for -update-key")
+
+	action := func() error {
+		if providerID != "self" {
+			return errors.New("command does not run on remote node")
+		}
+		if *genKey {
+			if _, err := os.Stat(*keyFile); err == nil {
+				return fmt.Errorf("%s already exists", *keyFile)
+			}
+			pub, err := genSigningKey(*keyFile)
+			if err != nil {
+				return err
+			}
+			fmt.Println(pub)
+			return nil
+		}
+
+		args := cmd.Args()
+		if len(args) != 1 {
+			return errors.New("one path expected, see --help")
+		}
+		key, err := readSigningKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		var data []byte
+		if *raw {
+			data, err = os.ReadFile(args[0])
+		} else {
+			data, err = zipPathToBuffer(args[0])
+		}
+		if err != nil {
+			return err
+		}
+		file := *output
+		if len(file) == 0 {
+			file = sigFile(args[0])
+		}
+		if err := os.WriteFile(file, []byte(signCode(key, data)+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Println(file, "written")
+		return nil
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
 func addExecCmd() {
 	cmd := flag.NewFlagSet(newCmd("exec", "<path[/file.go]> [args...]", "Run go file(s) in a local GRE"), flag.ExitOnError)
 
@@ -462,6 +644,9 @@ func addStartCmd() {
 	cmd := flag.NewFlagSet(newCmd("__start", "[options]", "Start named GRG"), flag.ExitOnError)
 	workDir := cmd.String("wd", defaultWorkDir, "set working directory")
 	grgName := cmd.String("group", "", "GRG name")
+	var logRotation LogRotation
+	logRotation.addFlags(cmd, "grg.log and GRE logs")
+	cacheSize := cmd.String("cache-size", codeCacheSizeDefault, "max size of the code bundle cache in the work dir, 0 to disable")
 
 	getRealtimePriority := func(pid int) int {
 		statData, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
@@ -491,8 +676,14 @@ func addStartCmd() {
 		grgName := strings.Split(grgNameVer, "-")[0]
 
 		workDir := *workDir
+		cacheMaxSize, err := parseSize(*cacheSize)
+		if err != nil {
+			return err
+		}
 		logStream := log.NewStream("grg")
-		logStream.SetOutput("file:" + workDir + "/logs/grg.log")
+		if logFile, err := openLogFile(workDir+"/logs/grg.log", logRotation); err == nil {
+			logStream.SetOutputter(logFile)
+		}
 		lg := newLogger(logStream, "grg-"+grgNameVer)
 		opts := []as.Option{
 			as.WithScope(as.ScopeOS),
@@ -541,11 +732,15 @@ func addStartCmd() {
 				statDir:    grgStatDir,
 				pid:        os.Getpid(),
 			},
-			workDir: workDir,
-			server:  s,
-			lg:      lg,
-			gres:    make(map[string]*greCtl),
-		}
+			workDir:     workDir,
+			server:      s,
+			lg:          lg,
+			gres:        make(map[string]*greCtl),
+			events:      newEventReporter(grgNameVer, lg),
+			logRotation: logRotation,
+			cache:       newCodeCache(workDir, cacheMaxSize),
+		}
+		defer grg.events.close()
 		if err := grg.loadGREs(); err != nil {
 			return err
 		}
@@ -553,6 +748,8 @@ func addStartCmd() {
 		if err := s.Publish("grg-"+grgNameVer,
 			grgKnownMsgs,
 			as.OnNewStreamFunc(grg.onNewStream),
+			as.OnConnectFunc(grg.conns.onConnect),
+			as.OnDisconnectFunc(grg.conns.onDisconnect),
 		); err != nil {
 			return err
 		}
@@ -566,6 +763,71 @@ func addStartCmd() {
 	cmds = append(cmds, subCmd{cmd, action})
 }
 
+func addIsolateCmd() {
+	cmd := flag.NewFlagSet(newCmd("__isolate", "[options] [args...]"), flag.ExitOnError)
+	grgName := cmd.String("group", "", "GRG name")
+	greID := cmd.String("gre", "", "GRE ID")
+	codeDir := cmd.String("code", "", "code path")
+
+	action := func() error {
+		if providerID != "self" {
+			return errors.New("command does not run on remote node")
+		}
+		if len(*grgName) == 0 || len(*greID) == 0 || len(*codeDir) == 0 {
+			return errors.New("no GRG name, GRE ID or code path")
+		}
+		token := os.Getenv(isolateTokenEnv)
+		os.Unsetenv(isolateTokenEnv)
+
+		c := as.NewClient(as.WithScope(as.ScopeOS)).SetDiscoverTimeout(3)
+		conn := <-c.Discover(godevsigPublisher, "grg-"+*grgName)
+		if conn == nil {
+			return fmt.Errorf("grg-%s service not found", *grgName)
+		}
+		defer conn.Close()
+		conn.SetRecvTimeout(0)
+		secrets := make(map[string]string)
+		if err := conn.SendRecv(&grgCmdIsolate{*greID, token}, &secrets); err != nil {
+			return err
+		}
+		// stdio is proxied over the stream to the GRG, stderr is kept for
+		// the GRG to tell the error
+		stdio := as.NewStreamIO(conn)
+		defer stdio.Close()
+
+		gsh, err := newShell(interp.Options{
+			Stdin:  stdio,
+			Stdout: stdio,
+			Stderr: os.Stderr,
+			Args:   cmd.Args(),
+		})
+		if err != nil {
+			return err
+		}
+		defer gsh.close()
+		// the same view as non-isolated GRE, the environment and working directory are set by the GRG
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		exports := interp.Exports(stdlib.NewOSView(os.Environ(), wd).Symbols())
+		exports[secretPkgPath+"/secret"] = secretSymbols(secrets)
+		if err := gsh.interpreter.Use(exports); err != nil {
+			return err
+		}
+
+		// errors go to stderr which the GRG parses the same way as non-isolated GRE
+		if err := gsh.evalPath(*codeDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if p, ok := err.(interp.Panic); ok {
+				fmt.Fprintln(os.Stderr, string(p.Stack))
+			}
+		}
+		return nil
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
 func randStringRunes(n int) string {
 	var letterRunes = []rune("abcdefghijklmnopqrstuvwxyz")
 	b := make([]rune, n)
@@ -581,12 +843,18 @@ func connectDaemon(providerID string, lg *log.Logger) (conn as.Connection) {
 		conn = <-c.Discover(godevsigPublisher, "gshellDaemon")
 	} else { // remote
 		conn = <-c.Discover(godevsigPublisher, "gshellDaemon", providerID)
+		if conn != nil {
+			if err := authenticate(conn, lg); err != nil {
+				fmt.Fprintf(os.Stderr, "authentication to %s failed, running as anonymous: %v\n", providerID, err)
+			}
+		}
 	}
 	return
 }
 
 func addRepoCmd() {
-	cmd := flag.NewFlagSet(newCmd("repo", "[ls [path]]", "List contens of the code repo seen on local/remote node"), flag.ExitOnError)
+	cmd := flag.NewFlagSet(newCmd("repo", "[ls [path[@ref]] | cache <ls|clear>]", "List contens of the code repo seen on local/remote node",
+		"or list/clear the code bundle cache of local/remote node"), flag.ExitOnError)
 
 	action := func() error {
 		args := cmd.Args()
@@ -621,6 +889,41 @@ func addRepoCmd() {
 			}
 			return nil
 		}
+		if args[0] == "cache" {
+			if len(args) < 2 {
+				return errors.New("no cache subcommand provided, see --help")
+			}
+			switch args[1] {
+			case "ls":
+				var stat *codeCacheStat
+				if err := conn.SendRecv(cmdCacheList{}, &stat); err != nil {
+					return err
+				}
+				var size int64
+				fmt.Println("SUM           SIZE     LAST USED            SOURCE")
+				for _, ce := range stat.Entries {
+					size += ce.Size
+					source := ""
+					if len(ce.Sources) != 0 {
+						source = ce.Sources[0]
+						if len(ce.Sources) > 1 {
+							source += fmt.Sprintf(" (+%d)", len(ce.Sources)-1)
+						}
+					}
+					fmt.Printf("%-12s  %-7s  %s  %s\n", ce.Sum[:12], formatSize(ce.Size), ce.LastUsed.Format("2006/01/02 15:04:05"), source)
+				}
+				fmt.Printf("%d bundles, %s of max %s\n", len(stat.Entries), formatSize(size), formatSize(stat.MaxSize))
+			case "clear":
+				var out string
+				if err := conn.SendRecv(cmdCacheClear{}, &out); err != nil {
+					return err
+				}
+				fmt.Println(out)
+			default:
+				return fmt.Errorf("unknown cache subcommand %s, see --help", args[1])
+			}
+			return nil
+		}
 		return fmt.Errorf("unknown command %s, see --help", args[0])
 	}
 	cmds = append(cmds, subCmd{cmd, action})
@@ -631,7 +934,8 @@ func addRunCmd() {
 		"[options] <path[/file.go]> [args...]",
 		"Try local code path[/file.go] first or fetch the code from `gshell repo`,",
 		"and run it in a new GRE in specified GRG on local/remote node",
-		"Use `gshell repo ls [path]` to see available code files"),
+		"Use `gshell repo ls [path]` to see available code files",
+		"Use path[/file.go]@ref to run the code at the branch, tag or commit of git code repo"),
 		flag.ExitOnError)
 	grgName := cmd.String("group", "", `name of the GRG in the form name-version
 random group name will be used if no name specified
@@ -643,7 +947,31 @@ silently ignore errors if real-time priority can not be set`)
 	autoRemove := cmd.Bool("rm", false, "auto-remove the GRE when it exits")
 	autoRestart := cmd.Uint("restart", 0, `auto-restart the GRE on failure for at most specified times
 only applicable for non-interactive mode`)
+	restartMode := cmd.String("restart-mode", "", `when to auto-restart the GRE: on-failure(default), always or never
+restarts are counted in -restart times, always restarts without limit if -restart is not specified`)
+	restartBackoff := cmd.Uint("restart-backoff", 0, "initial delay in seconds before auto-restart, doubled on each consecutive restart")
+	restartMaxDelay := cmd.Uint("restart-max-delay", 0, "max auto-restart delay in seconds, 300 if not specified")
+	restartReset := cmd.Uint("restart-reset", 0, "refill the -restart times if the GRE has run longer than specified seconds")
 	autoImport := cmd.Bool("import", false, "auto-import dependent packages")
+	var env stringList
+	cmd.Var(&env, "e", "set environment variable KEY=VAL of the GRE, can be specified multiple times")
+	workdir := cmd.String("w", "", "working directory of the GRE, default to that of the GRG")
+	var secrets stringList
+	cmd.Var(&secrets, "secret", "grant the secret of the name to the GRE, can be specified multiple times")
+	sig := cmd.String("sig", "", "signature file of the code, default to <path[/file.go]>.sig if it exists")
+	isolate := cmd.Bool("isolate", false, "run the GRE in a dedicated helper process so that a crash does not affect the GRG")
+	schedule := cmd.String("schedule", "", `run the GRE on cron schedule instead of once, e.g. "*/5 * * * *"
+only applicable for non-interactive mode`)
+	healthCheck := cmd.String("health", "", `check the health of the GRE periodically, one of:
+service:publisher/service, tcp:host:port or go:snippet`)
+	healthInterval := cmd.Uint("health-interval", healthIntervalDefault, "health check interval in seconds")
+	healthRestart := cmd.Bool("health-restart", false, "restart the GRE when it is unhealthy, counted in -restart times")
+	memoryMax := cmd.String("mem", "", `set cgroup v2 memory limit of the GRG on new GRG creation, e.g. 64M
+silently ignore errors if cgroup v2 is not available`)
+	cpuQuota := cmd.Int("cpu", 0, "set cgroup v2 cpu quota of the GRG in percentage of one CPU on new GRG creation")
+	pidsMax := cmd.Int("pids", 0, "set cgroup v2 max number of tasks of the GRG on new GRG creation")
+	var logRotation LogRotation
+	logRotation.addFlags(cmd, "the GRE log")
 
 	action := func() error {
 		args := cmd.Args()
@@ -670,14 +998,51 @@ only applicable for non-interactive mode`)
 		if rtPriority < 0 || rtPriority > 99 {
 			return errors.New("wrong SCHED_RR priority, see man chrt")
 		}
+		limits := ResourceLimits{
+			MemoryMax: *memoryMax,
+			CPUQuota:  *cpuQuota,
+			PidsMax:   *pidsMax,
+		}
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		if err := logRotation.validate(); err != nil {
+			return err
+		}
 
 		lg := newLogger(log.DefaultStream, "main")
 
 		if *interactive {
 			*autoRestart = 0
+			if len(*schedule) != 0 {
+				return errors.New("schedule is only applicable for non-interactive mode")
+			}
+		}
+		if len(*schedule) != 0 {
+			if _, err := parseCron(*schedule); err != nil {
+				return err
+			}
+		}
+		if len(*healthCheck) != 0 {
+			if _, err := parseHealthCheck(*healthCheck); err != nil {
+				return err
+			}
+		}
+		policy := RestartPolicy{
+			Mode:        *restartMode,
+			Backoff:     *restartBackoff,
+			MaxDelay:    *restartMaxDelay,
+			ResetWindow: *restartReset,
+		}
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		if err := validateEnv(env); err != nil {
+			return err
+		}
+		if err := validateSecretNames(secrets); err != nil {
+			return err
 		}
-
-		selfID, _ := getSelfID()
 
 		conn := connectDaemon(providerID, lg)
 		if conn == nil {
@@ -687,14 +1052,35 @@ only applicable for non-interactive mode`)
 
 		jobcmd := JobCmd{
 			Args:           args,
+			Env:            env,
+			Workdir:        *workdir,
+			Secrets:        secrets,
 			AutoRemove:     *autoRemove,
 			AutoRestartMax: *autoRestart,
+			RestartPolicy:  policy,
+			Isolate:        *isolate,
+			Schedule:       *schedule,
+			HealthCheck:    *healthCheck,
+			HealthInterval: *healthInterval,
+			HealthRestart:  *healthRestart,
+			ResourceLimits: limits,
+			LogRotation:    logRotation,
 		}
 
 		// try to use local file/path if it exits
 		filePath := args[0]
 		if zip, err := zipPathToBuffer(filePath); err == nil {
 			jobcmd.CodeZip = zip
+			if len(*sig) == 0 {
+				jobcmd.CodeSig, _ = readSigFile(sigFile(filePath))
+			}
+		}
+		if len(*sig) != 0 {
+			codeSig, err := readSigFile(*sig)
+			if err != nil {
+				return err
+			}
+			jobcmd.CodeSig = codeSig
 		}
 
 		cmd := cmdRun{
@@ -702,7 +1088,6 @@ only applicable for non-interactive mode`)
 				JobCmd:      jobcmd,
 				Interactive: *interactive,
 				AutoImport:  *autoImport,
-				RequestedBy: selfID,
 			},
 			GRGName:    grg,
 			RtPriority: rtPriority,
@@ -787,101 +1172,46 @@ func addJoblistCmd() {
 			return err
 		}
 
-		lg := newLogger(log.DefaultStream, "main")
-		conn := connectDaemon(providerID, lg)
-		if conn == nil {
-			return as.ErrServiceNotFound(godevsigPublisher, "gshellDaemon")
-		}
-		defer conn.Close()
-
-		selfID, _ := getSelfID()
-
 		tiny := *tiny
-		switch action {
-		case "save":
-			var jlist joblist
-			if err := conn.SendRecv(cmdJoblistSave{tiny}, &jlist); err != nil {
-				return err
-			}
-			// turn bytecode to string
-			for _, grg := range jlist.GRGs {
-				for _, job := range grg.Jobs {
-					if !tiny {
-						job.CodeZipBase64 = base64.StdEncoding.EncodeToString(job.CodeZip)
-					}
-					job.CodeZip = nil
-					job.Cmd = strings.Join(job.Args, " ")
-					job.Args = nil
-				}
-			}
-			f, err := os.Create(file)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			enc := yaml.NewEncoder(f)
-			if err := enc.Encode(jlist); err != nil {
-				return err
-			}
-			fmt.Println(file, "saved")
-		case "load":
-			f, err := os.Open(file)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			var jlist joblist
-			dec := yaml.NewDecoder(f)
-			if err := dec.Decode(&jlist); err != nil {
-				return err
-			}
-
-			grgMap := make(map[string]struct{})
-			// back to bytecode
-			for _, grg := range jlist.GRGs {
-				if len(grg.Name) == 0 {
-					return fmt.Errorf("empty grg name in joblist %s", file)
+		if action == "save" {
+			return onDaemons("", func(conn as.Connection, id string, w io.Writer) error {
+				file := file
+				if isFleet() {
+					file = fleetFile(file, id)
 				}
-				if _, has := grgMap[grg.Name]; has {
-					return fmt.Errorf("duplicated grg entry %s in joblist %s", grg.Name, file)
+				var jlist joblist
+				if err := conn.SendRecv(cmdJoblistSave{tiny}, &jlist); err != nil {
+					return err
 				}
-				grgMap[grg.Name] = struct{}{}
-				for _, job := range grg.Jobs {
-					if len(job.CodeZipBase64) != 0 {
-						data, err := base64.StdEncoding.DecodeString(job.CodeZipBase64)
-						if err != nil {
-							return fmt.Errorf("parse joblist %s with error: %v", file, err)
+				// turn bytecode to string
+				for _, grg := range jlist.GRGs {
+					for _, job := range grg.Jobs {
+						if !tiny {
+							job.CodeZipBase64 = base64.StdEncoding.EncodeToString(job.CodeZip)
 						}
-						job.CodeZipBase64 = ""
-						job.CodeZip = data
+						job.CodeZip = nil
+						job.Cmd = strings.Join(job.Args, " ")
+						job.Args = nil
 					}
-					job.Args = strings.Fields(job.Cmd)
-					if len(job.Args) == 0 {
-						return fmt.Errorf("parse joblist %s error: empty job", file)
-					}
-					job.Cmd = ""
 				}
-			}
+				f, err := os.Create(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
 
-			if err := conn.SendRecv(&cmdJoblistLoad{jlist, selfID}, nil); err != nil {
-				return err
-			}
-		default:
-			return errors.New("wrong subcommand, see --help")
+				enc := yaml.NewEncoder(f)
+				if err := enc.Encode(jlist); err != nil {
+					return err
+				}
+				fmt.Fprintln(w, file, "saved")
+				return nil
+			})
+		}
+		if isFleet() {
+			return errors.New("joblist " + action + " does not run on multiple providers")
 		}
 
-		return nil
-	}
-	cmds = append(cmds, subCmd{cmd, action})
-}
-
-func addPsCmd() {
-	cmd := flag.NewFlagSet(newCmd("ps", "[options] [GRE IDs ...|names ...]", "Show jobs by GRE ID or name on local/remote node"), flag.ExitOnError)
-	grgName := cmd.String("group", "*", "in which GRG")
-
-	action := func() error {
 		lg := newLogger(log.DefaultStream, "main")
 		conn := connectDaemon(providerID, lg)
 		if conn == nil {
@@ -889,95 +1219,41 @@ func addPsCmd() {
 		}
 		defer conn.Close()
 
-		msg := cmdQuery{GRGName: *grgName, IDPattern: cmd.Args()}
-		var ggis []*grgGREInfo
-		if err := conn.SendRecv(&msg, &ggis); err != nil {
-			return err
-		}
-
-		for _, ggi := range ggis {
-			grei := ggi.GREInfos
-			sort.Slice(grei, func(i int, j int) bool {
-				return grei[i].StartTime.After(grei[j].StartTime)
-			})
-		}
-
-		sort.Slice(ggis, func(i, j int) bool {
-			if len(ggis[i].GREInfos) == 0 {
-				return false
-			}
-			if len(ggis[j].GREInfos) == 0 {
-				return true
-			}
-			return ggis[i].GREInfos[0].StartTime.After(ggis[j].GREInfos[0].StartTime)
-		})
-
-		if len(msg.IDPattern) != 0 { // info
-			for _, ggi := range ggis {
-				for _, grei := range ggi.GREInfos {
-					fmt.Println("GRE ID       :", grei.ID)
-					fmt.Println("IN GROUP     :", ggi.Name)
-					fmt.Println("NAME         :", grei.Name)
-					fmt.Println("ARGS         :", grei.Args)
-					fmt.Println("REQUESTED BY :", grei.RequestedBy)
-					fmt.Println("STATUS       :", grei.Stat)
-					fmt.Println("RESTARTED    :", grei.RestartedNum)
-					startTime := ""
-					if !grei.StartTime.IsZero() {
-						startTime = fmt.Sprint(grei.StartTime)
-					}
-					fmt.Println("START AT     :", startTime)
-					endTime := ""
-					if grei.Stat == "exited" {
-						endTime = fmt.Sprint(grei.EndTime)
-					}
-					fmt.Println("END AT       :", endTime)
-					fmt.Printf("ERROR        : %v\n\n", grei.GREErr)
-				}
-			}
-		} else { // ps
-			fmt.Println("GRE ID        IN GROUP            NAME                START AT             STATUS")
-			trimName := func(name string) string {
-				if len(name) > 18 {
-					name = name[:13] + "..."
-				}
-				return name
+		switch action {
+		case "load":
+			jlist, err := readJoblist(file, queryNodeInfo(conn))
+			if err != nil {
+				return err
 			}
-			for _, ggi := range ggis {
-				for _, grei := range ggi.GREInfos {
-
-					created := grei.StartTime.Format("2006/01/02 15:04:05")
-					stat := grei.Stat
-					if stat == "exited" {
-						ret := ":OK"
-						if len(grei.GREErr) != 0 {
-							ret = ":ERR"
-						}
-						stat = stat + ret
-					}
-					d := grei.EndTime.Sub(grei.StartTime)
-					stat = fmt.Sprintf("%-10s %v", stat, d)
-
-					fmt.Printf("%s  %-18s  %-18s  %s  %s\n", grei.ID, trimName(ggi.Name), trimName(grei.Name), created, stat)
-				}
+			if err := conn.SendRecv(&cmdJoblistLoad{*jlist}, nil); err != nil {
+				return err
 			}
+		default:
+			return errors.New("wrong subcommand, see --help")
 		}
+
 		return nil
 	}
 	cmds = append(cmds, subCmd{cmd, action})
 }
 
-func addPatternCmds() {
+func addApplyCmds() {
 	for _, cmdStrs := range [][]string{
-		{"stop", "[options] [GRE IDs ...|names ...]", "Stop one or more jobs on local/remote node"},
-		{"rm", "[options] [GRE IDs ...|names ...]", "Remove one or more stopped jobs on local/remote node"},
-		{"start", "[options] [GRE IDs ...|names ...]", "Start one or more stopped jobs on local/remote node"},
+		{"apply", "[options]", "Bring the jobs on local/remote node to the joblist and keep them so",
+			"Only what changed is started, restarted or removed, jobs are identified by name and group",
+			"The joblist is reconciled in the background until -stop or joblist load"},
+		{"diff", "[options]", "Show what apply would do with the joblist on local/remote node"},
 	} {
 		cmdStrs := cmdStrs
-		cmd := flag.NewFlagSet(newCmd(cmdStrs[0], cmdStrs[1], cmdStrs[2]), flag.ExitOnError)
-		grgName := cmd.String("group", "*", "in which GRG")
+		cmd := flag.NewFlagSet(newCmd(cmdStrs[0], cmdStrs[1], cmdStrs[2:]...), flag.ExitOnError)
+		file := cmd.String("f", "default.joblist.yaml", "the joblist file")
+		var stop *bool
+		if cmdStrs[0] == "apply" {
+			stop = cmd.Bool("stop", false, "stop the background reconciliation, the jobs keep running")
+		}
 
 		action := func() error {
+			msg := &cmdApply{DryRun: cmdStrs[0] == "diff"}
 			lg := newLogger(log.DefaultStream, "main")
 			conn := connectDaemon(providerID, lg)
 			if conn == nil {
@@ -985,31 +1261,31 @@ func addPatternCmds() {
 			}
 			defer conn.Close()
 
-			msg := cmdPatternAction{GRGName: *grgName, IDPattern: cmd.Args(), Cmd: cmdStrs[0]}
-			var greids []*grgGREIDs
-			if err := conn.SendRecv(&msg, &greids); err != nil {
-				return err
+			if stop != nil && *stop {
+				msg.Stop = true
+			} else {
+				jlist, err := readJoblist(*file, queryNodeInfo(conn))
+				if err != nil {
+					return err
+				}
+				msg.joblist = *jlist
 			}
 
-			var info string
-			switch msg.Cmd {
-			case "stop":
-				info = "stopped"
-			case "rm":
-				info = "removed"
-			case "start":
-				info = "started"
-			}
-			var sb strings.Builder
-			for _, ggi := range greids {
-				str := strings.Join(ggi.GREIDs, "\n")
-				if len(str) != 0 {
-					fmt.Fprintln(&sb, str)
-				}
+			var steps []*applyStep
+			if err := conn.SendRecv(msg, &steps); err != nil {
+				return err
 			}
-			if sb.Len() > 0 {
-				fmt.Print(sb.String())
-				fmt.Println(info)
+			if msg.Stop {
+				fmt.Println("reconciliation stopped")
+				return nil
+			}
+			if len(steps) == 0 {
+				fmt.Println("no change")
+				return nil
+			}
+			fmt.Println("ACTION   GROUP               JOB                 GRE ID        REASON")
+			for _, st := range steps {
+				fmt.Printf("%-7s  %-18s  %-18s  %-12s  %s\n", st.Action, trimName(st.GRG, 18), trimName(st.Job, 18), st.GREID, st.Reason)
 			}
 			return nil
 		}
@@ -1017,10 +1293,242 @@ func addPatternCmds() {
 	}
 }
 
-func addInfoCmd() {
-	cmd := flag.NewFlagSet(newCmd("info", "", "Show gshell info on local/remote node"), flag.ExitOnError)
+// stringList is the flag value that can be specified multiple times.
+type stringList []string
+
+func (sl *stringList) String() string { return strings.Join(*sl, " ") }
+
+func (sl *stringList) Set(s string) error {
+	*sl = append(*sl, s)
+	return nil
+}
+
+// zero time does not survive message transport, treat time before epoch as zero
+func isZeroTime(t time.Time) bool {
+	return t.Before(time.Unix(0, 0))
+}
+
+const psHeader = "GRE ID        IN GROUP            NAME                START AT             STATUS"
+
+func addPsCmd() {
+	cmd := flag.NewFlagSet(newCmd("ps", "[options] [GRE IDs ...|names ...]", "Show jobs by GRE ID or name on local/remote node"), flag.ExitOnError)
+	grgName := cmd.String("group", "*", "in which GRG")
+
+	action := func() error {
+		msg := cmdQuery{GRGName: *grgName, IDPattern: cmd.Args()}
+		header := ""
+		if len(msg.IDPattern) == 0 {
+			header = psHeader
+		}
+		return onDaemons(header, func(conn as.Connection, _ string, w io.Writer) error {
+			var ggis []*grgGREInfo
+			if err := conn.SendRecv(&msg, &ggis); err != nil {
+				return err
+			}
+
+			for _, ggi := range ggis {
+				grei := ggi.GREInfos
+				sort.Slice(grei, func(i int, j int) bool {
+					return grei[i].StartTime.After(grei[j].StartTime)
+				})
+			}
+
+			sort.Slice(ggis, func(i, j int) bool {
+				if len(ggis[i].GREInfos) == 0 {
+					return false
+				}
+				if len(ggis[j].GREInfos) == 0 {
+					return true
+				}
+				return ggis[i].GREInfos[0].StartTime.After(ggis[j].GREInfos[0].StartTime)
+			})
+
+			if len(msg.IDPattern) != 0 { // info
+				for _, ggi := range ggis {
+					for _, grei := range ggi.GREInfos {
+						fmt.Fprintln(w, "GRE ID       :", grei.ID)
+						fmt.Fprintln(w, "IN GROUP     :", ggi.Name)
+						fmt.Fprintln(w, "NAME         :", grei.Name)
+						fmt.Fprintln(w, "ARGS         :", grei.Args)
+						if len(grei.CodeRev) != 0 {
+							fmt.Fprintln(w, "CODE REV     :", grei.CodeRev)
+						}
+						fmt.Fprintln(w, "REQUESTED BY :", grei.RequestedBy)
+						fmt.Fprintln(w, "STATUS       :", grei.Stat)
+						fmt.Fprintln(w, "RESTARTED    :", grei.RestartedNum)
+						if grei.Pid != 0 {
+							fmt.Fprintln(w, "ISOLATED PID :", grei.Pid)
+						}
+						startTime := ""
+						if !isZeroTime(grei.StartTime) {
+							startTime = fmt.Sprint(grei.StartTime)
+						}
+						fmt.Fprintln(w, "START AT     :", startTime)
+						endTime := ""
+						if grei.Stat == "exited" {
+							endTime = fmt.Sprint(grei.EndTime)
+						}
+						fmt.Fprintln(w, "END AT       :", endTime)
+						if len(grei.Schedule) != 0 {
+							fmt.Fprintln(w, "SCHEDULE     :", grei.Schedule)
+							nextRun := ""
+							if !isZeroTime(grei.NextRun) {
+								nextRun = fmt.Sprint(grei.NextRun)
+							}
+							fmt.Fprintln(w, "NEXT RUN     :", nextRun)
+							fmt.Fprintln(w, "HISTORY      :")
+							for i := len(grei.History) - 1; i >= 0; i-- {
+								rr := grei.History[i]
+								ret := "OK"
+								if len(rr.GREErr) != 0 {
+									ret = "ERR"
+								}
+								fmt.Fprintf(w, "  %s  %-3s  %v\n", rr.StartTime.Format("2006/01/02 15:04:05"), ret, rr.EndTime.Sub(rr.StartTime))
+							}
+						}
+						if grei.Stat == "restarting" {
+							fmt.Fprintln(w, "RESTART AT   :", grei.NextRun)
+						}
+						if len(grei.HealthCheck) != 0 {
+							fmt.Fprintln(w, "HEALTH CHECK :", grei.HealthCheck)
+							fmt.Fprintln(w, "HEALTH       :", grei.Health)
+						}
+						if ggi.Resource != nil {
+							fmt.Fprintln(w, "RESOURCE     :", ggi.Resource)
+						}
+						fmt.Fprintf(w, "ERROR        : %v\n\n", grei.GREErr)
+					}
+				}
+			} else { // ps
+				fmt.Fprintln(w, psHeader)
+				trimName := func(name string) string {
+					if len(name) > 18 {
+						name = name[:13] + "..."
+					}
+					return name
+				}
+				for _, ggi := range ggis {
+					for _, grei := range ggi.GREInfos {
+
+						created := grei.StartTime.Format("2006/01/02 15:04:05")
+						if isZeroTime(grei.StartTime) {
+							created = fmt.Sprintf("%19s", "")
+						}
+						stat := grei.Stat
+						if stat == "exited" {
+							ret := ":OK"
+							if len(grei.GREErr) != 0 {
+								ret = ":ERR"
+							}
+							stat = stat + ret
+						}
+						if stat == "scheduled" {
+							stat = fmt.Sprintf("%-10s next %s", stat, grei.NextRun.Format("2006/01/02 15:04"))
+						} else if stat == "restarting" {
+							stat = fmt.Sprintf("%-10s at %s", stat, grei.NextRun.Format("2006/01/02 15:04:05"))
+						} else {
+							d := grei.EndTime.Sub(grei.StartTime)
+							stat = fmt.Sprintf("%-10s %v", stat, d)
+						}
+
+						fmt.Fprintf(w, "%s  %-18s  %-18s  %s  %s\n", grei.ID, trimName(ggi.Name), trimName(grei.Name), created, stat)
+					}
+				}
+			}
+			return nil
+		})
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
+func addPatternCmds() {
+	for _, cmdStrs := range [][]string{
+		{"stop", "[options] [GRE IDs ...|names ...]", "Stop one or more jobs on local/remote node"},
+		{"rm", "[options] [GRE IDs ...|names ...]", "Remove one or more stopped jobs on local/remote node"},
+		{"start", "[options] [GRE IDs ...|names ...]", "Start one or more stopped jobs on local/remote node"},
+	} {
+		cmdStrs := cmdStrs
+		cmd := flag.NewFlagSet(newCmd(cmdStrs[0], cmdStrs[1], cmdStrs[2]), flag.ExitOnError)
+		grgName := cmd.String("group", "*", "in which GRG")
+		var grace *time.Duration
+		if cmdStrs[0] == "stop" {
+			grace = cmd.Duration("t", stopGraceDefault, "grace period after SIGTERM before the job is aborted, 0 to abort at once")
+		}
+
+		action := func() error {
+			msg := cmdPatternAction{GRGName: *grgName, IDPattern: cmd.Args(), Cmd: cmdStrs[0]}
+			if grace != nil {
+				msg.Grace = *grace
+			}
+			return onDaemons("", func(conn as.Connection, _ string, w io.Writer) error {
+				var greids []*grgGREIDs
+				if err := conn.SendRecv(&msg, &greids); err != nil {
+					return err
+				}
+
+				var info string
+				switch msg.Cmd {
+				case "stop":
+					info = "stopped"
+				case "rm":
+					info = "removed"
+				case "start":
+					info = "started"
+				}
+				var sb strings.Builder
+				for _, ggi := range greids {
+					str := strings.Join(ggi.GREIDs, "\n")
+					if len(str) != 0 {
+						fmt.Fprintln(&sb, str)
+					}
+				}
+				if sb.Len() > 0 {
+					fmt.Fprint(w, sb.String())
+					fmt.Fprintln(w, info)
+				}
+				return nil
+			})
+		}
+		cmds = append(cmds, subCmd{cmd, action})
+	}
+}
+
+func addRegroupCmd() {
+	cmd := flag.NewFlagSet(newCmd("regroup",
+		"[options] <GRE ID>",
+		"Move the job to another GRG on local/remote node",
+		"The job keeps its GRE ID and restart counters, a running job is restarted in the new GRG"),
+		flag.ExitOnError)
+	grgName := cmd.String("group", "", `name of the target GRG in the form name-version
+target daemon version will be used if no version specified`)
+	maxprocs := cmd.Int("maxprocs", 0, "set GOMAXPROCS variable on new GRG creation")
+	rtPriority := cmd.Int("rt", 0, `set the GRG to SCHED_RR min/max priority 1/99 on new GRG creation
+silently ignore errors if real-time priority can not be set`)
 
 	action := func() error {
+		args := cmd.Args()
+		if len(args) != 1 {
+			return errors.New("one GRE ID expected, see --help")
+		}
+		grg := *grgName
+		if len(grg) == 0 {
+			return errors.New("no target GRG specified, see --help")
+		}
+		if strings.Contains(grg, "*") {
+			return errors.New("wrong use of wildcard(*), see --help")
+		}
+		if strings.Count(grg, "-") > 1 {
+			return errors.New("wrong group format, see --help")
+		}
+		maxprocs := *maxprocs
+		if maxprocs < 0 {
+			maxprocs = 0
+		}
+		rtPriority := *rtPriority
+		if rtPriority < 0 || rtPriority > 99 {
+			return errors.New("wrong SCHED_RR priority, see man chrt")
+		}
+
 		lg := newLogger(log.DefaultStream, "main")
 		conn := connectDaemon(providerID, lg)
 		if conn == nil {
@@ -1028,27 +1536,36 @@ func addInfoCmd() {
 		}
 		defer conn.Close()
 
-		var info string
-		if err := conn.SendRecv(cmdInfo{}, &info); err != nil {
+		msg := cmdRegroup{
+			GREID:      args[0],
+			GRGName:    grg,
+			RtPriority: rtPriority,
+			Maxprocs:   maxprocs,
+		}
+		var reply string
+		if err := conn.SendRecv(&msg, &reply); err != nil {
 			return err
 		}
-		fmt.Print(info)
-
+		fmt.Println(reply)
 		return nil
 	}
 	cmds = append(cmds, subCmd{cmd, action})
 }
 
-func addLogCmd() {
-	cmd := flag.NewFlagSet(newCmd("log", "[options] <daemon|grg|GRE ID>", "Print target log on local/remote node"), flag.ExitOnError)
-	follow := cmd.Bool("f", false, "follow and output appended data as the log grows")
+func addAttachCmd() {
+	cmd := flag.NewFlagSet(newCmd("attach",
+		"[options] <GRE ID>",
+		"Attach the terminal to stdin and stdout of the running job on local/remote node",
+		"Enter the detach keys in a line or Ctrl-C to detach, leaving the job running"),
+		flag.ExitOnError)
+	detachKeys := cmd.String("detach-keys", "~.", "the line to detach")
 
 	action := func() error {
 		args := cmd.Args()
-		if len(args) == 0 {
-			return errors.New("no target provided, see --help")
+		if len(args) != 1 {
+			return errors.New("one GRE ID expected, see --help")
 		}
-		target := args[0]
+
 		lg := newLogger(log.DefaultStream, "main")
 		conn := connectDaemon(providerID, lg)
 		if conn == nil {
@@ -1056,11 +1573,362 @@ func addLogCmd() {
 		}
 		defer conn.Close()
 
-		msg := cmdLog{Target: target, Follow: *follow}
+		if err := conn.Send(&cmdAttach{GREID: args[0]}); err != nil {
+			return err
+		}
+
+		var detached int32
+		detach := func() {
+			atomic.StoreInt32(&detached, 1)
+			conn.Close()
+		}
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT)
+		go func() {
+			sig := <-sigChan
+			lg.Debugf("signal: %s", sig.String())
+			detach()
+		}()
+
+		ioconn := as.NewStreamIO(conn)
+		go func() {
+			r := bufio.NewReader(os.Stdin)
+			for {
+				line, err := r.ReadString('\n')
+				if strings.TrimSpace(line) == *detachKeys {
+					detach()
+					return
+				}
+				if len(line) != 0 {
+					if _, err := ioconn.Write([]byte(line)); err != nil {
+						return
+					}
+				}
+				if err != nil { // stay attached for output
+					return
+				}
+			}
+		}()
+		lg.Debugln("enter attached io")
+		_, err := io.Copy(os.Stdout, ioconn)
+		lg.Debugln("exit attached io")
+		if atomic.LoadInt32(&detached) == 1 {
+			fmt.Println("detached")
+			return nil
+		}
+		return err
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
+func addEvalCmd() {
+	cmd := flag.NewFlagSet(newCmd("eval",
+		"[options] <GRE ID> <snippet>",
+		"Evaluate Go snippet in the interpreter of the running job on local/remote node",
+		"Package-level variables and functions of the job can be used in the snippet,",
+		"the value is printed if the snippet is an expression but not a function call"),
+		flag.ExitOnError)
+	timeout := cmd.Int("timeout", evalTimeoutDefault, "seconds to wait for the snippet to finish")
+
+	action := func() error {
+		args := cmd.Args()
+		if len(args) < 2 {
+			return errors.New("GRE ID and snippet expected, see --help")
+		}
+
+		lg := newLogger(log.DefaultStream, "main")
+		conn := connectDaemon(providerID, lg)
+		if conn == nil {
+			return as.ErrServiceNotFound(godevsigPublisher, "gshellDaemon")
+		}
+		defer conn.Close()
+
+		msg := cmdEval{grgCmdEval{GREID: args[0], Snippet: strings.Join(args[1:], " "), Timeout: *timeout}}
 		if err := conn.Send(&msg); err != nil {
 			return err
 		}
+		_, err := io.Copy(os.Stdout, as.NewStreamIO(conn))
+		return err
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
+func addSignalCmd() {
+	cmd := flag.NewFlagSet(newCmd("signal",
+		"<signal> <GRE ID>",
+		"Send signal to the running job on local/remote node",
+		"The signal is given by name(TERM or SIGTERM) or number, the job receives it",
+		"through os/signal, or is aborted if it is not handled and terminates by default"),
+		flag.ExitOnError)
+
+	action := func() error {
+		args := cmd.Args()
+		if len(args) != 2 {
+			return errors.New("signal and GRE ID expected, see --help")
+		}
+		sig, err := parseSignal(args[0])
+		if err != nil {
+			return err
+		}
+
+		lg := newLogger(log.DefaultStream, "main")
+		conn := connectDaemon(providerID, lg)
+		if conn == nil {
+			return as.ErrServiceNotFound(godevsigPublisher, "gshellDaemon")
+		}
+		defer conn.Close()
+
+		return conn.SendRecv(&cmdSignal{grgCmdSignal{GREID: args[1], Signal: int(sig)}}, nil)
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
+func addSecretCmd() {
+	cmd := flag.NewFlagSet(newCmd("secret",
+		"<set|ls|rm> [name] [value]",
+		"Manage the secrets of the jobs on local/remote node",
+		"set <name> [value]: set the secret, the value is read from stdin if not given",
+		"ls: list the secrets without values",
+		"rm <names...>: remove the secrets",
+		"The secrets are stored encrypted by the daemon, jobs run with -secret <name>",
+		"read them with Get(name) of package "+secretPkgPath),
+		flag.ExitOnError)
+
+	action := func() error {
+		args := cmd.Args()
+		if len(args) == 0 {
+			return errors.New("no subcommand provided, see --help")
+		}
+
+		var msg interface{}
+		switch args[0] {
+		case "set":
+			if len(args) < 2 || len(args) > 3 {
+				return errors.New("secret name and optional value expected, see --help")
+			}
+			if err := validateSecretNames(args[1:2]); err != nil {
+				return err
+			}
+			value := ""
+			if len(args) == 3 {
+				value = args[2]
+			} else {
+				b, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					return err
+				}
+				value = strings.TrimRight(string(b), "\r\n")
+			}
+			msg = &cmdSecretSet{Name: args[1], Value: value}
+		case "ls":
+			msg = cmdSecretList{}
+		case "rm":
+			if len(args) < 2 {
+				return errors.New("no secret name provided, see --help")
+			}
+			msg = &cmdSecretRm{Names: args[1:]}
+		default:
+			return errors.New("wrong subcommand, see --help")
+		}
+
+		lg := newLogger(log.DefaultStream, "main")
+		conn := connectDaemon(providerID, lg)
+		if conn == nil {
+			return as.ErrServiceNotFound(godevsigPublisher, "gshellDaemon")
+		}
+		defer conn.Close()
+
+		switch msg := msg.(type) {
+		case *cmdSecretSet:
+			return conn.SendRecv(msg, nil)
+		case cmdSecretList:
+			var infos []*secretInfo
+			if err := conn.SendRecv(msg, &infos); err != nil {
+				return err
+			}
+			fmt.Printf("%-24s  %s\n", "NAME", "UPDATED")
+			for _, si := range infos {
+				fmt.Printf("%-24s  %s\n", trimName(si.Name, 24), si.Updated.Format("2006/01/02 15:04:05"))
+			}
+		case *cmdSecretRm:
+			var removed []string
+			if err := conn.SendRecv(msg, &removed); err != nil {
+				return err
+			}
+			for _, name := range removed {
+				fmt.Println(name, "removed")
+			}
+		}
+		return nil
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
+func addUpdateCmd() {
+	cmd := flag.NewFlagSet(newCmd("update",
+		"<status|pause|resume|rollout|hold|unhold|forget> [args...]",
+		"Show or control the rollout of new gshell versions by the updater",
+		"status: show which providers run which version",
+		"pause/resume: stop/restart handing out the new version",
+		"rollout <percent> [provider IDs...]: update the percent of providers",
+		"        selected by provider ID hash, plus the listed providers",
+		"hold <provider ID> <rev>: hold the provider back until the latest rev is the rev",
+		"unhold <provider ID>: remove the hold",
+		"forget <provider ID>: forget the provider and the key it reported with,",
+		"        requires admin role",
+		"The controls are only allowed on the root registry node"),
+		flag.ExitOnError)
+
+	action := func() error {
+		if providerID != "self" {
+			return errors.New("command does not run on remote node")
+		}
+		args := cmd.Args()
+		if len(args) == 0 {
+			return errors.New("no subcommand provided, see --help")
+		}
+
+		var msg interface{}
+		switch args[0] {
+		case "status":
+			msg = updateStatus{}
+		case "pause", "resume":
+			msg = &updateControl{Cmd: args[0]}
+		case "rollout":
+			if len(args) < 2 {
+				return errors.New("no percent provided, see --help")
+			}
+			percent, err := strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+			if err != nil {
+				return fmt.Errorf("wrong percent %s", args[1])
+			}
+			if err := validatePercent(percent); err != nil {
+				return err
+			}
+			msg = &updateControl{Cmd: args[0], Percent: percent, Allow: args[2:]}
+		case "hold":
+			if len(args) != 3 {
+				return errors.New("provider ID and rev expected, see --help")
+			}
+			msg = &updateControl{Cmd: args[0], ProviderID: args[1], Rev: args[2]}
+		case "unhold", "forget":
+			if len(args) != 2 {
+				return errors.New("provider ID expected, see --help")
+			}
+			msg = &updateControl{Cmd: args[0], ProviderID: args[1]}
+		default:
+			return errors.New("wrong subcommand, see --help")
+		}
+
+		lg := newLogger(log.DefaultStream, "main")
+		c := as.NewClient(as.WithLogger(lg)).SetDiscoverTimeout(3)
+		conn := <-c.Discover(godevsigPublisher, "updater")
+		if conn == nil {
+			return as.ErrServiceNotFound(godevsigPublisher, "updater")
+		}
+		defer conn.Close()
+
+		if _, ok := msg.(*updateControl); ok {
+			return conn.SendRecv(msg, nil)
+		}
+		var rs *rolloutStatus
+		if err := conn.SendRecv(msg, &rs); err != nil {
+			return err
+		}
+		paused := ""
+		if rs.Paused {
+			paused = " (paused)"
+		}
+		fmt.Printf("LATEST: %s\n", rs.RevNew)
+		fmt.Printf("ROLLOUT: %d%% %v%s\n\n", rs.Percent, rs.Allow, paused)
+		fmt.Println("PROVIDER      ARCH     REV                                       LAST SEEN            STATE")
+		for _, ps := range rs.Providers {
+			fmt.Printf("%-12s  %-7s  %-40s  %s  %s\n", ps.ProviderID, ps.Arch, ps.Rev, ps.LastSeen.Format("2006/01/02 15:04:05"), ps.State)
+		}
+		return nil
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
+func addInfoCmd() {
+	cmd := flag.NewFlagSet(newCmd("info", "", "Show gshell info on local/remote node"), flag.ExitOnError)
+
+	action := func() error {
+		return onDaemons("", func(conn as.Connection, _ string, w io.Writer) error {
+			var info string
+			if err := conn.SendRecv(cmdInfo{}, &info); err != nil {
+				return err
+			}
+			fmt.Fprint(w, info)
+			return nil
+		})
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
+// parseSince parses the time in the past as a duration from now, or an absolute time in RFC3339
+// or local time format.
+func parseSince(since string) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, since, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("wrong time %s, duration or time like 2006-01-02T15:04:05 expected", since)
+}
+
+func addLogCmd() {
+	cmd := flag.NewFlagSet(newCmd("log", "[options] <daemon|grg|GRE ID>", "Print target log on local/remote node"), flag.ExitOnError)
+	follow := cmd.Bool("f", false, "follow and output appended data as the log grows")
+	all := cmd.Bool("all", false, "also print the rotated log files, the oldest first")
+	stdout := cmd.Bool("stdout", false, "only print stdout of the GRE")
+	stderr := cmd.Bool("stderr", false, "only print stderr of the GRE")
+	since := cmd.String("since", "", "only print the lines since the time, e.g. 10m or 2006-01-02T15:04:05")
+	tail := cmd.Int("tail", 0, "only print the last N lines")
+
+	action := func() error {
+		args := cmd.Args()
+		if len(args) == 0 {
+			return errors.New("no target provided, see --help")
+		}
+		target := args[0]
+		msg := cmdLog{Target: target, Follow: *follow, All: *all, Tail: *tail}
+		switch {
+		case *stdout && *stderr:
+			return errors.New("-stdout and -stderr are exclusive")
+		case *stdout:
+			msg.Stream = "stdout"
+		case *stderr:
+			msg.Stream = "stderr"
+		}
+		if len(*since) != 0 {
+			t, err := parseSince(*since)
+			if err != nil {
+				return err
+			}
+			msg.Since = t
+		}
+
 		if *follow {
+			if isFleet() {
+				return errors.New("log -f does not run on multiple providers")
+			}
+			lg := newLogger(log.DefaultStream, "main")
+			conn := connectDaemon(providerID, lg)
+			if conn == nil {
+				return as.ErrServiceNotFound(godevsigPublisher, "gshellDaemon")
+			}
+			defer conn.Close()
+
+			if err := conn.Send(&msg); err != nil {
+				return err
+			}
 			sigChan := make(chan os.Signal, 1)
 			signal.Notify(sigChan, syscall.SIGINT)
 			go func() {
@@ -1071,15 +1939,61 @@ func addLogCmd() {
 			ioconn := as.NewStreamIO(conn)
 			io.Copy(os.Stdout, ioconn)
 			lg.Debugln("cmdLog: done")
-		} else {
+			return nil
+		}
+
+		return onDaemons("", func(conn as.Connection, _ string, w io.Writer) error {
 			var log []byte
-			if err := conn.Recv(&log); err != nil {
+			if err := conn.SendRecv(&msg, &log); err != nil {
 				return err
 			}
-			fmt.Printf("%s", log)
+			fmt.Fprintf(w, "%s", log)
+			return nil
+		})
+	}
+	cmds = append(cmds, subCmd{cmd, action})
+}
+
+func addEventsCmd() {
+	cmd := flag.NewFlagSet(newCmd("events", "[options]", "Watch lifecycle events of GREs and GRGs on local/remote node"), flag.ExitOnError)
+	grgName := cmd.String("group", "*", "in which GRG")
+	jsonOut := cmd.Bool("json", false, "output one event per line in JSON")
+
+	action := func() error {
+		lg := newLogger(log.DefaultStream, "main")
+		conn := connectDaemon(providerID, lg)
+		if conn == nil {
+			return as.ErrServiceNotFound(godevsigPublisher, "gshellDaemon")
 		}
+		defer conn.Close()
 
-		return nil
+		if err := conn.Send(&cmdEvents{GRGName: *grgName}); err != nil {
+			return err
+		}
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT)
+		go func() {
+			sig := <-sigChan
+			lg.Debugf("signal: %s", sig.String())
+			conn.Close()
+		}()
+
+		enc := json.NewEncoder(os.Stdout)
+		for {
+			var ev *event
+			if err := conn.Recv(&ev); err != nil {
+				lg.Debugln("cmdEvents: done")
+				return nil
+			}
+			if len(ev.Type) == 0 { // keepalive
+				continue
+			}
+			if *jsonOut {
+				enc.Encode(ev)
+			} else {
+				fmt.Println(ev)
+			}
+		}
 	}
 	cmds = append(cmds, subCmd{cmd, action})
 }
@@ -1122,21 +2036,34 @@ func ShellMain() error {
 	flag.StringVar(&loglevel, "loglevel", loglevel, "")
 	flag.StringVar(&providerID, "p", providerID, "")
 	flag.StringVar(&providerID, "provider", providerID, "")
+	flag.BoolVar(&allProviders, "all", false, "")
+	flag.BoolVar(&allProviders, "all-providers", false, "")
+	flag.IntVar(&fleetTimeout, "timeout", fleetTimeout, "")
 	flag.StringVar(&traceList, "trace", "", "")
 
 	addIDCmd()
+	addSignCmd()
 	addExecCmd()
 	addDaemonCmd()
 	addListCmd()
 	addStartCmd()
+	addIsolateCmd()
 	addRepoCmd()
 	addRunCmd()
 	addKillCmd()
 	addPsCmd()
 	addPatternCmds()
+	addRegroupCmd()
+	addAttachCmd()
+	addEvalCmd()
+	addSignalCmd()
+	addSecretCmd()
+	addUpdateCmd()
 	addInfoCmd()
 	addLogCmd()
+	addEventsCmd()
 	addJoblistCmd()
+	addApplyCmds()
 	addMsgTraceCmd()
 
 	usage := func() {
@@ -1145,11 +2072,16 @@ OPTIONS:
   -l, --loglevel
         loglevel, debug/info/warn/error (default "%s")
   -p, --provider
-        provider ID, run following command on the remote node with this ID (default "%s")
+        provider ID, run following command on the remote node with this ID,
+        or on multiple nodes with wildcard or comma separated IDs (default "%s")
+  --all, --all-providers
+        run following command on all the nodes in scope
+  --timeout
+        per node timeout in seconds when running on multiple nodes (default %d)
   --trace
         Comma seprated messages to be traced, use "gshell mtrace list" to show possbile values
 `
-		fmt.Printf(opt, loglevel, providerID)
+		fmt.Printf(opt, loglevel, providerID, fleetTimeout)
 		fmt.Println("COMMANDS:")
 		for _, cmd := range cmds {
 			name := cmd.Name()
@@ -1198,6 +2130,9 @@ GREs can be grouped into one named GRG for better performance.
 			}
 		}
 		str := args[0]
+		if isFleet() && !fleetCmds[str] {
+			return fmt.Errorf("command %s does not run on multiple providers", str)
+		}
 		for _, cmd := range cmds {
 			if str == strings.Split(cmd.Name(), " ")[0] {
 				cmd.SetOutput(os.Stdout)
@@ -84,14 +84,11 @@ func multiWriter(writers ...io.Writer) io.Writer {
 	return mw
 }
 
-type nullIO struct{}
-
-func (nullIO) Close() error                  { return nil }
-func (nullIO) Write(buf []byte) (int, error) { return len(buf), nil }
-func (nullIO) Read(buf []byte) (int, error)  { return 0, io.EOF }
-
 var gshellTempDir = "/tmp/gshell"
 
+// os.Args is reset for the interpreters, save the executable name before that
+var selfExe = os.Args[0]
+
 func init() {
 	os.MkdirAll(gshellTempDir, 0755)
 	as.RegisterType((*net.DNSError)(nil))
@@ -124,6 +121,9 @@ type httpOperation interface {
 
 var httpOp httpOperation
 
+// serves metrics of the daemon over http until the process exits
+var metricsService func(addr string, gd *daemon)
+
 // save folder in .zip format
 func zipPathToBuffer(path string) ([]byte, error) {
 	fi, err := os.Stat(path)
@@ -156,7 +156,8 @@ func zipPathToBuffer(path string) ([]byte, error) {
 		return data.Bytes(), nil
 	}
 
-	srcDir := path
+	// the same entries with or without the trailing slash, for the code signature
+	srcDir := filepath.Clean(path)
 
 	// Walk through the source directory
 	err = filepath.Walk(srcDir, func(filePath string, info os.FileInfo, err error) error {
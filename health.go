@@ -0,0 +1,150 @@
+package gshellos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/gshellos/stdlib"
+	"github.com/traefik/yaegi/interp"
+)
+
+const (
+	healthIntervalDefault = 10 // in seconds
+	healthCheckTimeout    = 5 * time.Second
+	healthFailMax         = 3 // consecutive failures to be unhealthy
+)
+
+// healthCheck is the parsed health check of a job in one of the forms:
+//
+//	service:publisher/service  the service can be discovered
+//	tcp:host:port              the address can be connected
+//	go:snippet                 the Go snippet evaluates to true, nil error or nothing
+type healthCheck struct {
+	kind   string
+	target string
+	i      *interp.Interpreter // of go kind, with the compiled snippet
+	prog   *interp.Program
+}
+
+func parseHealthCheck(spec string) (*healthCheck, error) {
+	strs := strings.SplitN(spec, ":", 2)
+	if len(strs) != 2 || len(strings.TrimSpace(strs[1])) == 0 {
+		return nil, fmt.Errorf("invalid health check %q: kind:target expected", spec)
+	}
+	hc := &healthCheck{kind: strs[0], target: strings.TrimSpace(strs[1])}
+	switch hc.kind {
+	case "service":
+		if svc := strings.Split(hc.target, "/"); len(svc) != 2 || len(svc[0]) == 0 || len(svc[1]) == 0 {
+			return nil, fmt.Errorf("invalid health check %q: publisher/service expected", spec)
+		}
+	case "tcp":
+		if _, _, err := net.SplitHostPort(hc.target); err != nil {
+			return nil, fmt.Errorf("invalid health check %q: %v", spec, err)
+		}
+	case "go":
+	default:
+		return nil, fmt.Errorf("invalid health check %q: unknown kind %s", spec, hc.kind)
+	}
+	return hc, nil
+}
+
+func (hc *healthCheck) check() error {
+	switch hc.kind {
+	case "service":
+		svc := strings.Split(hc.target, "/")
+		c := as.NewClient().SetDiscoverTimeout(0)
+		conn := <-c.Discover(svc[0], svc[1])
+		if conn == nil {
+			return as.ErrServiceNotFound(svc[0], svc[1])
+		}
+		conn.Close()
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", hc.target, healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	case "go":
+		return hc.evalSnippet()
+	}
+	return nil
+}
+
+// evalSnippet evaluates the snippet in an interpreter with stdlib only, the
+// interpreter is created and the snippet is compiled at the first check then
+// reused by the following checks.
+func (hc *healthCheck) evalSnippet() error {
+	if hc.prog == nil {
+		i := interp.New(interp.Options{})
+		if err := i.Use(stdlib.Symbols); err != nil {
+			return err
+		}
+		prog, err := i.Compile(hc.target)
+		if err != nil {
+			return err
+		}
+		hc.i, hc.prog = i, prog
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	v, err := hc.i.ExecuteWithContext(ctx, hc.prog)
+	if err != nil {
+		return err
+	}
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	switch r := v.Interface().(type) {
+	case bool:
+		if !r {
+			return errors.New("health snippet returned false")
+		}
+	case error:
+		return r
+	}
+	return nil
+}
+
+// healthLoop checks the health of the GRE periodically until ctx is done.
+// It stops the GRE and returns the reason if the GRE is unhealthy and
+// restart on unhealthy applies.
+func (gc *greCtl) healthLoop(ctx context.Context, hc *healthCheck) error {
+	interval := time.Duration(gc.runMsg.HealthInterval) * time.Second
+	if interval == 0 {
+		interval = healthIntervalDefault * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	fails := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		err := hc.check()
+		if err == nil {
+			fails = 0
+			gc.setHealth("ok")
+			gc.changeStatIf(greStatUnhealthy, greStatRunning)
+			continue
+		}
+		fails++
+		gc.setHealth(err.Error())
+		if fails < healthFailMax {
+			continue
+		}
+		gc.changeStatIf(greStatRunning, greStatUnhealthy)
+		if gc.runMsg.HealthRestart && gc.canRestart() {
+			gc.cancel()
+			return fmt.Errorf("unhealthy: %v", err)
+		}
+	}
+}
@@ -10,11 +10,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type urlInfo struct {
@@ -339,6 +341,32 @@ func (httpOperationImpl) getArchive(url string) ([]byte, error) {
 	return hdl.getArchive()
 }
 
+// serveMetrics retries listening on addr for a while in case the port is
+// still held by the daemon being updated.
+func serveMetrics(addr string, gd *daemon) {
+	var lnr net.Listener
+	var err error
+	for i := 0; i < 10; i++ {
+		if lnr, err = net.Listen("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		gd.lg.Errorf("metrics not served: %v", err)
+		return
+	}
+	gd.lg.Infoln("serving metrics at:", lnr.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		gd.writeMetrics(w)
+	})
+	gd.lg.Errorf("metrics server exited: %v", http.Serve(lnr, mux))
+}
+
 func init() {
 	httpOp = httpOperationImpl{}
+	metricsService = serveMetrics
 }
@@ -0,0 +1,426 @@
+package gshellos
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	as "github.com/godevsig/adaptiveservice"
+	"gopkg.in/yaml.v3"
+)
+
+// joblistFile is the joblist file as written by user, it can include other
+// joblist files, define variables used in the jobs and override the jobs
+// for some providers or arches.
+type joblistFile struct {
+	Include   []string           `yaml:"include,omitempty"` // relative to the dir of the including file
+	Vars      map[string]string  `yaml:"vars,omitempty"`
+	GRGs      []grgJoblist       `yaml:"grgs,omitempty"`
+	Overrides []*joblistOverride `yaml:"overrides,omitempty"`
+}
+
+// joblistOverride applies to the target node if both provider and arch,
+// when given, match.
+type joblistOverride struct {
+	Provider string            `yaml:"provider,omitempty"` // provider ID pattern
+	Arch     string            `yaml:"arch,omitempty"`
+	Vars     map[string]string `yaml:"vars,omitempty"`
+	GRGs     []grgJoblist      `yaml:"grgs,omitempty"`
+}
+
+type nodeInfo struct {
+	ProviderID string
+	Arch       string
+}
+
+// reply *nodeInfo
+type cmdNodeInfo struct{}
+
+func (msg cmdNodeInfo) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleReadOnly, "info"); err != nil {
+		return err
+	}
+	selfID, err := getSelfID()
+	if err != nil {
+		return err
+	}
+	return &nodeInfo{selfID, runtime.GOARCH}
+}
+
+// queryNodeInfo returns the func that asks the daemon behind conn for its node info.
+func queryNodeInfo(conn as.Connection) func() (*nodeInfo, error) {
+	return func() (*nodeInfo, error) {
+		var node *nodeInfo
+		if err := conn.SendRecv(cmdNodeInfo{}, &node); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+}
+
+type filePos struct {
+	file string
+	line int
+}
+
+func (pos filePos) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("parse joblist %s error: line %d: %s", pos.file, pos.line, fmt.Sprintf(format, a...))
+}
+
+type joblistLoader struct {
+	pos     map[*JobInfo]filePos
+	loading map[string]bool // the files being loaded, to find include cycle
+}
+
+var (
+	yamlUnknownField = regexp.MustCompile(`field (\S+) not found in type \S+`)
+	yamlGoType       = regexp.MustCompile(`into \S*gshellos\.`)
+)
+
+// yamlError turns the yaml decoding error to user readable one.
+func yamlError(err error) string {
+	var terr *yaml.TypeError
+	if !errors.As(err, &terr) {
+		return strings.TrimPrefix(err.Error(), "yaml: ")
+	}
+	msgs := make([]string, len(terr.Errors))
+	for i, msg := range terr.Errors {
+		msg = yamlUnknownField.ReplaceAllString(msg, "unknown key $1")
+		msgs[i] = yamlGoType.ReplaceAllString(msg, "into ")
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// mapValue returns the value node of the key in the mapping node.
+func mapValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// seqItem returns the ith item node of the sequence node.
+func seqItem(node *yaml.Node, i int) *yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+		return nil
+	}
+	return node.Content[i]
+}
+
+func nodeLine(node *yaml.Node, parent *yaml.Node) int {
+	if node != nil {
+		return node.Line
+	}
+	if parent != nil {
+		return parent.Line
+	}
+	return 0
+}
+
+// markGRGs records the position of the jobs and checks the grg names.
+func (l *joblistLoader) markGRGs(file string, grgs []grgJoblist, node *yaml.Node) error {
+	names := make(map[string]bool)
+	for i, grg := range grgs {
+		grgNode := seqItem(node, i)
+		pos := filePos{file, nodeLine(grgNode, node)}
+		if len(grg.Name) == 0 {
+			return pos.errorf("empty grg name")
+		}
+		if names[grg.Name] {
+			return pos.errorf("duplicated grg entry %s", grg.Name)
+		}
+		names[grg.Name] = true
+		jobsNode := mapValue(grgNode, "jobs")
+		for j, job := range grg.Jobs {
+			if job == nil {
+				return pos.errorf("empty job in grg %s", grg.Name)
+			}
+			l.pos[job] = filePos{file, nodeLine(seqItem(jobsNode, j), grgNode)}
+		}
+	}
+	return nil
+}
+
+// load reads the joblist file and the files it includes, the result has
+// the included files merged but not the overrides.
+func (l *joblistLoader) load(file string) (*joblistFile, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	if l.loading[abs] {
+		return nil, fmt.Errorf("parse joblist %s error: include cycle", file)
+	}
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var jf joblistFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&jf); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parse joblist %s error: %s", file, yamlError(err))
+	}
+	var doc yaml.Node
+	yaml.Unmarshal(data, &doc)
+	root := &doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) != 0 {
+		root = root.Content[0]
+	}
+
+	if err := l.markGRGs(file, jf.GRGs, mapValue(root, "grgs")); err != nil {
+		return nil, err
+	}
+	ovsNode := mapValue(root, "overrides")
+	for i, ov := range jf.Overrides {
+		ovNode := seqItem(ovsNode, i)
+		pos := filePos{file, nodeLine(ovNode, ovsNode)}
+		if ov == nil || len(ov.Provider) == 0 && len(ov.Arch) == 0 {
+			return nil, pos.errorf("override with neither provider nor arch")
+		}
+		if _, err := path.Match(ov.Provider, ""); err != nil {
+			return nil, pos.errorf("wrong provider pattern %s", ov.Provider)
+		}
+		if err := l.markGRGs(file, ov.GRGs, mapValue(ovNode, "grgs")); err != nil {
+			return nil, err
+		}
+	}
+
+	merged := &joblistFile{Vars: make(map[string]string)}
+	for _, inc := range jf.Include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(file), inc)
+		}
+		ijf, err := l.load(inc)
+		if err != nil {
+			return nil, err
+		}
+		merged.merge(ijf.Vars, ijf.GRGs)
+		merged.Overrides = append(merged.Overrides, ijf.Overrides...)
+	}
+	merged.merge(jf.Vars, jf.GRGs)
+	merged.Overrides = append(merged.Overrides, jf.Overrides...)
+	return merged, nil
+}
+
+// jobKey returns the name the job is known by before its cmd is expanded.
+func jobKey(job *JobInfo) string {
+	if len(job.Name) != 0 {
+		return job.Name
+	}
+	fields := strings.Fields(job.Cmd)
+	if len(fields) == 0 {
+		return ""
+	}
+	return codeName(fields[0])
+}
+
+// merge adds the vars and the grgs to jf. The grg of the same name is
+// merged: non-zero rt-priority and max-procs replace the old ones, a job
+// replaces the old job of the same name or is added.
+func (jf *joblistFile) merge(vars map[string]string, grgs []grgJoblist) {
+	for k, v := range vars {
+		jf.Vars[k] = v
+	}
+	for _, grg := range grgs {
+		var dst *grgJoblist
+		for i := range jf.GRGs {
+			if jf.GRGs[i].Name == grg.Name {
+				dst = &jf.GRGs[i]
+				break
+			}
+		}
+		if dst == nil {
+			grg.Jobs = append([]*JobInfo(nil), grg.Jobs...)
+			jf.GRGs = append(jf.GRGs, grg)
+			continue
+		}
+		if grg.RtPriority != 0 {
+			dst.RtPriority = grg.RtPriority
+		}
+		if grg.Maxprocs != 0 {
+			dst.Maxprocs = grg.Maxprocs
+		}
+		limits := grg.ResourceLimits
+		limits.merge(dst.ResourceLimits)
+		dst.ResourceLimits = limits
+		n := len(dst.Jobs)
+		replaced := make([]bool, n)
+		for _, job := range grg.Jobs {
+			found := false
+			for i := 0; i < n; i++ {
+				if !replaced[i] && jobKey(dst.Jobs[i]) == jobKey(job) {
+					dst.Jobs[i] = job
+					replaced[i] = true
+					found = true
+					break
+				}
+			}
+			if !found {
+				dst.Jobs = append(dst.Jobs, job)
+			}
+		}
+	}
+}
+
+var joblistVar = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// readJoblist reads and validates the joblist file for the target node,
+// the node info is only queried if the joblist has overrides or uses
+// the builtin variables.
+func readJoblist(file string, target func() (*nodeInfo, error)) (*joblist, error) {
+	l := &joblistLoader{pos: make(map[*JobInfo]filePos), loading: make(map[string]bool)}
+	jf, err := l.load(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var node *nodeInfo
+	getNode := func() (*nodeInfo, error) {
+		if node == nil {
+			n, err := target()
+			if err != nil {
+				return nil, fmt.Errorf("get target node info error: %v", err)
+			}
+			node = n
+		}
+		return node, nil
+	}
+
+	for _, ov := range jf.Overrides {
+		n, err := getNode()
+		if err != nil {
+			return nil, err
+		}
+		if len(ov.Provider) != 0 {
+			if matched, _ := path.Match(ov.Provider, n.ProviderID); !matched {
+				continue
+			}
+		}
+		if len(ov.Arch) != 0 && ov.Arch != n.Arch {
+			continue
+		}
+		jf.merge(ov.Vars, ov.GRGs)
+	}
+
+	expand := func(s string) (string, error) {
+		var err error
+		s = joblistVar.ReplaceAllStringFunc(s, func(ref string) string {
+			name := joblistVar.FindStringSubmatch(ref)[1]
+			if v, has := jf.Vars[name]; has {
+				return v
+			}
+			if name == "PROVIDER" || name == "ARCH" {
+				n, nerr := getNode()
+				if nerr != nil {
+					err = nerr
+					return ref
+				}
+				if name == "PROVIDER" {
+					return n.ProviderID
+				}
+				return n.Arch
+			}
+			if err == nil {
+				err = fmt.Errorf("undefined variable %s", name)
+			}
+			return ref
+		})
+		return s, err
+	}
+
+	// back to bytecode
+	for _, grg := range jf.GRGs {
+		for _, job := range grg.Jobs {
+			pos := l.pos[job]
+			if len(job.CodeZipBase64) != 0 {
+				data, err := base64.StdEncoding.DecodeString(job.CodeZipBase64)
+				if err != nil {
+					return nil, pos.errorf("%v", err)
+				}
+				job.CodeZipBase64 = ""
+				job.CodeZip = data
+			}
+			for _, s := range append([]*string{&job.Cmd, &job.Workdir}, stringPtrs(job.Env)...) {
+				if *s, err = expand(*s); err != nil {
+					return nil, pos.errorf("%v", err)
+				}
+			}
+			job.Args = strings.Fields(job.Cmd)
+			if len(job.Args) == 0 {
+				return nil, pos.errorf("empty job")
+			}
+			if err := job.ResourceLimits.validate(); err != nil {
+				return nil, pos.errorf("%v", err)
+			}
+			if len(job.Schedule) != 0 {
+				if _, err := parseCron(job.Schedule); err != nil {
+					return nil, pos.errorf("%v", err)
+				}
+			}
+			if len(job.HealthCheck) != 0 {
+				if _, err := parseHealthCheck(job.HealthCheck); err != nil {
+					return nil, pos.errorf("%v", err)
+				}
+			}
+			if err := job.RestartPolicy.validate(); err != nil {
+				return nil, pos.errorf("%v", err)
+			}
+			if err := job.LogRotation.validate(); err != nil {
+				return nil, pos.errorf("%v", err)
+			}
+			if err := validateEnv(job.Env); err != nil {
+				return nil, pos.errorf("%v", err)
+			}
+			if err := validateSecretNames(job.Secrets); err != nil {
+				return nil, pos.errorf("%v", err)
+			}
+			job.Cmd = ""
+		}
+	}
+
+	for i := range jf.GRGs {
+		if err := jf.GRGs[i].ResourceLimits.validate(); err != nil {
+			return nil, fmt.Errorf("parse joblist %s error: grg %s: %v", file, jf.GRGs[i].Name, err)
+		}
+		if _, err := jf.GRGs[i].limits(); err != nil {
+			return nil, fmt.Errorf("parse joblist %s error: %v", file, err)
+		}
+	}
+
+	jlist := &joblist{GRGs: jf.GRGs}
+	if _, err := jlist.sortJobs(); err != nil {
+		return nil, fmt.Errorf("parse joblist %s error: %v", file, err)
+	}
+	return jlist, nil
+}
+
+func stringPtrs(ss []string) []*string {
+	ptrs := make([]*string, len(ss))
+	for i := range ss {
+		ptrs[i] = &ss[i]
+	}
+	return ptrs
+}
+
+func init() {
+	as.RegisterType(cmdNodeInfo{})
+	as.RegisterType((*nodeInfo)(nil))
+}
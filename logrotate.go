@@ -0,0 +1,271 @@
+package gshellos
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// LogRotation is the rotation settings of log files, no rotation if MaxSize is not set.
+type LogRotation struct {
+	MaxSize  string `yaml:"log-max-size,omitempty"`  // rotate the file when it exceeds the size, K/M/G suffix supported
+	MaxFiles int    `yaml:"log-max-files,omitempty"` // number of rotated files to keep, 1 by default
+	Compress bool   `yaml:"log-compress,omitempty"`  // gzip the rotated files
+}
+
+// merge fills the unset fields of lr with those in other.
+func (lr *LogRotation) merge(other LogRotation) {
+	if len(lr.MaxSize) == 0 {
+		lr.MaxSize = other.MaxSize
+	}
+	if lr.MaxFiles == 0 {
+		lr.MaxFiles = other.MaxFiles
+	}
+	lr.Compress = lr.Compress || other.Compress
+}
+
+func (lr LogRotation) validate() error {
+	if len(lr.MaxSize) != 0 {
+		if _, err := parseSize(lr.MaxSize); err != nil {
+			return fmt.Errorf("wrong log max size: %v", err)
+		}
+	}
+	if lr.MaxFiles < 0 {
+		return errors.New("wrong log max files")
+	}
+	return nil
+}
+
+// addFlags adds the command line flags of the settings to cmd.
+func (lr *LogRotation) addFlags(cmd *flag.FlagSet, what string) {
+	cmd.StringVar(&lr.MaxSize, "log-max-size", "", "rotate "+what+" when it exceeds the size, e.g. 1M")
+	cmd.IntVar(&lr.MaxFiles, "log-max-files", 0, "number of rotated files to keep for "+what+", 1 if not specified")
+	cmd.BoolVar(&lr.Compress, "log-compress", false, "gzip the rotated files of "+what)
+}
+
+// args returns the settings in command line flags.
+func (lr LogRotation) args() []string {
+	var args []string
+	if len(lr.MaxSize) != 0 {
+		args = append(args, "-log-max-size", lr.MaxSize)
+	}
+	if lr.MaxFiles != 0 {
+		args = append(args, "-log-max-files", strconv.Itoa(lr.MaxFiles))
+	}
+	if lr.Compress {
+		args = append(args, "-log-compress")
+	}
+	return args
+}
+
+// logFile is an appending file that rotates itself by the settings.
+// It is safe for multiple processes to write the same log file.
+type logFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64 // 0 means no rotation
+	maxFiles int
+	compress bool
+	f        *os.File
+}
+
+func openLogFile(path string, lr LogRotation) (*logFile, error) {
+	maxSize, _ := parseSize(lr.MaxSize)
+	lf := &logFile{path: path, maxSize: maxSize, maxFiles: lr.MaxFiles, compress: lr.Compress}
+	if lf.maxFiles <= 0 {
+		lf.maxFiles = 1
+	}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *logFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(lf.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(lf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	lf.f = f
+	return nil
+}
+
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := lf.f.Write(p)
+	if err == nil && lf.maxSize > 0 {
+		if fi, err := lf.f.Stat(); err == nil && fi.Size() >= lf.maxSize {
+			lf.rotate()
+		}
+	}
+	return n, err
+}
+
+func (lf *logFile) Close() error {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
+
+// rotate renames the file to path.1 and shifts the older ones, rotations
+// from different processes are serialized by the lock of the directory.
+func (lf *logFile) rotate() {
+	dir, err := os.Open(filepath.Dir(lf.path))
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	if err := syscall.Flock(int(dir.Fd()), syscall.LOCK_EX); err != nil {
+		return
+	}
+	defer syscall.Flock(int(dir.Fd()), syscall.LOCK_UN)
+
+	// the file may have been rotated by another process
+	cur, err1 := lf.f.Stat()
+	fi, err2 := os.Stat(lf.path)
+	if err1 == nil && err2 == nil && os.SameFile(cur, fi) && fi.Size() >= lf.maxSize {
+		for i := lf.maxFiles; i > 0; i-- {
+			for _, ext := range []string{"", ".gz"} {
+				old := fmt.Sprintf("%s.%d%s", lf.path, i, ext)
+				if i == lf.maxFiles {
+					os.Remove(old)
+				} else {
+					os.Rename(old, fmt.Sprintf("%s.%d%s", lf.path, i+1, ext))
+				}
+			}
+		}
+		os.Rename(lf.path, lf.path+".1")
+		if lf.compress {
+			gzipFile(lf.path + ".1")
+		}
+	}
+
+	lf.f.Close()
+	lf.f = nil
+	lf.open()
+}
+
+// gzipFile compresses file to file.gz and removes file.
+func gzipFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(file + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// logSegments returns the rotated files of the log file, the oldest first.
+func logSegments(path string) []string {
+	files, _ := filepath.Glob(path + ".[0-9]*")
+	num := func(file string) int {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(file, path+"."), ".gz")
+		i, err := strconv.Atoi(suffix)
+		if err != nil {
+			return -1
+		}
+		return i
+	}
+	var segments []string
+	for _, file := range files {
+		if num(file) > 0 {
+			segments = append(segments, file)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return num(segments[i]) > num(segments[j]) })
+	return segments
+}
+
+// readLogSegment reads the rotated file, decompressed if gzipped.
+func readLogSegment(file string) ([]byte, error) {
+	if !strings.HasSuffix(file, ".gz") {
+		return os.ReadFile(file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// removeLogFiles removes the log file and its rotated files.
+func removeLogFiles(path string) {
+	os.Remove(path)
+	for _, file := range logSegments(path) {
+		os.Remove(file)
+	}
+}
+
+// followFile reads the log file and switches to the new file once it is rotated.
+type followFile struct {
+	path string
+	f    *os.File
+}
+
+func (ff *followFile) Read(p []byte) (int, error) {
+	n, err := ff.f.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	fi, err1 := os.Stat(ff.path)
+	cur, err2 := ff.f.Stat()
+	if err1 != nil || err2 != nil || os.SameFile(fi, cur) {
+		return n, err
+	}
+	f, err3 := os.Open(ff.path)
+	if err3 != nil {
+		return n, err
+	}
+	ff.f.Close()
+	ff.f = f
+	if n != 0 {
+		return n, nil
+	}
+	return ff.f.Read(p)
+}
+
+func (ff *followFile) Close() error {
+	return ff.f.Close()
+}
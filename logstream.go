@@ -0,0 +1,128 @@
+package gshellos
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// log lines of GREs are prefixed with the same timestamp format as the daemon and grg logs
+const logTimeFormat = "[2006/01/02 15:04:05.000000]"
+
+// lineStamper prefixes each line written to w with the current time.
+type lineStamper struct {
+	sync.Mutex
+	w       io.Writer
+	midLine bool // the last write did not end with newline
+}
+
+func newLineStamper(w io.Writer) *lineStamper {
+	return &lineStamper{w: w}
+}
+
+func (ls *lineStamper) Write(p []byte) (int, error) {
+	ls.Lock()
+	defer ls.Unlock()
+	stamp := time.Now().AppendFormat(nil, logTimeFormat+" ")
+	var buf []byte
+	for rest := p; len(rest) != 0; {
+		if !ls.midLine {
+			buf = append(buf, stamp...)
+		}
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		buf = append(buf, line...)
+		rest = rest[len(line):]
+		ls.midLine = line[len(line)-1] != '\n'
+	}
+	if _, err := ls.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type logLine struct {
+	time time.Time
+	text []byte // including the newline
+}
+
+// splitLogLines splits the log into lines, the line without timestamp
+// inherits that of the previous line.
+func splitLogLines(data []byte) []logLine {
+	var lines []logLine
+	var t time.Time
+	for len(data) != 0 {
+		text := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			text = data[:i+1]
+		}
+		data = data[len(text):]
+		if len(text) >= len(logTimeFormat) && text[0] == '[' {
+			if lt, err := time.ParseInLocation(logTimeFormat, string(text[:len(logTimeFormat)]), time.Local); err == nil {
+				t = lt
+			}
+		}
+		lines = append(lines, logLine{t, text})
+	}
+	return lines
+}
+
+// mergeLogLines merges the lines of two logs in time order.
+func mergeLogLines(a, b []logLine) []logLine {
+	lines := make([]logLine, 0, len(a)+len(b))
+	for len(a) != 0 && len(b) != 0 {
+		if b[0].time.Before(a[0].time) {
+			lines = append(lines, b[0])
+			b = b[1:]
+		} else {
+			lines = append(lines, a[0])
+			a = a[1:]
+		}
+	}
+	lines = append(lines, a...)
+	return append(lines, b...)
+}
+
+// filterLogLines returns the lines since the time, and then the last tail lines if tail > 0.
+func filterLogLines(lines []logLine, since time.Time, tail int) []byte {
+	if !isZeroTime(since) {
+		i := 0
+		for i < len(lines) && lines[i].time.Before(since) {
+			i++
+		}
+		lines = lines[i:]
+	}
+	if tail > 0 && tail < len(lines) {
+		lines = lines[len(lines)-tail:]
+	}
+	var buf []byte
+	for _, line := range lines {
+		buf = append(buf, line.text...)
+	}
+	return buf
+}
+
+// readLogFile reads the log file, and the rotated files before it if withSegments.
+// A log file not existing is not an error if optional.
+func readLogFile(path string, withSegments, optional bool) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil && !(optional && os.IsNotExist(err)) {
+		return nil, err
+	}
+	if !withSegments {
+		return buf, nil
+	}
+	var all []byte
+	for _, segment := range logSegments(path) {
+		data, err := readLogSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, data...)
+	}
+	return append(all, buf...), nil
+}
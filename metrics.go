@@ -0,0 +1,180 @@
+package gshellos
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+)
+
+// connStat counts the connections of a service.
+type connStat struct {
+	Current int64
+	Total   int64
+}
+
+func (cs *connStat) onConnect(as.Netconn) bool {
+	atomic.AddInt64(&cs.Current, 1)
+	atomic.AddInt64(&cs.Total, 1)
+	return false
+}
+
+func (cs *connStat) onDisconnect(as.Netconn) {
+	atomic.AddInt64(&cs.Current, -1)
+}
+
+func (cs *connStat) load() connStat {
+	return connStat{atomic.LoadInt64(&cs.Current), atomic.LoadInt64(&cs.Total)}
+}
+
+const clockTicks = 100 // USER_HZ on almost all linux systems
+
+// procStat reads the cpu time in seconds and the resident memory in bytes of the process.
+func procStat(pid int) (cpu float64, rss int64, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// comm may contain spaces, fields start from state after the last ')'
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 || i+2 > len(data) {
+		return 0, 0, fmt.Errorf("wrong format of /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+2:]))
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("wrong format of /proc/%d/stat", pid)
+	}
+	utime, _ := strconv.ParseFloat(fields[11], 64)
+	stime, _ := strconv.ParseFloat(fields[12], 64)
+	pages, _ := strconv.ParseInt(fields[21], 10, 64)
+	return (utime + stime) / clockTicks, pages * int64(os.Getpagesize()), nil
+}
+
+type metricFamily struct {
+	name    string
+	typ     string
+	help    string
+	samples []string
+}
+
+// metricSet builds metrics in Prometheus text exposition format.
+type metricSet struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// add adds a sample, labels are in key value pairs.
+func (ms *metricSet) add(name, typ, help string, value float64, labels ...string) {
+	if ms.byName == nil {
+		ms.byName = make(map[string]*metricFamily)
+	}
+	mf := ms.byName[name]
+	if mf == nil {
+		mf = &metricFamily{name: name, typ: typ, help: help}
+		ms.byName[name] = mf
+		ms.families = append(ms.families, mf)
+	}
+
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) != 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	mf.samples = append(mf.samples, b.String())
+}
+
+func (ms *metricSet) writeTo(w io.Writer) {
+	for _, mf := range ms.families {
+		fmt.Fprintf(w, "# HELP %s %s\n", mf.name, mf.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", mf.name, mf.typ)
+		for _, sample := range mf.samples {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeMetrics writes the metrics of the daemon, GRGs and GREs.
+func (gd *daemon) writeMetrics(w io.Writer) {
+	ms := &metricSet{}
+	ms.add("gshell_daemon_info", "gauge", "Version of gshell daemon.", 1, "version", version, "commit", commitRev)
+	if cpu, rss, err := procStat(os.Getpid()); err == nil {
+		ms.add("gshell_daemon_cpu_seconds_total", "counter", "CPU time of gshell daemon in seconds.", cpu)
+		ms.add("gshell_daemon_resident_memory_bytes", "gauge", "Resident memory of gshell daemon in bytes.", float64(rss))
+	}
+	conns := gd.conns.load()
+	ms.add("gshell_daemon_connections", "gauge", "Current connections to gshell daemon service.", float64(conns.Current))
+	ms.add("gshell_daemon_connections_total", "counter", "Connections accepted by gshell daemon service.", float64(conns.Total))
+
+	var ggis []*grgGREInfo
+	c := as.NewClient(as.WithLogger(gd.lg), as.WithScope(as.ScopeOS)).SetDiscoverTimeout(0)
+	connChan := c.Discover(godevsigPublisher, "grg-*")
+	for conn := range connChan {
+		var ggi *grgGREInfo
+		conn.SetRecvTimeout(time.Second)
+		if err := conn.SendRecv(&grgCmdQuery{}, &ggi); err != nil {
+			gd.lg.Warnf("writeMetrics: send recv error: %v", err)
+		} else {
+			ggis = append(ggis, ggi)
+		}
+		conn.Close()
+	}
+	sort.Slice(ggis, func(i, j int) bool { return ggis[i].Name < ggis[j].Name })
+
+	for _, ggi := range ggis {
+		grg := ggi.Name
+		if pi := ggi.Process; pi != nil {
+			ms.add("gshell_grg_pid", "gauge", "Process ID of the GRG.", float64(pi.pid), "grg", grg)
+			ms.add("gshell_grg_rt_priority", "gauge", "SCHED_RR priority of the GRG, 0 if not real-time.", float64(pi.rtPriority), "grg", grg)
+			ms.add("gshell_grg_maxprocs", "gauge", "GOMAXPROCS of the GRG, 0 if not set.", float64(pi.maxProcs), "grg", grg)
+			if cpu, rss, err := procStat(pi.pid); err == nil {
+				ms.add("gshell_grg_cpu_seconds_total", "counter", "CPU time of the GRG in seconds.", cpu, "grg", grg)
+				ms.add("gshell_grg_resident_memory_bytes", "gauge", "Resident memory of the GRG in bytes.", float64(rss), "grg", grg)
+			}
+		}
+		ms.add("gshell_grg_connections", "gauge", "Current connections to the GRG service.", float64(ggi.Conns.Current), "grg", grg)
+		ms.add("gshell_grg_connections_total", "counter", "Connections accepted by the GRG service.", float64(ggi.Conns.Total), "grg", grg)
+		ms.add("gshell_grg_gres", "gauge", "Number of GREs in the GRG.", float64(len(ggi.GREInfos)), "grg", grg)
+
+		for _, gi := range ggi.GREInfos {
+			labels := []string{"grg", grg, "greid", gi.ID, "name", gi.Name}
+			for _, stat := range greStatString {
+				ms.add("gshell_gre_state", "gauge", "Current state of the GRE, 1 for the state it is in.",
+					boolValue(gi.Stat == stat), append(labels, "state", stat)...)
+			}
+			uptime := 0.0
+			if gi.Stat == greStatString[greStatRunning] || gi.Stat == greStatString[greStatUnhealthy] {
+				uptime = time.Since(gi.StartTime).Seconds()
+			}
+			ms.add("gshell_gre_uptime_seconds", "gauge", "Seconds since the running GRE started, 0 if not running.", uptime, labels...)
+			ms.add("gshell_gre_restarts_total", "counter", "Times the GRE has been auto restarted.", float64(gi.RestartedNum), labels...)
+			ms.add("gshell_gre_error", "gauge", "1 if the GRE exited with error in its last run.", boolValue(len(gi.GREErr) != 0), labels...)
+		}
+	}
+
+	ms.writeTo(w)
+}
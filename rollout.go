@@ -0,0 +1,313 @@
+package gshellos
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	"gopkg.in/yaml.v3"
+)
+
+// rolloutConfig controls which daemons the updater hands the new version to,
+// it is kept in rollout.yaml of the work dir of the root registry.
+type rolloutConfig struct {
+	Paused  bool              `yaml:"paused"`
+	Percent int               `yaml:"percent"`         // of the providers selected by the hash of the provider ID
+	Allow   []string          `yaml:"allow,omitempty"` // providers always selected
+	Holds   map[string]string `yaml:"holds,omitempty"` // provider ID: held back until the new version is the rev
+}
+
+// providerRev is what the provider reported in its last tryUpdate.
+type providerRev struct {
+	ProviderID string    `yaml:"provider-id"`
+	Rev        string    `yaml:"rev"`
+	Arch       string    `yaml:"arch"`
+	LastSeen   time.Time `yaml:"last-seen"`
+	Key        string    `yaml:"key"` // base64 node key the reports are signed with, kept since first seen
+}
+
+type rollout struct {
+	sync.Mutex
+	file          string
+	providersFile string
+	cfg           *rolloutConfig
+	providers     map[string]*providerRev
+}
+
+func newRollout(workDir string) (*rollout, error) {
+	ro := &rollout{
+		file:          filepath.Join(workDir, "rollout.yaml"),
+		providersFile: filepath.Join(workDir, "rollout.providers.yaml"),
+		cfg:           &rolloutConfig{Percent: 100},
+		providers:     make(map[string]*providerRev),
+	}
+	if data, err := os.ReadFile(ro.providersFile); err == nil {
+		var providers []*providerRev
+		if err := yaml.Unmarshal(data, &providers); err != nil {
+			return nil, fmt.Errorf("parse %s error: %v", ro.providersFile, err)
+		}
+		for _, pr := range providers {
+			ro.providers[pr.ProviderID] = pr
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	data, err := os.ReadFile(ro.file)
+	if os.IsNotExist(err) {
+		return ro, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, ro.cfg); err != nil {
+		return nil, fmt.Errorf("parse %s error: %v", ro.file, err)
+	}
+	if err := validatePercent(ro.cfg.Percent); err != nil {
+		return nil, fmt.Errorf("parse %s error: %v", ro.file, err)
+	}
+	return ro, nil
+}
+
+func validatePercent(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("wrong percent %d, 0 to 100 expected", percent)
+	}
+	return nil
+}
+
+// save must be called with lock held.
+func (ro *rollout) save() error {
+	return writeYAML(ro.file, ro.cfg)
+}
+
+// saveProviders must be called with lock held.
+func (ro *rollout) saveProviders() error {
+	providers := make([]*providerRev, 0, len(ro.providers))
+	for _, pr := range ro.providers {
+		providers = append(providers, pr)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].ProviderID < providers[j].ProviderID })
+	return writeYAML(ro.providersFile, providers)
+}
+
+func writeYAML(file string, v interface{}) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// bucket maps the provider ID to a stable number in [0, 100).
+func bucket(providerID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(providerID))
+	return int(h.Sum32() % 100)
+}
+
+// selected must be called with lock held.
+func (ro *rollout) selected(providerID string) bool {
+	for _, id := range ro.cfg.Allow {
+		if id == providerID {
+			return true
+		}
+	}
+	return bucket(providerID) < ro.cfg.Percent
+}
+
+// seen records the report of the provider signed with key, the provider is
+// then known by the key and the reports signed with other keys are rejected.
+func (ro *rollout) seen(providerID, rev, arch string, key ed25519.PublicKey) error {
+	ro.Lock()
+	defer ro.Unlock()
+	keyStr := base64.StdEncoding.EncodeToString(key)
+	if pr, has := ro.providers[providerID]; has && len(pr.Key) != 0 && pr.Key != keyStr {
+		return fmt.Errorf("provider %s reported with another key", providerID)
+	}
+	ro.providers[providerID] = &providerRev{providerID, rev, arch, time.Now(), keyStr}
+	return ro.saveProviders()
+}
+
+// admit returns nil if the provider is allowed to update to revNew, the
+// provider ID is empty if not verified.
+// The root registry updates first whatever the selection is, because other
+// daemons only update after the root registry runs the latest version.
+func (ro *rollout) admit(providerID, revNew string, root bool) error {
+	ro.Lock()
+	defer ro.Unlock()
+	if ro.cfg.Paused {
+		return ErrNoUpdate
+	}
+	if len(providerID) == 0 { // only when all are selected
+		if ro.cfg.Percent != 100 || len(ro.cfg.Holds) != 0 {
+			return ErrNoUpdate
+		}
+		return nil
+	}
+	if hold, has := ro.cfg.Holds[providerID]; has {
+		if hold != revNew {
+			return ErrNoUpdate
+		}
+		return nil
+	}
+	if !root && !ro.selected(providerID) {
+		return ErrNoUpdate
+	}
+	return nil
+}
+
+// state returns the rollout state of the provider for the status view.
+// Must be called with lock held.
+func (ro *rollout) state(pr *providerRev, revNew string) string {
+	if pr.Rev == revNew {
+		return "latest"
+	}
+	if ro.cfg.Paused {
+		return "paused"
+	}
+	if hold, has := ro.cfg.Holds[pr.ProviderID]; has {
+		if hold != revNew {
+			return "held until " + hold
+		}
+		return "pending"
+	}
+	if ro.selected(pr.ProviderID) {
+		return "pending"
+	}
+	return "held"
+}
+
+type rolloutStatus struct {
+	RevNew    string
+	Paused    bool
+	Percent   int
+	Allow     []string
+	Providers []*providerStatus
+}
+
+type providerStatus struct {
+	providerRev
+	State string
+}
+
+// reply with *rolloutStatus or error
+type updateStatus struct{}
+
+func (msg updateStatus) Handle(stream as.ContextStream) (reply interface{}) {
+	updtr := stream.GetContext().(*updater)
+	rev, err := httpOp.readFile(updtr.url + "/rev")
+	if err != nil {
+		return err
+	}
+	revNew := strings.TrimSpace(string(rev))
+
+	ro := updtr.rollout
+	ro.Lock()
+	defer ro.Unlock()
+	rs := &rolloutStatus{RevNew: revNew, Paused: ro.cfg.Paused, Percent: ro.cfg.Percent, Allow: ro.cfg.Allow}
+	for _, pr := range ro.providers {
+		rs.Providers = append(rs.Providers, &providerStatus{*pr, ro.state(pr, revNew)})
+	}
+	sort.Slice(rs.Providers, func(i, j int) bool { return rs.Providers[i].ProviderID < rs.Providers[j].ProviderID })
+	return rs
+}
+
+// reply OK or error
+// Only accepted from the root registry node.
+type updateControl struct {
+	Cmd        string // pause, resume, rollout, hold, unhold or forget
+	Percent    int
+	Allow      []string
+	ProviderID string
+	Rev        string
+}
+
+func (msg *updateControl) Handle(stream as.ContextStream) (reply interface{}) {
+	updtr := stream.GetContext().(*updater)
+	if !isLocal(stream.GetNetconn()) {
+		return errors.New("permission denied: update " + msg.Cmd + " only allowed on the root registry node")
+	}
+
+	if msg.Cmd == "forget" {
+		if err := updtr.forget(stream.GetNetconn(), msg.ProviderID); err != nil {
+			return err
+		}
+		return as.OK
+	}
+
+	ro := updtr.rollout
+	ro.Lock()
+	defer ro.Unlock()
+	switch msg.Cmd {
+	case "pause":
+		ro.cfg.Paused = true
+	case "resume":
+		ro.cfg.Paused = false
+	case "rollout":
+		if err := validatePercent(msg.Percent); err != nil {
+			return err
+		}
+		ro.cfg.Percent = msg.Percent
+		ro.cfg.Allow = msg.Allow
+	case "hold":
+		if len(msg.ProviderID) == 0 || len(msg.Rev) == 0 {
+			return errors.New("provider ID and rev expected")
+		}
+		if ro.cfg.Holds == nil {
+			ro.cfg.Holds = make(map[string]string)
+		}
+		ro.cfg.Holds[msg.ProviderID] = msg.Rev
+	case "unhold":
+		delete(ro.cfg.Holds, msg.ProviderID)
+	default:
+		return fmt.Errorf("unknown update command %s", msg.Cmd)
+	}
+	if err := ro.save(); err != nil {
+		return err
+	}
+	updtr.lg.Infof("update %s: %+v", msg.Cmd, *ro.cfg)
+	return as.OK
+}
+
+// forget removes the provider with its key, the next report of the provider
+// is then trusted with whatever key it is signed with.
+func (updtr *updater) forget(netconn as.Netconn, providerID string) error {
+	caller := updtr.access.caller(netconn)
+	if role := updtr.access.role(caller); role < roleAdmin {
+		updtr.access.auditf("denied: update forget %s from %s as %s, %s required", providerID, caller, roleNames[role], roleNames[roleAdmin])
+		return fmt.Errorf("permission denied: update forget requires %s role", roleNames[roleAdmin])
+	}
+
+	ro := updtr.rollout
+	ro.Lock()
+	defer ro.Unlock()
+	if _, has := ro.providers[providerID]; !has {
+		return fmt.Errorf("provider %s not found", providerID)
+	}
+	delete(ro.providers, providerID)
+	if err := ro.saveProviders(); err != nil {
+		return err
+	}
+	updtr.access.auditf("update forget %s by %s", providerID, caller)
+	updtr.lg.Infof("update forget: provider %s", providerID)
+	return nil
+}
+
+func init() {
+	as.RegisterType(updateStatus{})
+	as.RegisterType((*updateControl)(nil))
+	as.RegisterType((*rolloutStatus)(nil))
+}
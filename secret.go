@@ -0,0 +1,468 @@
+package gshellos
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+)
+
+// the package through which the GRE reads the secrets
+const secretPkgPath = "github.com/godevsig/gshellos/extension/secret"
+
+const redacted = "******"
+
+var secretNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type secretEntry struct {
+	Value   string
+	Updated time.Time
+}
+
+// secretStore keeps the secrets of the daemon encrypted in the secrets file,
+// the key is generated on first use and only readable by the daemon user.
+// The key is in the keys dir of the work dir unless given with daemon
+// -secret-key, anyone who can read the work dir can then decrypt them.
+type secretStore struct {
+	sync.Mutex
+	dir     string
+	file    string
+	keyFile string
+	secrets map[string]*secretEntry // nil if not loaded yet
+}
+
+func newSecretStore(dir, keyFile string) *secretStore {
+	return &secretStore{dir: dir, file: filepath.Join(dir, "secrets"), keyFile: keyFile}
+}
+
+func (ss *secretStore) cipher() (cipher.AEAD, error) {
+	if len(ss.keyFile) == 0 {
+		file, err := keyFile(ss.dir, "secret.key")
+		if err != nil {
+			return nil, err
+		}
+		ss.keyFile = file
+	}
+	key, err := os.ReadFile(ss.keyFile)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(ss.keyFile, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("secret key %s: %v", ss.keyFile, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// load must be called with lock held.
+func (ss *secretStore) load() error {
+	if ss.secrets != nil {
+		return nil
+	}
+	data, err := os.ReadFile(ss.file)
+	if os.IsNotExist(err) {
+		ss.secrets = make(map[string]*secretEntry)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	aead, err := ss.cipher()
+	if err != nil {
+		return err
+	}
+	if len(data) < aead.NonceSize() {
+		return fmt.Errorf("secrets file %s corrupted", ss.file)
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return fmt.Errorf("secrets file %s not decrypted: %v", ss.file, err)
+	}
+	secrets := make(map[string]*secretEntry)
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return err
+	}
+	ss.secrets = secrets
+	return nil
+}
+
+// save must be called with lock held.
+func (ss *secretStore) save() error {
+	plain, err := json.Marshal(ss.secrets)
+	if err != nil {
+		return err
+	}
+	aead, err := ss.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	tmpFile := ss.file + ".tmp"
+	if err := os.WriteFile(tmpFile, aead.Seal(nonce, nonce, plain, nil), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, ss.file)
+}
+
+func (ss *secretStore) set(name, value string) error {
+	ss.Lock()
+	defer ss.Unlock()
+	if err := ss.load(); err != nil {
+		return err
+	}
+	ss.secrets[name] = &secretEntry{Value: value, Updated: time.Now()}
+	return ss.save()
+}
+
+func (ss *secretStore) remove(names []string) ([]string, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	if err := ss.load(); err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, name := range names {
+		if _, has := ss.secrets[name]; has {
+			delete(ss.secrets, name)
+			removed = append(removed, name)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, ss.save()
+}
+
+func (ss *secretStore) list() ([]*secretInfo, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	if err := ss.load(); err != nil {
+		return nil, err
+	}
+	infos := make([]*secretInfo, 0, len(ss.secrets))
+	for name, se := range ss.secrets {
+		infos = append(infos, &secretInfo{Name: name, Updated: se.Updated})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (ss *secretStore) get(names []string) (map[string]string, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	if err := ss.load(); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		se, has := ss.secrets[name]
+		if !has {
+			return nil, fmt.Errorf("secret %s not found", name)
+		}
+		values[name] = se.Value
+	}
+	return values, nil
+}
+
+// redactMinLen is the min length of the secret values to be redacted, the
+// shorter values are too common to be replaced in the output.
+const redactMinLen = 4
+
+// redact replaces the values of the named secrets in the string.
+func (ss *secretStore) redact(str string, names []string) string {
+	if len(names) == 0 || len(str) == 0 {
+		return str
+	}
+	ss.Lock()
+	defer ss.Unlock()
+	if err := ss.load(); err != nil {
+		return str
+	}
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		if se, has := ss.secrets[name]; has && len(se.Value) >= redactMinLen {
+			values = append(values, se.Value)
+		}
+	}
+	// longer first in case one contains another
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		str = strings.ReplaceAll(str, value, redacted)
+	}
+	return str
+}
+
+func (ss *secretStore) redactAll(strs []string, names []string) []string {
+	if len(strs) == 0 {
+		return strs
+	}
+	out := make([]string, len(strs))
+	for i, str := range strs {
+		out[i] = ss.redact(str, names)
+	}
+	return out
+}
+
+func validateSecretNames(names []string) error {
+	for _, name := range names {
+		if !secretNameRegexp.MatchString(name) {
+			return fmt.Errorf("wrong secret name %q, letters, digits, _ . and - expected", name)
+		}
+	}
+	return nil
+}
+
+// secretSymbols returns the symbols of the secret package with the values
+// granted to the GRE.
+func secretSymbols(values map[string]string) map[string]reflect.Value {
+	get := func(name string) (string, error) {
+		value, has := values[name]
+		if !has {
+			return "", fmt.Errorf("secret %s not granted", name)
+		}
+		return value, nil
+	}
+	return map[string]reflect.Value{"Get": reflect.ValueOf(get)}
+}
+
+// fetchSecrets gets the values of the secrets of the job from the daemon.
+func (gc *greCtl) fetchSecrets() (map[string]string, error) {
+	values := make(map[string]string)
+	if len(gc.runMsg.Secrets) == 0 {
+		return values, nil
+	}
+	c := as.NewClient(as.WithScope(as.ScopeOS)).SetDiscoverTimeout(3)
+	conn := <-c.Discover(godevsigPublisher, "gshellDaemon")
+	if conn == nil {
+		return nil, errors.New("secrets not available: daemon not found")
+	}
+	defer conn.Close()
+	if err := conn.SendRecv(&cmdSecretGet{gc.ID, gc.runMsg.Secrets}, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// reply OK or error
+type cmdSecretSet struct {
+	Name  string
+	Value string
+}
+
+func (msg *cmdSecretSet) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleAdmin, "secret set"); err != nil {
+		return err
+	}
+	gd.lg.Debugf("handle cmdSecretSet: %s", msg.Name)
+	if err := validateSecretNames([]string{msg.Name}); err != nil {
+		return err
+	}
+	if err := gd.secrets.set(msg.Name, msg.Value); err != nil {
+		return err
+	}
+	gd.lg.Infof("secret %s set", msg.Name)
+	return as.OK
+}
+
+// reply with the removed names or error
+type cmdSecretRm struct {
+	Names []string
+}
+
+func (msg *cmdSecretRm) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleAdmin, "secret rm"); err != nil {
+		return err
+	}
+	gd.lg.Debugf("handle cmdSecretRm: %v", msg.Names)
+	removed, err := gd.secrets.remove(msg.Names)
+	if err != nil {
+		return err
+	}
+	if len(removed) != 0 {
+		gd.lg.Infof("secrets %v removed", removed)
+	}
+	return removed
+}
+
+type secretInfo struct {
+	Name    string
+	Updated time.Time
+}
+
+// reply with []*secretInfo or error
+type cmdSecretList struct{}
+
+func (msg cmdSecretList) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleReadOnly, "secret ls"); err != nil {
+		return err
+	}
+	infos, err := gd.secrets.list()
+	if err != nil {
+		return err
+	}
+	return infos
+}
+
+// reply with map[string]string or error
+// The values are only sent to the GRG on the same node where the GRE is, and
+// only those granted to the GRE.
+type cmdSecretGet struct {
+	GREID string
+	Names []string
+}
+
+func (msg *cmdSecretGet) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.localOnly(stream, "secret get"); err != nil {
+		return err
+	}
+	gd.lg.Debugf("handle cmdSecretGet: %s %v", msg.GREID, msg.Names)
+	granted, err := gd.grantedSecrets(stream.GetNetconn(), msg.GREID)
+	if err != nil {
+		gd.access.auditf("denied: secret get for GRE %s: %v", msg.GREID, err)
+		return fmt.Errorf("permission denied: %v", err)
+	}
+	for _, name := range msg.Names {
+		if !granted[name] {
+			gd.access.auditf("denied: secret get %s not granted to GRE %s", name, msg.GREID)
+			return fmt.Errorf("permission denied: secret %s not granted to GRE %s", name, msg.GREID)
+		}
+	}
+	values, err := gd.secrets.get(msg.Names)
+	if err != nil {
+		return err
+	}
+	return values
+}
+
+// grantedSecrets returns the secrets granted to the GRE when it was run, the
+// caller must be the GRG process of the daemon user where the GRE is.
+func (gd *daemon) grantedSecrets(netconn as.Netconn, greid string) (map[string]bool, error) {
+	if !greIDRegexp.MatchString(greid) {
+		return nil, fmt.Errorf("wrong GRE ID %q", greid)
+	}
+	cred, err := peerCred(netconn)
+	if err != nil {
+		return nil, err
+	}
+	if int(cred.Uid) != os.Getuid() {
+		return nil, fmt.Errorf("caller uid %d is not the daemon user", cred.Uid)
+	}
+	grgName, workDir := grgOfProcess(int(cred.Pid))
+	if len(grgName) == 0 || workDir != gd.workDir {
+		return nil, fmt.Errorf("caller pid %d is not a GRG of the daemon", cred.Pid)
+	}
+	grgBase := strings.Split(grgName, "-")[0]
+	runMsg, err := gd.greRunMsg("grg-"+grgBase+"-*", greid)
+	if err != nil {
+		return nil, err
+	}
+	granted := make(map[string]bool, len(runMsg.Secrets))
+	for _, name := range runMsg.Secrets {
+		granted[name] = true
+	}
+	return granted, nil
+}
+
+// greRunMsg returns the run message of the GRE saved in the status dir of
+// the GRG matching the pattern.
+func (gd *daemon) greRunMsg(grgPattern, greid string) (*grgCmdRun, error) {
+	files, _ := filepath.Glob(filepath.Join(gd.workDir, "status", grgPattern, greid, "runMsg"))
+	if len(files) == 0 {
+		return nil, fmt.Errorf("GRE %s not found in %s", greid, grgPattern)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	runMsg := &grgCmdRun{}
+	if err := gob.NewDecoder(f).Decode(runMsg); err != nil {
+		return nil, err
+	}
+	return runMsg, nil
+}
+
+// peerCred returns the credentials of the process at the other end of the
+// unix socket.
+func peerCred(netconn as.Netconn) (*syscall.Ucred, error) {
+	uc, ok := netconn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("caller not on unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// grgOfProcess returns the GRG name and the work dir in the args of the GRG
+// process started by the daemon, empty if the process is not a GRG.
+func grgOfProcess(pid int) (grgName, workDir string) {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", ""
+	}
+	args := strings.Split(string(cmdline), "\x00")
+	for i, arg := range args {
+		if arg != "__start" {
+			continue
+		}
+		for j := i + 1; j < len(args)-1; j++ {
+			switch args[j] {
+			case "-group":
+				grgName = args[j+1]
+			case "-wd":
+				workDir = args[j+1]
+			}
+		}
+		return grgName, workDir
+	}
+	return "", ""
+}
+
+func init() {
+	as.RegisterType((*cmdSecretSet)(nil))
+	as.RegisterType((*cmdSecretRm)(nil))
+	as.RegisterType(cmdSecretList{})
+	as.RegisterType((*cmdSecretGet)(nil))
+	as.RegisterType((*secretInfo)(nil))
+	as.RegisterType([]*secretInfo(nil))
+	as.RegisterType(map[string]string(nil))
+}
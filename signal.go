@@ -0,0 +1,301 @@
+package gshellos
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+)
+
+const stopGraceDefault = 10 * time.Second
+
+// the signals that can be caught by the GRE
+var catchableSignals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CHLD":  syscall.SIGCHLD,
+	"CONT":  syscall.SIGCONT,
+	"WINCH": syscall.SIGWINCH,
+	"URG":   syscall.SIGURG,
+}
+
+// parseSignal accepts signal number, or name with or without the SIG prefix.
+func parseSignal(str string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(str); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(str), "SIG")
+	if name == "KILL" {
+		return syscall.SIGKILL, nil
+	}
+	if sig, has := catchableSignals[name]; has {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %s", str)
+}
+
+// the default action of the signals is to terminate except these
+func ignoredByDefault(sig os.Signal) bool {
+	switch sig {
+	case syscall.SIGCHLD, syscall.SIGCONT, syscall.SIGWINCH, syscall.SIGURG:
+		return true
+	}
+	return false
+}
+
+// sigRelay simulates the signal delivery to the interpreted code of a GRE,
+// it provides the os/signal package of the interpreter.
+type sigRelay struct {
+	sync.Mutex
+	handlers map[chan<- os.Signal]map[os.Signal]bool
+	ignored  map[os.Signal]bool
+}
+
+func newSigRelay() *sigRelay {
+	return &sigRelay{handlers: make(map[chan<- os.Signal]map[os.Signal]bool), ignored: make(map[os.Signal]bool)}
+}
+
+func allSignals(sig []os.Signal) []os.Signal {
+	if len(sig) != 0 {
+		return sig
+	}
+	for _, s := range catchableSignals {
+		sig = append(sig, s)
+	}
+	return sig
+}
+
+func (sr *sigRelay) notify(c chan<- os.Signal, sig ...os.Signal) {
+	if c == nil {
+		panic("os/signal: Notify using nil channel")
+	}
+	sr.Lock()
+	defer sr.Unlock()
+	sigs := sr.handlers[c]
+	if sigs == nil {
+		sigs = make(map[os.Signal]bool)
+		sr.handlers[c] = sigs
+	}
+	for _, s := range allSignals(sig) {
+		sigs[s] = true
+		delete(sr.ignored, s)
+	}
+}
+
+func (sr *sigRelay) stop(c chan<- os.Signal) {
+	sr.Lock()
+	delete(sr.handlers, c)
+	sr.Unlock()
+}
+
+// remove the signals from all handlers, and ignore them if ignore is true.
+func (sr *sigRelay) remove(ignore bool, sig []os.Signal) {
+	sr.Lock()
+	defer sr.Unlock()
+	for _, s := range allSignals(sig) {
+		for c, sigs := range sr.handlers {
+			delete(sigs, s)
+			if len(sigs) == 0 {
+				delete(sr.handlers, c)
+			}
+		}
+		if ignore {
+			sr.ignored[s] = true
+		} else {
+			delete(sr.ignored, s)
+		}
+	}
+}
+
+func (sr *sigRelay) reset(sig ...os.Signal)  { sr.remove(false, sig) }
+func (sr *sigRelay) ignore(sig ...os.Signal) { sr.remove(true, sig) }
+
+func (sr *sigRelay) isIgnored(sig os.Signal) bool {
+	sr.Lock()
+	defer sr.Unlock()
+	return sr.ignored[sig]
+}
+
+func (sr *sigRelay) notifyContext(parent context.Context, sig ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	c := make(chan os.Signal, 1)
+	sr.notify(c, sig...)
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		sr.stop(c)
+		cancel()
+	}
+}
+
+// deliver sends the signal to the handlers without blocking like the os/signal
+// package does, returns false if the signal is neither handled nor ignored.
+func (sr *sigRelay) deliver(sig os.Signal) bool {
+	sr.Lock()
+	defer sr.Unlock()
+	if sr.ignored[sig] {
+		return true
+	}
+	handled := false
+	for c, sigs := range sr.handlers {
+		if sigs[sig] {
+			handled = true
+			select {
+			case c <- sig:
+			default:
+			}
+		}
+	}
+	return handled
+}
+
+func (sr *sigRelay) symbols() map[string]reflect.Value {
+	return map[string]reflect.Value{
+		"Ignore":        reflect.ValueOf(sr.ignore),
+		"Ignored":       reflect.ValueOf(sr.isIgnored),
+		"Notify":        reflect.ValueOf(sr.notify),
+		"NotifyContext": reflect.ValueOf(sr.notifyContext),
+		"Reset":         reflect.ValueOf(sr.reset),
+		"Stop":          reflect.ValueOf(sr.stop),
+	}
+}
+
+// signal sends the signal to the running GRE, the GRE is aborted if the
+// signal is not handled and the default action is to terminate.
+func (gc *greCtl) signal(sig syscall.Signal) error {
+	stat := atomic.LoadInt32(&gc.stat)
+	if stat != greStatRunning && stat != greStatUnhealthy && stat != greStatAborting {
+		return fmt.Errorf("GRE %s is %s", gc.ID, greStatString[stat])
+	}
+	if gc.runMsg.Isolate {
+		pid := gc.pid()
+		if pid == 0 {
+			return fmt.Errorf("GRE %s not started yet", gc.ID)
+		}
+		return syscall.Kill(pid, sig)
+	}
+	if sig != syscall.SIGKILL {
+		if !isCatchable(sig) {
+			return fmt.Errorf("signal %d not supported", int(sig))
+		}
+		if gc.signals.deliver(sig) || ignoredByDefault(sig) {
+			return nil
+		}
+	}
+	gc.cancel()
+	return nil
+}
+
+func isCatchable(sig syscall.Signal) bool {
+	for _, s := range catchableSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+func sigName(sig syscall.Signal) string {
+	for name, s := range catchableSignals {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	if sig == syscall.SIGKILL {
+		return "SIGKILL"
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// terminate stops the running GRE gracefully: SIGTERM is sent to the GRE which
+// is then aborted if not exited within the grace period.
+func (gc *greCtl) terminate(grace time.Duration) bool {
+	stat := atomic.LoadInt32(&gc.stat)
+	if grace <= 0 || stat != greStatRunning && stat != greStatUnhealthy {
+		return gc.stop()
+	}
+	gc.changeStatIf(greStatRunning, greStatAborting)
+	gc.changeStatIf(greStatUnhealthy, greStatAborting)
+	if err := gc.signal(syscall.SIGTERM); err != nil {
+		gc.cancel()
+		return true
+	}
+	end, cancel := gc.runEnd, gc.cancel
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-end:
+		}
+	}()
+	return true
+}
+
+// reply OK or error
+type grgCmdSignal struct {
+	GREID  string
+	Signal int
+}
+
+func (msg *grgCmdSignal) Handle(stream as.ContextStream) (reply interface{}) {
+	grg := stream.GetContext().(*grg)
+	grg.RLock()
+	gc := grg.gres[msg.GREID]
+	grg.RUnlock()
+	if gc == nil {
+		return fmt.Errorf("GRE %s not found", msg.GREID)
+	}
+	if err := gc.signal(syscall.Signal(msg.Signal)); err != nil {
+		return err
+	}
+	grg.lg.Infof("gre %s signaled with %s", gc.ID, sigName(syscall.Signal(msg.Signal)))
+	return as.OK
+}
+
+// reply OK or error
+type cmdSignal struct {
+	grgCmdSignal
+}
+
+func (msg *cmdSignal) Handle(stream as.ContextStream) (reply interface{}) {
+	gd := stream.GetContext().(*daemon)
+	if err := gd.authorize(stream, roleOperator, "signal"); err != nil {
+		return err
+	}
+	gd.lg.Debugf("handle cmdSignal: %v", msg)
+	conn, _ := gd.findGRE(msg.GREID)
+	if conn == nil {
+		return fmt.Errorf("GRE %s not found", msg.GREID)
+	}
+	defer conn.Close()
+	if err := conn.SendRecv(&msg.grgCmdSignal, nil); err != nil {
+		return err
+	}
+	return as.OK
+}
+
+func init() {
+	as.RegisterType((*grgCmdSignal)(nil))
+	as.RegisterType((*cmdSignal)(nil))
+}
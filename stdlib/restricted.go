@@ -1,11 +1,22 @@
 package stdlib
 
 import (
+	"context"
 	"errors"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var errRestricted = errors.New("restricted")
@@ -53,3 +64,253 @@ func (l *logLogger) Println(v ...interface{})          { l.l.Println(v...) }
 func (l *logLogger) SetFlags(flag int)                 { l.l.SetFlags(flag) }
 func (l *logLogger) SetOutput(w io.Writer)             { l.l.SetOutput(w) }
 func (l *logLogger) Writer() io.Writer                 { return l.l.Writer() }
+
+// OSView is the private view of the environment variables and the working
+// directory of the interpreted code, changes in the view do not affect the
+// process or other interpreters in the same process.
+// Relative paths are resolved against the working directory of the view.
+type OSView struct {
+	mu  sync.Mutex
+	env map[string]string
+	dir string
+}
+
+// NewOSView returns a view with the environment in the form "key=value",
+// later values win for the same key. dir should be absolute.
+func NewOSView(env []string, dir string) *OSView {
+	v := &OSView{env: make(map[string]string), dir: dir}
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			v.env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return v
+}
+
+// Symbols returns the wrappers to override those of the stdlib Symbols.
+func (v *OSView) Symbols() map[string]map[string]reflect.Value {
+	symbols := map[string]map[string]reflect.Value{
+		"os/os": {
+			"Chdir":      reflect.ValueOf(v.Chdir),
+			"Chmod":      reflect.ValueOf(func(name string, mode fs.FileMode) error { return os.Chmod(v.abs(name), mode) }),
+			"Chown":      reflect.ValueOf(func(name string, uid, gid int) error { return os.Chown(v.abs(name), uid, gid) }),
+			"Chtimes":    reflect.ValueOf(func(name string, atime, mtime time.Time) error { return os.Chtimes(v.abs(name), atime, mtime) }),
+			"Clearenv":   reflect.ValueOf(v.Clearenv),
+			"Create":     reflect.ValueOf(func(name string) (*os.File, error) { return os.Create(v.abs(name)) }),
+			"CreateTemp": reflect.ValueOf(func(dir, pattern string) (*os.File, error) { return os.CreateTemp(v.abs(dir), pattern) }),
+			"DirFS":      reflect.ValueOf(func(dir string) fs.FS { return os.DirFS(v.abs(dir)) }),
+			"Environ":    reflect.ValueOf(v.Environ),
+			"ExpandEnv":  reflect.ValueOf(func(s string) string { return os.Expand(s, v.Getenv) }),
+			"Getenv":     reflect.ValueOf(v.Getenv),
+			"Getwd":      reflect.ValueOf(v.Getwd),
+			"Lchown":     reflect.ValueOf(func(name string, uid, gid int) error { return os.Lchown(v.abs(name), uid, gid) }),
+			"Link":       reflect.ValueOf(func(oldname, newname string) error { return os.Link(v.abs(oldname), v.abs(newname)) }),
+			"LookupEnv":  reflect.ValueOf(v.LookupEnv),
+			"Lstat":      reflect.ValueOf(func(name string) (fs.FileInfo, error) { return os.Lstat(v.abs(name)) }),
+			"Mkdir":      reflect.ValueOf(func(name string, perm fs.FileMode) error { return os.Mkdir(v.abs(name), perm) }),
+			"MkdirAll":   reflect.ValueOf(func(path string, perm fs.FileMode) error { return os.MkdirAll(v.abs(path), perm) }),
+			"MkdirTemp":  reflect.ValueOf(func(dir, pattern string) (string, error) { return os.MkdirTemp(v.abs(dir), pattern) }),
+			"Open":       reflect.ValueOf(func(name string) (*os.File, error) { return os.Open(v.abs(name)) }),
+			"OpenFile": reflect.ValueOf(func(name string, flag int, perm fs.FileMode) (*os.File, error) {
+				return os.OpenFile(v.abs(name), flag, perm)
+			}),
+			"ReadDir":  reflect.ValueOf(func(name string) ([]fs.DirEntry, error) { return os.ReadDir(v.abs(name)) }),
+			"ReadFile": reflect.ValueOf(func(name string) ([]byte, error) { return os.ReadFile(v.abs(name)) }),
+			"Readlink": reflect.ValueOf(func(name string) (string, error) { return os.Readlink(v.abs(name)) }),
+			"Remove":   reflect.ValueOf(func(name string) error { return os.Remove(v.abs(name)) }),
+			"RemoveAll": reflect.ValueOf(func(path string) error {
+				if path == "" {
+					return nil // as os.RemoveAll does, not to remove the working directory
+				}
+				return os.RemoveAll(v.abs(path))
+			}),
+			"Rename":       reflect.ValueOf(func(oldpath, newpath string) error { return os.Rename(v.abs(oldpath), v.abs(newpath)) }),
+			"Setenv":       reflect.ValueOf(v.Setenv),
+			"StartProcess": reflect.ValueOf(v.StartProcess),
+			"Stat":         reflect.ValueOf(func(name string) (fs.FileInfo, error) { return os.Stat(v.abs(name)) }),
+			"Symlink":      reflect.ValueOf(func(oldname, newname string) error { return os.Symlink(oldname, v.abs(newname)) }),
+			"Truncate":     reflect.ValueOf(func(name string, size int64) error { return os.Truncate(v.abs(name), size) }),
+			"Unsetenv":     reflect.ValueOf(v.Unsetenv),
+			"WriteFile": reflect.ValueOf(func(name string, data []byte, perm fs.FileMode) error {
+				return os.WriteFile(v.abs(name), data, perm)
+			}),
+		},
+		"io/ioutil/ioutil": {
+			"ReadDir":  reflect.ValueOf(func(dirname string) ([]fs.FileInfo, error) { return ioutil.ReadDir(v.abs(dirname)) }),
+			"ReadFile": reflect.ValueOf(func(filename string) ([]byte, error) { return ioutil.ReadFile(v.abs(filename)) }),
+			"TempDir":  reflect.ValueOf(func(dir, pattern string) (string, error) { return ioutil.TempDir(v.abs(dir), pattern) }),
+			"TempFile": reflect.ValueOf(func(dir, pattern string) (*os.File, error) { return ioutil.TempFile(v.abs(dir), pattern) }),
+			"WriteFile": reflect.ValueOf(func(filename string, data []byte, perm fs.FileMode) error {
+				return ioutil.WriteFile(v.abs(filename), data, perm)
+			}),
+		},
+		"os/exec/exec": {
+			"Command": reflect.ValueOf(func(name string, arg ...string) *exec.Cmd {
+				return v.command(exec.Command, name, arg)
+			}),
+			"CommandContext": reflect.ValueOf(func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+				return v.command(func(name string, arg ...string) *exec.Cmd { return exec.CommandContext(ctx, name, arg...) }, name, arg)
+			}),
+			"LookPath": reflect.ValueOf(v.LookPath),
+		},
+		"path/filepath/filepath": {
+			"Abs": reflect.ValueOf(func(path string) (string, error) { return v.abs(filepath.Clean(path)), nil }),
+		},
+	}
+	// only override the packages in use
+	for key := range symbols {
+		if _, has := Symbols[key]; !has {
+			delete(symbols, key)
+		}
+	}
+	return symbols
+}
+
+// abs returns the path relative to the working directory of the view, empty
+// path is kept as is.
+func (v *OSView) abs(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(v.wd(), path)
+}
+
+func (v *OSView) wd() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.dir
+}
+
+// Getwd returns the working directory of the view.
+func (v *OSView) Getwd() (string, error) { return v.wd(), nil }
+
+// Chdir changes the working directory of the view.
+func (v *OSView) Chdir(dir string) error {
+	path := v.abs(dir)
+	fi, err := os.Stat(path)
+	if err != nil {
+		if pe, ok := err.(*fs.PathError); ok {
+			err = pe.Err
+		}
+		return &fs.PathError{Op: "chdir", Path: dir, Err: err}
+	}
+	if !fi.IsDir() {
+		return &fs.PathError{Op: "chdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	v.mu.Lock()
+	v.dir = path
+	v.mu.Unlock()
+	return nil
+}
+
+// Getenv returns the value of the environment variable in the view.
+func (v *OSView) Getenv(key string) string {
+	value, _ := v.LookupEnv(key)
+	return value
+}
+
+// LookupEnv returns the value of the environment variable in the view and
+// whether it is present.
+func (v *OSView) LookupEnv(key string) (string, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	value, has := v.env[key]
+	return value, has
+}
+
+// Setenv sets the environment variable in the view.
+func (v *OSView) Setenv(key, value string) error {
+	if key == "" || strings.ContainsAny(key, "=\x00") || strings.Contains(value, "\x00") {
+		return os.NewSyscallError("setenv", syscall.EINVAL)
+	}
+	v.mu.Lock()
+	v.env[key] = value
+	v.mu.Unlock()
+	return nil
+}
+
+// Unsetenv unsets the environment variable in the view.
+func (v *OSView) Unsetenv(key string) error {
+	v.mu.Lock()
+	delete(v.env, key)
+	v.mu.Unlock()
+	return nil
+}
+
+// Clearenv deletes all environment variables in the view.
+func (v *OSView) Clearenv() {
+	v.mu.Lock()
+	v.env = make(map[string]string)
+	v.mu.Unlock()
+}
+
+// Environ returns the environment of the view in the form "key=value".
+func (v *OSView) Environ() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	env := make([]string, 0, len(v.env))
+	for key, value := range v.env {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// StartProcess starts the process in the working directory and with the
+// environment of the view if not specified in attr.
+func (v *OSView) StartProcess(name string, argv []string, attr *os.ProcAttr) (*os.Process, error) {
+	pa := os.ProcAttr{}
+	if attr != nil {
+		pa = *attr
+	}
+	if pa.Dir == "" {
+		pa.Dir = v.wd()
+	} else {
+		pa.Dir = v.abs(pa.Dir)
+	}
+	if pa.Env == nil {
+		pa.Env = v.Environ()
+	}
+	return os.StartProcess(v.abs(name), argv, &pa)
+}
+
+// LookPath searches the executable file in the PATH of the view.
+func (v *OSView) LookPath(file string) (string, error) {
+	if strings.Contains(file, "/") {
+		if isExecutable(v.abs(file)) {
+			return file, nil
+		}
+		return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+	}
+	for _, dir := range filepath.SplitList(v.Getenv("PATH")) {
+		if dir == "" {
+			dir = "." // Unix shell semantics: path element "" means "."
+		}
+		path := filepath.Join(dir, file)
+		if isExecutable(v.abs(path)) {
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+func isExecutable(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir() && fi.Mode()&0111 != 0
+}
+
+// command creates the Cmd which runs in the working directory and with the
+// environment of the view by default, the name is looked up in the PATH of the view.
+func (v *OSView) command(newCmd func(name string, arg ...string) *exec.Cmd, name string, arg []string) *exec.Cmd {
+	path := name
+	if !strings.Contains(name, "/") {
+		if lp, err := v.LookPath(name); err == nil {
+			path = v.abs(lp)
+		}
+	}
+	cmd := newCmd(path, arg...)
+	cmd.Args[0] = name
+	cmd.Dir = v.wd()
+	cmd.Env = v.Environ()
+	return cmd
+}
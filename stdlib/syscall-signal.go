@@ -0,0 +1,32 @@
+//go:build stdbase
+// +build stdbase
+
+package stdlib
+
+import (
+	"reflect"
+	"syscall"
+)
+
+// Only the signals are exported from syscall, to be used with os/signal.
+func init() {
+	Symbols["syscall/syscall"] = map[string]reflect.Value{
+		// function, constant and variable definitions
+		"SIGALRM":  reflect.ValueOf(syscall.SIGALRM),
+		"SIGCHLD":  reflect.ValueOf(syscall.SIGCHLD),
+		"SIGCONT":  reflect.ValueOf(syscall.SIGCONT),
+		"SIGHUP":   reflect.ValueOf(syscall.SIGHUP),
+		"SIGINT":   reflect.ValueOf(syscall.SIGINT),
+		"SIGKILL":  reflect.ValueOf(syscall.SIGKILL),
+		"SIGPIPE":  reflect.ValueOf(syscall.SIGPIPE),
+		"SIGQUIT":  reflect.ValueOf(syscall.SIGQUIT),
+		"SIGTERM":  reflect.ValueOf(syscall.SIGTERM),
+		"SIGURG":   reflect.ValueOf(syscall.SIGURG),
+		"SIGUSR1":  reflect.ValueOf(syscall.SIGUSR1),
+		"SIGUSR2":  reflect.ValueOf(syscall.SIGUSR2),
+		"SIGWINCH": reflect.ValueOf(syscall.SIGWINCH),
+
+		// type definitions
+		"Signal": reflect.ValueOf((*syscall.Signal)(nil)),
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var counter int
+
+func status() string {
+	return fmt.Sprintf("counter is %d", counter)
+}
+
+func main() {
+	fmt.Println("counting")
+	for {
+		counter++
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+func main() {
+	fmt.Println("crashing")
+	go func() {
+		var m map[string]int
+		m["crash"] = 1 // panic in goroutine kills the whole process
+	}()
+	time.Sleep(time.Second)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func main() {
+	wd, _ := os.Getwd()
+	fmt.Println("workdir:", wd)
+	fmt.Println("GREETING:", os.Getenv("GREETING"))
+	os.Setenv("GREETING", "changed")
+
+	if err := os.WriteFile("env.out", []byte(os.Getenv("GREETING")), 0644); err != nil {
+		fmt.Println(err)
+	}
+	if err := os.Mkdir("sub", 0755); err != nil {
+		fmt.Println(err)
+	}
+	if err := os.Chdir("sub"); err != nil {
+		fmt.Println(err)
+	}
+	wd, _ = os.Getwd()
+	fmt.Println("chdir:", wd)
+	out, err := exec.Command("sh", "-c", "pwd; echo $GREETING").Output()
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Print("exec: ", string(out))
+}
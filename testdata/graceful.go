@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "stubborn" {
+		signal.Ignore(syscall.SIGTERM)
+		fmt.Println("ignoring SIGTERM")
+		time.Sleep(time.Hour)
+		return
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGUSR1)
+	fmt.Println("waiting for signals")
+	for sig := range c {
+		fmt.Println("got", sig)
+		if sig == syscall.SIGTERM {
+			fmt.Println("cleaning up")
+			time.Sleep(500 * time.Millisecond)
+			fmt.Println("bye")
+			return
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+func main() {
+	n := 10
+	if len(os.Args) >= 2 {
+		if i, err := strconv.Atoi(os.Args[1]); err == nil {
+			n = i
+		}
+	}
+	for i := 0; i < n; i++ {
+		fmt.Printf("line %04d: the quick brown fox jumps over the lazy dog\n", i)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+func main() {
+	for i := 0; i < 3; i++ {
+		fmt.Println("stdout line", i)
+		fmt.Fprintln(os.Stderr, "stderr line", i)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/godevsig/gshellos/extension/secret"
+)
+
+func main() {
+	token, err := secret.Get("api-token")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("token length:", len(token))
+	if len(os.Args) > 1 && os.Args[1] == token {
+		fmt.Println("token matched")
+	}
+	if _, err := secret.Get("other"); err != nil {
+		fmt.Println(err)
+	}
+}